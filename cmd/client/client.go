@@ -2,45 +2,36 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dayvidpham/ipcache/internal/config"
 	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/transport"
 )
 
 //////////////////////////////////////////////////////////////
 // Declare and init basic CLI flags
 //////////////////////////////////////////////////////////////
 
-/**
- * Required flags:
- * --server <hostname | IP (probably just tls.Dial format)>
- * --port <positive number>
- * --cert <path>
- * --privatekey <path>
- * --publickey <path> (probably don't need)
- *
- * --server root CAs
- */
-
-var parsedServer string
-var parsedPort uint
-var parsedCertPath string
-var parsedPrivatekeyPath string
-var parsedServerRootCACert string
-var nflagsRequired int = 5
+var clientFlags *config.ClientFlags
+
+const (
+	handshakeTimeout = 10 * time.Second
+	callTimeout      = 10 * time.Second
+	dialRetries      = 2
+	dialRetryDelay   = time.Second
+)
 
 func init() {
-	flag.StringVar(&parsedServer, "server", "", "server to connect to; examples <ipcache.com | 192.168.0.1> ")
-	flag.UintVar(&parsedPort, "port", 0, "server port to connect to; examples <8080 | 4430>")
-	flag.StringVar(&parsedCertPath, "cert", "", "path to your certificate")
-	flag.StringVar(&parsedPrivatekeyPath, "privatekey", "", "path to your private key that was used to sign your certificate")
-	flag.StringVar(&parsedServerRootCACert, "server-root-ca-cert", "", "path to the expected server root CA certificate, used for verification")
+	clientFlags = config.BindClientFlags(flag.CommandLine)
 }
 
 func main() {
@@ -50,47 +41,34 @@ func main() {
 	// Proccess flags
 	///////////////////////////////
 	flag.Parse()
-	log.Println("[DEBUG] --server", parsedServer)
-	log.Println("[DEBUG] --port", parsedPort)
-	log.Println("[DEBUG] --cert", parsedCertPath)
-	log.Println("[DEBUG] --privatekey", parsedPrivatekeyPath)
-	log.Println("[DEBUG] --server-root-ca-cert", parsedServerRootCACert)
-
-	// NOTE: Want some data type binding (var, flagname, Flag) for convenience error-checking
-	// Could also maybe use the Visitor for error-checking?
-	if flag.NFlag() < nflagsRequired {
-		log.Panicf("[FATAL] Require at least %d flags to be set, but were only given %d\n", nflagsRequired, flag.NFlag())
+	cfg, err := clientFlags.Load()
+	if err != nil {
+		log.Println("[FATAL] Invalid config\n\t-", strings.ReplaceAll(err.Error(), "\n", "\n\t- "))
+		return
 	}
+	log.Printf("[DEBUG] config: %+v\n", cfg)
 
-	parsedServerAddr := fmt.Sprintf("%s:%d", parsedServer, parsedPort)
-
-	///////////////////////////////
-	// Main client program
-	// Referencing https://gist.github.com/denji/12b3a568f092ab951456
-	///////////////////////////////
-
-	caCert, err := os.ReadFile(parsedServerRootCACert)
+	parsedServerAddr := cfg.Addr()
+	framing, err := cfg.ParsedFraming()
 	if err != nil {
-		log.Println("[FATAL] Reading Root CA PEM file failed.\n\t- Reason:", err)
+		log.Println("[FATAL]", err)
 		return
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	///////////////////////////////
+	// Main client program
+	///////////////////////////////
 
-	cert, err := tls.LoadX509KeyPair(parsedCertPath, parsedPrivatekeyPath)
+	dialConfig, err := cfg.DialConfig()
 	if err != nil {
-		log.Println("[FATAL] Loading X509 key pair failed.\n\t- Reason:", err)
+		log.Println("[FATAL]", err)
 		return
 	}
+	dialConfig.HandshakeTimeout = handshakeTimeout
+	dialConfig.Retries = dialRetries
+	dialConfig.RetryDelay = dialRetryDelay
 
-	config := tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-	}
-
-	conn, err := tls.Dial("tcp", parsedServerAddr, &config)
+	conn, err := transport.Dial(context.Background(), dialConfig)
 	if err != nil {
 		log.Println("[FATAL] Failed to establish connection to the server at", parsedServerAddr, "\n\t- Reason:", err)
 		return
@@ -102,22 +80,19 @@ func main() {
 	// Referencing https://gist.github.com/denji/12b3a568f092ab951456
 	///////////////////////////////
 
-	client := msgs.NewMessenger(conn)
+	client := msgs.NewAsyncMessengerWithFraming(context.Background(), conn, framing)
+	defer client.Close()
 
-	sendMsg := msgs.DaemonRegister()
-	n, err := client.SendN(sendMsg)
-	log.Printf("[INFO] Sending message of %d bytes, %d bytes sitting in buffer", sendMsg.Size(), n)
+	version, err := msgs.Handshake(client, handshakeTimeout)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	log.Println("[INFO] Negotiated protocol version", version)
 
-	okMsg, err := client.Receive()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	log.Printf("Registration succeeded: Got Ok from server, %d total bytes\n\n", okMsg.Size())
+	// Only queries: registering would take over the entry of a clientd
+	// running with the same certificate on this host
+	go printUnsolicited(client)
 
 	scan := bufio.NewScanner(os.Stdin)
 	fmt.Print(">>> ")
@@ -129,8 +104,24 @@ func main() {
 			continue
 		}
 
-		sendMsg = msgs.String(input)
-		err := client.Send(sendMsg)
+		switch fields := strings.Fields(input); fields[0] {
+		case "getips":
+			err = getIPs(client, fields[1:])
+		case "grant", "revoke":
+			err = changeAuthorization(client, fields[0], fields[1:])
+		case "subscribe", "unsubscribe":
+			err = changeSubscription(client, fields[0], fields[1:])
+		case "whoami":
+			err = whoAmI(client)
+		case "services":
+			err = getServices(client, fields[1:])
+		default:
+			sendMsg := msgs.String(input)
+			if framing == msgs.Framing_JSON {
+				sendMsg = msgs.StringJSON(input)
+			}
+			err = client.Send(sendMsg)
+		}
 		/*
 			log.Printf("[INFO] (Before) Sending message of %d bytes, %d bytes sitting in buffer\n", sendMsg.Size(), n)
 			n, err := client.SendN(sendMsg)
@@ -146,3 +137,228 @@ func main() {
 	}
 
 }
+
+func getIPs(client msgs.Messenger, skids []string) (err error) {
+	sendMsg, err := msgs.Marshal(msgs.T_ClientGetIPs, msgs.GetIPsRequest{Skids: skids})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(ctx, sendMsg)
+	if err != nil {
+		return err
+	}
+
+	switch recvMsg.Type {
+	case msgs.T_ServerIPs:
+		var resp msgs.GetIPsResponse
+		if err = msgs.Unmarshal(recvMsg, &resp); err != nil {
+			return err
+		}
+		for _, entry := range resp.Entries {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.Skid, entry.IP, time.Unix(entry.UnixTimestampUtc, 0).UTC(), liveness(entry))
+			for _, addr := range entry.Addrs {
+				fmt.Printf("\t- %s\n", describeAddr(addr))
+			}
+		}
+		fmt.Printf("(%d entries)\n", len(resp.Entries))
+	case msgs.T_Err:
+		return printRefusal(recvMsg)
+	default:
+		return fmt.Errorf("[ERROR] Expected the server to respond with MessageType ServerIPs, but got %s\n", recvMsg.Type)
+	}
+	return
+}
+
+func liveness(entry msgs.IPEntry) string {
+	if entry.Expired {
+		return fmt.Sprintf("expired at %s", time.Unix(entry.ExpiresAtUtc, 0).UTC())
+	}
+	if entry.Online {
+		return fmt.Sprintf("online since %s, last ping %s", time.Unix(entry.ConnectedSinceUtc, 0).UTC(), time.Unix(entry.LastPingUtc, 0).UTC())
+	}
+	if entry.DisconnectedAtUtc == 0 {
+		return "offline"
+	}
+	return fmt.Sprintf("offline since %s, expires %s", time.Unix(entry.DisconnectedAtUtc, 0).UTC(), time.Unix(entry.ExpiresAtUtc, 0).UTC())
+}
+
+// services [name=<service>] [skid...]
+func getServices(client msgs.Messenger, args []string) (err error) {
+	var req msgs.GetServicesRequest
+	for _, arg := range args {
+		if name, ok := strings.CutPrefix(arg, "name="); ok {
+			req.Name = name
+		} else {
+			req.Skids = append(req.Skids, arg)
+		}
+	}
+
+	sendMsg, err := msgs.Marshal(msgs.T_ClientGetServices, req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(ctx, sendMsg)
+	if err != nil {
+		return err
+	}
+
+	switch recvMsg.Type {
+	case msgs.T_ServerServices:
+		var resp msgs.GetServicesResponse
+		if err = msgs.Unmarshal(recvMsg, &resp); err != nil {
+			return err
+		}
+		for _, entry := range resp.Entries {
+			state := "offline"
+			if entry.Online {
+				state = "online"
+			}
+			fmt.Printf("%s\t%s\n", entry.Skid, state)
+			for _, svc := range entry.Services {
+				fmt.Printf("\t- %s\n", svc)
+			}
+		}
+		fmt.Printf("(%d entries)\n", len(resp.Entries))
+	case msgs.T_Err:
+		return printRefusal(recvMsg)
+	default:
+		return fmt.Errorf("[ERROR] Expected the server to respond with MessageType ServerServices, but got %s\n", recvMsg.Type)
+	}
+	return
+}
+
+func describeAddr(addr msgs.Address) string {
+	desc := fmt.Sprintf("%s (%s, %s)", addr, addr.Family, addr.Scope)
+	if addr.Observed {
+		desc += ", observed"
+	}
+	return desc
+}
+
+func changeAuthorization(client msgs.Messenger, action string, skids []string) (err error) {
+	if len(skids) != 1 {
+		fmt.Printf("Usage: %s <skid>\n", action)
+		return
+	}
+
+	msgT := msgs.T_ClientGrantAuthorization
+	if action == "revoke" {
+		msgT = msgs.T_ClientRevokeAuthorization
+	}
+	sendMsg, err := msgs.Marshal(msgT, msgs.GrantRequest{Other: skids[0], Type: msgs.AuthT_GetIP})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(ctx, sendMsg)
+	if err != nil {
+		return err
+	}
+	return printOk(recvMsg)
+}
+
+func changeSubscription(client msgs.Messenger, action string, skids []string) (err error) {
+	if len(skids) == 0 {
+		fmt.Printf("Usage: %s <skid> [skid ...]\n", action)
+		return
+	}
+
+	msgT := msgs.T_ClientSubscribe
+	if action == "unsubscribe" {
+		msgT = msgs.T_ClientUnsubscribe
+	}
+	sendMsg, err := msgs.Marshal(msgT, msgs.SubscribeRequest{Skids: skids})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(ctx, sendMsg)
+	if err != nil {
+		return err
+	}
+	return printOk(recvMsg)
+}
+
+func whoAmI(client msgs.Messenger) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(ctx, msgs.WhoAmI())
+	if err != nil {
+		return err
+	}
+	switch recvMsg.Type {
+	case msgs.T_ServerWhoAmI:
+		break
+	case msgs.T_Err:
+		return printRefusal(recvMsg)
+	default:
+		return fmt.Errorf("[ERROR] Expected the server to respond with MessageType ServerWhoAmI or Err, but got %s\n", recvMsg.Type)
+	}
+
+	var resp msgs.WhoAmIResponse
+	if err = msgs.Unmarshal(recvMsg, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("SKID:    %s\n", resp.Skid)
+	fmt.Printf("Address: %s\n", net.JoinHostPort(resp.IP.String(), strconv.Itoa(resp.Port)))
+	fmt.Printf("Subject: %s\n", resp.Subject)
+	return
+}
+
+// Notifications arrive at any time, so they are printed over the prompt
+func printUnsolicited(client msgs.Messenger) {
+	for recvMsg := range client.Unsolicited() {
+		if recvMsg.Type == msgs.T_ServerShutdown {
+			var notice msgs.ShutdownNotice
+			if err := msgs.Unmarshal(recvMsg, &notice); err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Printf("\n[Server shutting down] %s, reconnect after %s\n>>> ", notice.Reason, notice.ReconnectAfter)
+			continue
+		}
+		if recvMsg.Type != msgs.T_ServerIPChanged {
+			fmt.Printf("\n[%s from server]\n>>> ", recvMsg.Type)
+			continue
+		}
+
+		var changed msgs.IPChangedNotification
+		if err := msgs.Unmarshal(recvMsg, &changed); err != nil {
+			log.Println(err)
+			continue
+		}
+		entry := changed.Entry
+		fmt.Printf("\n[IP changed] %s\t%s\t%s\n>>> ", entry.Skid, entry.IP, time.Unix(entry.UnixTimestampUtc, 0).UTC())
+	}
+}
+
+func printOk(recvMsg msgs.Message) (err error) {
+	switch recvMsg.Type {
+	case msgs.T_Ok:
+		var ok msgs.OkPayload
+		if err = msgs.Unmarshal(recvMsg, &ok); err != nil {
+			return err
+		}
+		fmt.Printf("Ok: %s\n", ok.Message)
+	case msgs.T_Err:
+		return printRefusal(recvMsg)
+	default:
+		return fmt.Errorf("[ERROR] Expected the server to respond with MessageType Ok or Err, but got %s\n", recvMsg.Type)
+	}
+	return
+}
+
+func printRefusal(errMsg msgs.Message) (err error) {
+	var reason msgs.ErrorPayload
+	if err = msgs.Unmarshal(errMsg, &reason); err != nil {
+		return err
+	}
+	fmt.Printf("Server refused: %v\n", reason)
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestLiveness(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry msgs.IPEntry
+		want  string
+	}{
+		{"online", msgs.IPEntry{Online: true, ConnectedSinceUtc: 60, LastPingUtc: 120}, "online since 1970-01-01 00:01:00 +0000 UTC, last ping 1970-01-01 00:02:00 +0000 UTC"},
+		{"never connected", msgs.IPEntry{}, "offline"},
+		{"disconnected", msgs.IPEntry{DisconnectedAtUtc: 60, ExpiresAtUtc: 120}, "offline since 1970-01-01 00:01:00 +0000 UTC, expires 1970-01-01 00:02:00 +0000 UTC"},
+		{"expired", msgs.IPEntry{Expired: true, DisconnectedAtUtc: 60, ExpiresAtUtc: 120}, "expired at 1970-01-01 00:02:00 +0000 UTC"},
+	}
+	for _, tt := range tests {
+		if got := liveness(tt.entry); got != tt.want {
+			t.Errorf("%s: liveness = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr msgs.Address
+		want string
+	}{
+		{"bare", msgs.Address{IP: net.ParseIP("192.0.2.1"), Family: "ipv4", Scope: "global"}, "192.0.2.1 (ipv4, global)"},
+		{"labelled with a port", msgs.Address{IP: net.ParseIP("fe80::1"), Family: "ipv6", Scope: "link-local", Port: 4431, Label: "lan"}, "lan=[fe80::1]:4431 (ipv6, link-local)"},
+		{"observed", msgs.Address{IP: net.ParseIP("198.51.100.7"), Family: "ipv4", Scope: "global", Observed: true}, "198.51.100.7 (ipv4, global), observed"},
+	}
+	for _, tt := range tests {
+		if got := describeAddr(tt.addr); got != tt.want {
+			t.Errorf("%s: describeAddr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// Repeatable --addr, each one label=ip[:port]
+type addrsFlag []msgs.Address
+
+func (a *addrsFlag) String() string {
+	strs := make([]string, len(*a))
+	for i, addr := range *a {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (a *addrsFlag) Set(value string) error {
+	addr, err := msgs.ParseAddress(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, addr)
+	return nil
+}
+
+// Repeatable --service, each one name=protocol/port[,key=value...]
+type servicesFlag []msgs.ServiceRecord
+
+func (s *servicesFlag) String() string {
+	strs := make([]string, len(*s))
+	for i, svc := range *s {
+		strs[i] = svc.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+func (s *servicesFlag) Set(value string) error {
+	svc, err := msgs.ParseService(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, svc)
+	return nil
+}
+
+// Addresses sent in DaemonRegister: the --addr ones, then, if
+// `publishLocal`, those of interfaceAddrs
+func publishedAddrs(static []msgs.Address, publishLocal bool) (addrs []msgs.Address, err error) {
+	addrs = append(addrs, static...)
+	if !publishLocal {
+		return addrs, nil
+	}
+
+	local, err := interfaceAddrs()
+	return append(addrs, local...), err
+}
+
+// The global unicast address of every interface that is up, labelled with
+// the interface's name. WatchAddrs lists the same ones, so that it only
+// reports changes to what gets published.
+func interfaceAddrs() (addrs []msgs.Address, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return addrs, err
+		}
+		for _, ifaddr := range ifaddrs {
+			if ip, ok := usableAddr(iface.Flags, ifaddr); ok {
+				addrs = append(addrs, msgs.NewAddress(ip, 0, iface.Name))
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// Whether `ifaddr`, on an interface with `flags`, is worth publishing
+func usableAddr(flags net.Flags, ifaddr net.Addr) (ip net.IP, ok bool) {
+	ipnet, ok := ifaddr.(*net.IPNet)
+	if !ok || flags&net.FlagUp == 0 || !ipnet.IP.IsGlobalUnicast() {
+		return nil, false
+	}
+	return ipnet.IP, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestUsableAddr(t *testing.T) {
+	ipnet := func(s string) *net.IPNet {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	tests := []struct {
+		name   string
+		flags  net.Flags
+		ifaddr net.Addr
+		want   bool
+	}{
+		{"global IPv4", net.FlagUp, ipnet("192.0.2.1/24"), true},
+		{"private IPv4", net.FlagUp, ipnet("10.0.0.1/8"), true},
+		{"global IPv6", net.FlagUp, ipnet("2001:db8::1/64"), true},
+		{"interface down", 0, ipnet("192.0.2.1/24"), false},
+		{"loopback", net.FlagUp | net.FlagLoopback, ipnet("127.0.0.1/8"), false},
+		{"link-local", net.FlagUp, ipnet("fe80::1/64"), false},
+		{"not an IPNet", net.FlagUp, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+	}
+	for _, tt := range tests {
+		ip, ok := usableAddr(tt.flags, tt.ifaddr)
+		if ok != tt.want {
+			t.Errorf("%s: usableAddr = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && !ip.Equal(tt.ifaddr.(*net.IPNet).IP) {
+			t.Errorf("%s: usableAddr = %s, want %s", tt.name, ip, tt.ifaddr)
+		}
+	}
+}
+
+func TestPublishedAddrsWithoutLocal(t *testing.T) {
+	static := []msgs.Address{msgs.NewAddress(net.ParseIP("198.51.100.1"), 22, "wan")}
+	addrs, err := publishedAddrs(static, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Label != "wan" {
+		t.Fatalf("publishedAddrs = %v, want only the --addr ones", addrs)
+	}
+}
+
+func TestLocalAddrsMatchPublished(t *testing.T) {
+	published, err := publishedAddrs(nil, true)
+	if err != nil {
+		t.Skip("cannot list interfaces:", err)
+	}
+	watched, err := localAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(watched) != len(published) {
+		t.Fatalf("WatchAddrs sees %v, but %v get published", watched, published)
+	}
+	for _, addr := range published {
+		found := false
+		for _, ip := range watched {
+			found = found || ip.Equal(addr.IP)
+		}
+		if !found {
+			t.Errorf("%s is published but not watched", addr.IP)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"time"
+)
+
+// How long addresses must stay put before a change is reported, so that a
+// burst of events, e.g. from a DHCP renewal, ends in one reconnect
+const addrSettleDelay = 2 * time.Second
+
+// Sends the addresses of interfaceAddrs every time that set changes. Changes
+// are picked up from netlink where the platform supports it, and by polling
+// every `pollInterval` otherwise.
+func WatchAddrs(ctx context.Context, pollInterval time.Duration) <-chan []net.IP {
+	changed := make(chan []net.IP, 1)
+
+	go func() {
+		defer close(changed)
+
+		prev, err := localAddrs()
+		if err != nil {
+			log.Println("[ERROR] Failed to list local addresses\n\t-", err)
+		}
+
+		for range debounce(ctx, addrEvents(ctx, pollInterval), addrSettleDelay) {
+			addrs, err := localAddrs()
+			if err != nil {
+				log.Println("[ERROR] Failed to list local addresses\n\t-", err)
+				continue
+			}
+			if slices.EqualFunc(prev, addrs, net.IP.Equal) {
+				continue
+			}
+			prev = addrs
+
+			// Only the latest set matters, so replace any unread one
+			select {
+			case <-changed:
+			default:
+			}
+			changed <- addrs
+		}
+	}()
+
+	return changed
+}
+
+// Sorted, so that two snapshots can be compared directly
+func localAddrs() (ips []net.IP, err error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	slices.SortFunc(ips, func(a net.IP, b net.IP) int {
+		return slices.Compare(a.To16(), b.To16())
+	})
+	return ips, nil
+}
+
+// Ticks every `interval` until ctx is cancelled
+func pollEvents(ctx context.Context, interval time.Duration) <-chan struct{} {
+	events := make(chan struct{})
+
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				events <- struct{}{}
+			}
+		}
+	}()
+
+	return events
+}
+
+// Ticks once `events` has been quiet for `quiet` since its last tick, so a
+// burst of events ticks once. Closes once `events` does.
+func debounce(ctx context.Context, events <-chan struct{}, quiet time.Duration) <-chan struct{} {
+	settled := make(chan struct{})
+
+	go func() {
+		defer close(settled)
+		var (
+			timer *time.Timer
+			fired <-chan time.Time
+		)
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.NewTimer(quiet)
+				fired = timer.C
+			case <-fired:
+				fired = nil
+				select {
+				case settled <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return settled
+}
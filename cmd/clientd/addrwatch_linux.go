@@ -0,0 +1,91 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// How often a blocked netlink read wakes up to check for cancellation
+const netlinkReadTimeout = time.Second
+
+// Multicast groups from linux/rtnetlink.h, missing from package syscall
+const (
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// Ticks on every RTM_NEWADDR or RTM_DELADDR from the kernel. Falls back to
+// polling if the netlink socket cannot be opened.
+func addrEvents(ctx context.Context, pollInterval time.Duration) <-chan struct{} {
+	fd, err := openNetlink()
+	if err != nil {
+		log.Printf("[ERROR] Failed to watch addresses over netlink, polling every %s instead\n\t- %v\n", pollInterval, err)
+		return pollEvents(ctx, pollInterval)
+	}
+
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		defer syscall.Close(fd)
+
+		buf := make([]byte, syscall.Getpagesize())
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			if err != nil {
+				log.Println("[ERROR] Failed to read from netlink, no longer watching addresses\n\t-", err)
+				return
+			}
+
+			nlmsgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, nlmsg := range nlmsgs {
+				if nlmsg.Header.Type != syscall.RTM_NEWADDR && nlmsg.Header.Type != syscall.RTM_DELADDR {
+					continue
+				}
+				select {
+				case events <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				break
+			}
+		}
+	}()
+
+	return events
+}
+
+// Subscribes to IPv4 and IPv6 address changes, with a read timeout so the
+// reader can notice cancellation
+func openNetlink() (fd int, err error) {
+	fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr,
+	}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	tv := syscall.NsecToTimeval(netlinkReadTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+func addrEvents(ctx context.Context, pollInterval time.Duration) <-chan struct{} {
+	return pollEvents(ctx, pollInterval)
+}
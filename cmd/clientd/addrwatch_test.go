@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	const quiet = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan struct{})
+	settled := debounce(ctx, events, quiet)
+
+	// A burst ticks once, after it ends
+	start := time.Now()
+	for range 5 {
+		events <- struct{}{}
+		time.Sleep(quiet / 5)
+	}
+	select {
+	case <-settled:
+		if elapsed := time.Since(start); elapsed < quiet {
+			t.Fatalf("ticked after %s, before the burst settled", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("burst never settled")
+	}
+	select {
+	case <-settled:
+		t.Fatal("burst ticked twice")
+	case <-time.After(2 * quiet):
+	}
+
+	// A later event ticks again
+	events <- struct{}{}
+	select {
+	case <-settled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second event never settled")
+	}
+
+	close(events)
+	select {
+	case _, ok := <-settled:
+		if ok {
+			t.Fatal("ticked after events closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("settled was not closed")
+	}
+}
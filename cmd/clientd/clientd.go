@@ -1,42 +1,45 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
-	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/config"
+	"github.com/dayvidpham/ipcache/internal/transport"
 )
 
 //////////////////////////////////////////////////////////////
 // Declare and init basic CLI flags
 //////////////////////////////////////////////////////////////
 
-/**
- * Required flags:
- * --server <hostname | IP (probably just tls.Dial format)>
- * --port <positive number>
- * --cert <path>
- * --privatekey <path>
- * --publickey <path> (probably don't need)
- *
- * --server root CAs
- */
-
 var (
-	parsedServer                 string
-	parsedPort                   uint
-	parsedCertPath               string
-	parsedPrivatekeyPath         string
-	parsedServerRootCACert       string
 	parsedRegisterTimeoutSeconds uint
-	nflagsRequired               int = 5
-
-	registerTimeout time.Duration
+	parsedReconnectMinSeconds    uint
+	parsedReconnectMaxSeconds    uint
+	parsedStatusFile             string
+	parsedIPCheckSeconds         uint
+	parsedAddrPollSeconds        uint
+	parsedTTLSeconds             uint
+	parsedAddrs                  addrsFlag
+	parsedPublishLocalAddrs      bool
+	parsedServices               servicesFlag
+	parsedPongTimeoutSeconds     uint
+	parsedMaxMissedPongs         uint
+	clientFlags                  *config.ClientFlags
+
+	registerTimeout  time.Duration
+	reconnectMin     time.Duration
+	reconnectMax     time.Duration
+	ipCheckInterval  time.Duration
+	addrPollInterval time.Duration
+	requestedTTL     time.Duration
+	pongTimeout      time.Duration
 )
 
 var (
@@ -45,12 +48,19 @@ var (
 )
 
 func init() {
-	flag.StringVar(&parsedServer, "server", "", "server to connect to; examples <ipcache.com | 192.168.0.1> ")
-	flag.UintVar(&parsedPort, "port", 0, "server port to connect to; examples <8080 | 4430>")
-	flag.StringVar(&parsedCertPath, "cert", "", "path to your certificate")
-	flag.StringVar(&parsedPrivatekeyPath, "privatekey", "", "path to your private key that was used to sign your certificate")
-	flag.StringVar(&parsedServerRootCACert, "server-root-ca-cert", "", "path to the expected server root CA certificate, used for verification")
+	clientFlags = config.BindClientFlags(flag.CommandLine)
 	flag.UintVar(&parsedRegisterTimeoutSeconds, "register-timeout-seconds", 10, "max time to wait for server to respond to DaemonRegister message before killing the connection")
+	flag.UintVar(&parsedReconnectMinSeconds, "reconnect-min-seconds", 1, "delay before the first reconnect attempt; doubles, with jitter, on every failed attempt")
+	flag.UintVar(&parsedReconnectMaxSeconds, "reconnect-max-seconds", 60, "upper bound on the delay between reconnect attempts")
+	flag.UintVar(&parsedIPCheckSeconds, "ip-check-seconds", 5*60, "how often to check that the server still has our current IP, registering again if not; 0 disables")
+	flag.UintVar(&parsedAddrPollSeconds, "addr-poll-seconds", 30, "how often to list local addresses when netlink is unavailable; a change triggers a reconnect")
+	flag.UintVar(&parsedTTLSeconds, "ttl-seconds", 0, "how long the server should keep our IP after we were last seen; 0 for the server default, which also caps it")
+	flag.Var(&parsedAddrs, "addr", "extra address to register, as label=ip[:port] (e.g. wan=203.0.113.7:22); repeatable")
+	flag.BoolVar(&parsedPublishLocalAddrs, "publish-local-addrs", true, "register the global unicast address of every interface that is up, labelled with its name")
+	flag.Var(&parsedServices, "service", "service to publish, as name=protocol/port[,key=value...] (e.g. ssh=tcp/2222,user=git); repeatable")
+	flag.UintVar(&parsedPongTimeoutSeconds, "pong-timeout-seconds", 10, "how long to wait for the server to answer a Ping before counting it as missed")
+	flag.UintVar(&parsedMaxMissedPongs, "max-missed-pongs", 2, "consecutive missed Pongs after which the connection is considered dead and re-established")
+	flag.StringVar(&parsedStatusFile, "status-file", "", "if set, path of a JSON file rewritten with the connection state on every change")
 }
 
 func main() {
@@ -60,131 +70,68 @@ func main() {
 	// Proccess flags
 	///////////////////////////////
 	flag.Parse()
-	log.Println("[DEBUG] --server", parsedServer)
-	log.Println("[DEBUG] --port", parsedPort)
-	log.Println("[DEBUG] --cert", parsedCertPath)
-	log.Println("[DEBUG] --privatekey", parsedPrivatekeyPath)
-	log.Println("[DEBUG] --server-root-ca-cert", parsedServerRootCACert)
-	log.Println("[DEBUG] --register-timeout-seconds", parsedRegisterTimeoutSeconds)
-
-	// NOTE: Want some data type binding (var, flagname, Flag) for convenience error-checking
-	// Could also maybe use the Visitor for error-checking?
-	if flag.NFlag() < nflagsRequired {
-		log.Panicf("[FATAL] Require at least %d flags to be set, but were only given %d\n", nflagsRequired, flag.NFlag())
-	}
-
-	parsedServerAddr := fmt.Sprintf("%s:%d", parsedServer, parsedPort)
-	registerTimeout = time.Second * time.Duration(parsedRegisterTimeoutSeconds)
-
-	///////////////////////////////
-	// Main client daemon program
-	// Referencing https://gist.github.com/denji/12b3a568f092ab951456
-	///////////////////////////////
-
-	caCert, err := os.ReadFile(parsedServerRootCACert)
+	cfg, err := clientFlags.Load()
 	if err != nil {
-		log.Println("[FATAL] Reading Root CA PEM file failed.\n\t- Reason:", err)
+		log.Println("[FATAL] Invalid config\n\t-", strings.ReplaceAll(err.Error(), "\n", "\n\t- "))
 		return
 	}
-
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	cert, err := tls.LoadX509KeyPair(parsedCertPath, parsedPrivatekeyPath)
+	log.Printf("[DEBUG] config: %+v\n", cfg)
+	log.Println("[DEBUG] --register-timeout-seconds", parsedRegisterTimeoutSeconds)
+	log.Println("[DEBUG] --reconnect-min-seconds", parsedReconnectMinSeconds)
+	log.Println("[DEBUG] --reconnect-max-seconds", parsedReconnectMaxSeconds)
+	log.Println("[DEBUG] --status-file", parsedStatusFile)
+	log.Println("[DEBUG] --ip-check-seconds", parsedIPCheckSeconds)
+	log.Println("[DEBUG] --addr-poll-seconds", parsedAddrPollSeconds)
+	log.Println("[DEBUG] --ttl-seconds", parsedTTLSeconds)
+	log.Println("[DEBUG] --addr", parsedAddrs.String())
+	log.Println("[DEBUG] --publish-local-addrs", parsedPublishLocalAddrs)
+	log.Println("[DEBUG] --service", parsedServices.String())
+	log.Println("[DEBUG] --pong-timeout-seconds", parsedPongTimeoutSeconds)
+	log.Println("[DEBUG] --max-missed-pongs", parsedMaxMissedPongs)
+
+	parsedServerAddr := cfg.Addr()
+	framing, err := cfg.ParsedFraming()
 	if err != nil {
-		log.Println("[FATAL] Loading X509 key pair failed.\n\t- Reason:", err)
+		log.Println("[FATAL]", err)
 		return
 	}
-
-	config := tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
+	registerTimeout = time.Second * time.Duration(parsedRegisterTimeoutSeconds)
+	reconnectMin = time.Second * time.Duration(parsedReconnectMinSeconds)
+	reconnectMax = time.Second * time.Duration(parsedReconnectMaxSeconds)
+	ipCheckInterval = time.Second * time.Duration(parsedIPCheckSeconds)
+	addrPollInterval = time.Second * time.Duration(parsedAddrPollSeconds)
+	requestedTTL = time.Second * time.Duration(parsedTTLSeconds)
+	pongTimeout = time.Second * time.Duration(parsedPongTimeoutSeconds)
+	if addrPollInterval <= 0 {
+		log.Println("[FATAL] --addr-poll-seconds must be positive")
+		return
 	}
-
-	conn, err := tls.Dial("tcp", parsedServerAddr, &config)
-	if err != nil {
-		log.Println("[FATAL] Failed to establish connection to the server at", parsedServerAddr, "\n\t- Reason:", err)
+	if pongTimeout <= 0 || parsedMaxMissedPongs == 0 {
+		log.Println("[FATAL] --pong-timeout-seconds and --max-missed-pongs must be positive")
 		return
 	}
-	defer conn.Close()
 
 	///////////////////////////////
-	// Handle responses from server
-	// Referencing https://gist.github.com/denji/12b3a568f092ab951456
+	// Main client daemon program
 	///////////////////////////////
 
-	client := msgs.NewMessenger(conn)
-
-	/*
-		Register with server, kill connection if server response takes too long
-		Should receive the expected ping timeout from the server as a response
-	*/
-	sendMsg := msgs.DaemonRegister()
-	err = client.Send(sendMsg)
-	log.Printf("Sending DaemonRegister message\n")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	if err = client.SetReadTimeout(registerTimeout); err != nil {
-		log.Println(err)
-		return
-	}
-
-	timeoutMsg, err := client.Receive()
+	dialConfig, err := cfg.DialConfig()
 	if err != nil {
-		log.Println(err)
-		return
-	}
-	if timeoutMsg.Type != msgs.T_String {
-		log.Printf("[FATAL] Expected the server to respond with MessageType String, but got %s.\n", timeoutMsg.Type)
-		if timeoutMsg.Type == msgs.T_Err {
-			log.Printf("Reason: %v\n", string(timeoutMsg.Payload))
-		}
+		log.Println("[FATAL]", err)
 		return
 	}
+	dialConfig.HandshakeTimeout = registerTimeout
 
-	log.Printf(
-		"Registration succeeded.\n\t- Got ping timeout from server, %d total bytes\n\t- Ping timeout: %s\n\n",
-		timeoutMsg.Size(),
-		timeoutMsg.Payload)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Unset the register timeout
-	err = client.SetReadDeadline(time.Time{})
+	backoff := transport.NewBackoff(reconnectMin, reconnectMax)
+	daemon, err := NewDaemon(dialConfig, framing, backoff, parsedStatusFile, ipCheckInterval, addrPollInterval)
 	if err != nil {
-		log.Println(err)
+		log.Println("[FATAL]", err)
 		return
 	}
-
-	pingTimeout, err = time.ParseDuration(string(timeoutMsg.Payload))
-	if err != nil {
-		log.Printf("[FATAL] Failed to parse server's response payload as a time.Duration.\n\t- Received: %s\n", timeoutMsg.Payload)
-		return
-	}
-	sleepDuration = time.Duration((pingTimeout * 3) / 4)
-	log.Printf(
-		"[INFO] Calculated ping interval as timeout * 3/4\n\t- (%s) * 3/4 = %s\n\n",
-		pingTimeout,
-		sleepDuration)
-	// Registration complete
-
-	for {
-		err = client.SetWriteTimeout(pingTimeout)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		sendMsg = msgs.Ping()
-
-		err := client.Send(sendMsg)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		log.Printf("Sent Ping to server. Sleeping for %v seconds.\n", sleepDuration)
-		time.Sleep(sleepDuration)
-	}
-
+	log.Println("[INFO] Connecting to", parsedServerAddr)
+	daemon.Run(ctx)
+	log.Println("[INFO] Shutting down")
 }
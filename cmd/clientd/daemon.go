@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/transport"
+)
+
+type ConnState int
+
+const (
+	// Waiting out the backoff before the next attempt
+	State_Disconnected ConnState = iota
+	// Dialing, negotiating the protocol version, or waiting on DaemonRegister
+	State_Connecting
+	// Registered with the server and sending pings
+	State_Registered
+)
+
+var connStateNames = map[ConnState]string{
+	State_Disconnected: "disconnected",
+	State_Connecting:   "connecting",
+	State_Registered:   "registered",
+}
+
+func (s ConnState) String() string {
+	name, ok := connStateNames[s]
+	if !ok {
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+	return name
+}
+
+func (s ConnState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Snapshot of the connection to the server, written to --status-file on
+// every change
+type Status struct {
+	State  ConnState
+	Server string
+	// When State last changed
+	Since time.Time
+	// Failed attempts since the last successful registration
+	Attempts  int
+	LastError string `json:",omitempty"`
+	// Ping/Pong round trips since clientd started
+	Latency LatencyStats
+}
+
+// Sessions that end with one of these reconnect after minReconnectDelay
+// rather than the backoff, so the server soon registers the IP it sees on a
+// fresh connection
+var (
+	errAddrChanged    = errors.New("local addresses changed")
+	errRegistrarStale = errors.New("server has a different IP for us")
+	errNotRegistered  = errors.New("server has no IP for us")
+)
+
+var errMissedPongs = errors.New("server stopped answering pings")
+
+// The server said it is shutting down; reconnect after its hint rather than
+// the backoff
+type shutdownError struct {
+	notice msgs.ShutdownNotice
+}
+
+func (e *shutdownError) Error() string {
+	return fmt.Sprintf("server is shutting down (%s), reconnect after %s", e.notice.Reason, e.notice.ReconnectAfter)
+}
+
+// Least time before reconnecting for a change of address, even with
+// --reconnect-min-seconds of 0, so that addresses flapping or a server
+// that keeps a stale IP do not turn into a reconnect storm
+const minReconnectDelay = time.Second
+
+// Used if the server sends no usable ping timeout, e.g. an older server;
+// the server's own default
+const defaultPingTimeout = 10 * time.Minute
+
+// Spreads reconnects over [hint, 2*hint], so that daemons told the same
+// hint do not all come back at once
+func reconnectDelay(hint time.Duration) time.Duration {
+	if hint <= 0 {
+		return 0
+	}
+	return hint + time.Duration(rand.Int63n(int64(hint)+1))
+}
+
+// Keeps clientd registered with the server: reconnects with jittered
+// exponential backoff whenever the connection is lost, and re-registers
+type Daemon struct {
+	dialConfig transport.DialConfig
+	framing    msgs.Framing
+	backoff    *transport.Backoff
+	statusPath string
+	// Own SKID, used to look up our entry in the server's registrar
+	skid string
+	// How often to check the server still has our IP, 0 to never check
+	ipCheckInterval time.Duration
+	// How often to list local addresses where netlink is unavailable
+	addrPollInterval time.Duration
+
+	addrChanged <-chan []net.IP
+
+	mu     sync.Mutex
+	status Status
+}
+
+func NewDaemon(
+	dialConfig transport.DialConfig,
+	framing msgs.Framing,
+	backoff *transport.Backoff,
+	statusPath string,
+	ipCheckInterval time.Duration,
+	addrPollInterval time.Duration,
+) (d *Daemon, err error) {
+	if len(dialConfig.TLS.Certificates) == 0 {
+		return nil, errors.New("no client certificate configured")
+	}
+	leaf, err := x509.ParseCertificate(dialConfig.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	d = &Daemon{
+		dialConfig:       dialConfig,
+		framing:          framing,
+		backoff:          backoff,
+		statusPath:       statusPath,
+		skid:             msgs.CertId(leaf),
+		ipCheckInterval:  ipCheckInterval,
+		addrPollInterval: addrPollInterval,
+		status: Status{
+			State:  State_Disconnected,
+			Server: dialConfig.Addr,
+			Since:  time.Now(),
+		},
+	}
+	return d, nil
+}
+
+func (d *Daemon) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+func (d *Daemon) setState(state ConnState, err error) {
+	d.mu.Lock()
+	d.status.State = state
+	d.status.Since = time.Now()
+	d.status.Attempts = d.backoff.Attempt()
+	if err != nil {
+		d.status.LastError = err.Error()
+	}
+	status := d.status
+	d.mu.Unlock()
+
+	log.Printf("[INFO] Connection to %s is now %s\n", status.Server, status.State)
+	if err := d.writeStatus(status); err != nil {
+		log.Println("[ERROR] Failed to write status file\n\t-", err)
+	}
+}
+
+// Records the outcome of one Ping: its round trip, or a miss if `missed`
+func (d *Daemon) recordPong(rtt time.Duration, missed bool) {
+	d.mu.Lock()
+	if missed {
+		d.status.Latency.Miss()
+	} else {
+		d.status.Latency.Observe(rtt)
+	}
+	status := d.status
+	d.mu.Unlock()
+
+	log.Println("[INFO] Ping round trip:", status.Latency)
+	if err := d.writeStatus(status); err != nil {
+		log.Println("[ERROR] Failed to write status file\n\t-", err)
+	}
+}
+
+// Replaces the status file in one rename, so readers never see it half-written
+func (d *Daemon) writeStatus(status Status) error {
+	if d.statusPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.statusPath + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.statusPath)
+}
+
+// Blocks until ctx is cancelled
+func (d *Daemon) Run(ctx context.Context) {
+	d.addrChanged = WatchAddrs(ctx, d.addrPollInterval)
+
+	for {
+		d.setState(State_Connecting, nil)
+		err := d.session(ctx)
+		if ctx.Err() != nil {
+			d.setState(State_Disconnected, nil)
+			return
+		}
+
+		var delay time.Duration
+		var shutdown *shutdownError
+		if errors.Is(err, errAddrChanged) || errors.Is(err, errRegistrarStale) {
+			delay = reconnectDelay(max(d.backoff.Min, minReconnectDelay))
+			d.setState(State_Disconnected, err)
+			log.Printf("[INFO] %v, reconnecting in %s\n", err, delay.Round(time.Millisecond))
+		} else if errors.As(err, &shutdown) {
+			d.backoff.Reset()
+			delay = reconnectDelay(shutdown.notice.ReconnectAfter)
+			d.setState(State_Disconnected, err)
+			log.Printf("[INFO] %v, reconnecting in %s\n", err, delay.Round(time.Millisecond))
+		} else {
+			delay = d.backoff.Next()
+			d.setState(State_Disconnected, err)
+			log.Printf("[ERROR] Lost connection to the server, reconnecting in %s (attempt %d)\n\t- Reason: %v\n", delay.Round(time.Millisecond), d.backoff.Attempt(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		// The next session lists the addresses afresh
+		select {
+		case <-d.addrChanged:
+		default:
+		}
+	}
+}
+
+// One connection to the server, from dialing until it is lost
+func (d *Daemon) session(ctx context.Context) (err error) {
+	conn, err := transport.Dial(ctx, d.dialConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := msgs.NewAsyncMessengerWithFraming(ctx, conn, d.framing)
+	defer client.Close()
+
+	version, err := msgs.Handshake(client, registerTimeout)
+	if err != nil {
+		return err
+	}
+	log.Println("[INFO] Negotiated protocol version", version)
+
+	// Listed per session, so a reconnect after an address change sends the new set
+	addrs, err := publishedAddrs(parsedAddrs, parsedPublishLocalAddrs)
+	if err != nil {
+		log.Println("[ERROR] Failed to list local addresses, registering the rest\n\t-", err)
+	}
+
+	registered, err := register(ctx, client, addrs)
+	if err != nil {
+		return err
+	}
+	d.backoff.Reset()
+	d.setState(State_Registered, nil)
+
+	observed, err := whoAmI(ctx, client)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Server sees us as %s from %s\n", observed.Subject, net.JoinHostPort(observed.IP.String(), strconv.Itoa(observed.Port)))
+
+	pingTimeout = serverPingTimeout(registered)
+	sleepDuration = time.Duration((pingTimeout * 3) / 4)
+	log.Printf(
+		"[INFO] Calculated ping interval as timeout * 3/4\n\t- (%s) * 3/4 = %s\n\n",
+		pingTimeout,
+		sleepDuration)
+
+	return d.pingLoop(ctx, client, observed.IP)
+}
+
+// The ping timeout the server asked for, or defaultPingTimeout if it is too
+// short to ping at 3/4 of, which time.NewTicker would panic on
+func serverPingTimeout(registered msgs.RegisterResponse) time.Duration {
+	if (registered.PingTimeout*3)/4 <= 0 {
+		log.Printf("[ERROR] Server sent a ping timeout of %s, using %s instead\n", registered.PingTimeout, defaultPingTimeout)
+		return defaultPingTimeout
+	}
+	return registered.PingTimeout
+}
+
+/*
+Register with server, kill connection if server response takes too long
+Should receive the expected ping timeout from the server as a response
+*/
+func register(ctx context.Context, client msgs.Messenger, addrs []msgs.Address) (registered msgs.RegisterResponse, err error) {
+	sendMsg, err := msgs.Marshal(msgs.T_DaemonRegister, msgs.RegisterRequest{
+		TTL:      requestedTTL,
+		Addrs:    addrs,
+		Services: parsedServices,
+	})
+	if err != nil {
+		return registered, err
+	}
+	log.Printf("Sending DaemonRegister message\n\t- Addresses: %v\n\t- Services: %v\n", addrs, parsedServices)
+	registerCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	timeoutMsg, err := client.Call(registerCtx, sendMsg)
+	if err != nil {
+		return registered, err
+	}
+	if timeoutMsg.Type != msgs.T_ServerRegistered {
+		err = fmt.Errorf("expected the server to respond with MessageType ServerRegistered, but got %s", timeoutMsg.Type)
+		if timeoutMsg.Type == msgs.T_Err {
+			var reason msgs.ErrorPayload
+			if msgs.Unmarshal(timeoutMsg, &reason) == nil {
+				err = fmt.Errorf("%w: %w", err, reason)
+			}
+		}
+		return registered, err
+	}
+
+	if err = msgs.Unmarshal(timeoutMsg, &registered); err != nil {
+		return registered, fmt.Errorf("failed to read the server's registration response: %w", err)
+	}
+
+	log.Printf(
+		"Registration succeeded.\n\t- Got ping timeout from server, %d total bytes\n\t- Ping timeout: %s\n\t- TTL: %s\n\n",
+		timeoutMsg.Size(),
+		registered.PingTimeout,
+		registered.TTL)
+	return registered, nil
+}
+
+// The result of one Ping, once its Pong arrived or --pong-timeout-seconds passed
+type pingResult struct {
+	rtt time.Duration
+	err error
+}
+
+// Sends a stamped Ping and waits for the Pong echoing it
+func ping(ctx context.Context, client msgs.Messenger) (rtt time.Duration, err error) {
+	if err = client.SetWriteTimeout(pingTimeout); err != nil {
+		return 0, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, pongTimeout)
+	defer cancel()
+
+	sent := time.Now()
+	sendMsg, err := msgs.PingAt(sent)
+	if err != nil {
+		return 0, err
+	}
+	recvMsg, err := client.Call(callCtx, sendMsg)
+	if err != nil {
+		return 0, err
+	}
+	// Measured on the monotonic clock; the echo only confirms which Ping was answered
+	rtt = time.Since(sent)
+
+	if recvMsg.Type != msgs.T_Pong {
+		return 0, fmt.Errorf("expected Pong, but got %s", recvMsg.Type)
+	}
+	var pong msgs.PongPayload
+	if err = msgs.Unmarshal(recvMsg, &pong); err != nil {
+		return 0, err
+	}
+	if pong.PingSentUnixNano != sent.UnixNano() {
+		return 0, fmt.Errorf("Pong echoes a Ping sent at %d, not %d", pong.PingSentUnixNano, sent.UnixNano())
+	}
+	return rtt, nil
+}
+
+// `observedIP` is the IP the server sees this connection coming from, which
+// its registrar should hold for as long as the connection lasts
+func (d *Daemon) pingLoop(ctx context.Context, client msgs.Messenger, observedIP net.IP) (err error) {
+	ticker := time.NewTicker(sleepDuration)
+	defer ticker.Stop()
+	unsolicited := client.Unsolicited()
+
+	// Stops the Ping in flight, if any, once the session ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		pongs    = make(chan pingResult, 1)
+		inFlight bool
+		missed   uint
+	)
+
+	var ipCheck <-chan time.Time
+	if d.ipCheckInterval > 0 {
+		ipCheckTicker := time.NewTicker(d.ipCheckInterval)
+		defer ipCheckTicker.Stop()
+		ipCheck = ipCheckTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case addrs, ok := <-d.addrChanged:
+			if !ok {
+				d.addrChanged = nil
+				continue
+			}
+			log.Println("[INFO] Local addresses are now", addrs)
+			return errAddrChanged
+
+		case <-ipCheck:
+			ip, err := d.lookupOwnIP(ctx, client)
+			if errors.Is(err, errNotRegistered) {
+				return fmt.Errorf("%w: %w", errRegistrarStale, err)
+			}
+			if err != nil {
+				return err
+			}
+			if !ip.Equal(observedIP) {
+				return fmt.Errorf("%w: %s instead of %s", errRegistrarStale, ip, observedIP)
+			}
+
+		case <-ticker.C:
+			// A Ping still waiting on its Pong has a shorter timeout than the interval
+			if inFlight {
+				continue
+			}
+			inFlight = true
+			go func() {
+				rtt, err := ping(ctx, client)
+				pongs <- pingResult{rtt: rtt, err: err}
+			}()
+			log.Printf("Sent Ping to server. Next one in %v.\n", sleepDuration)
+
+		case result := <-pongs:
+			inFlight = false
+			if result.err == nil {
+				missed = 0
+				d.recordPong(result.rtt, false)
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			missed++
+			d.recordPong(0, true)
+			log.Printf("[ERROR] Missed Pong %d of %d\n\t- %v\n", missed, parsedMaxMissedPongs, result.err)
+			if missed >= parsedMaxMissedPongs {
+				return fmt.Errorf("%w: %d Pongs missed in a row: %w", errMissedPongs, missed, result.err)
+			}
+
+		case recvMsg, ok := <-unsolicited:
+			if !ok {
+				_, err = client.Receive()
+				if err == nil {
+					err = errors.New("connection closed")
+				}
+				return err
+			}
+			log.Printf("Received %s from server\n", recvMsg.Type)
+			if recvMsg.Type == msgs.T_ServerShutdown {
+				var notice msgs.ShutdownNotice
+				if err = msgs.Unmarshal(recvMsg, &notice); err != nil {
+					return err
+				}
+				return &shutdownError{notice: notice}
+			}
+		}
+	}
+}
+
+// Asks the server how it sees this connection
+func whoAmI(ctx context.Context, client msgs.Messenger) (resp msgs.WhoAmIResponse, err error) {
+	callCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(callCtx, msgs.WhoAmI())
+	if err != nil {
+		return resp, err
+	}
+
+	switch recvMsg.Type {
+	case msgs.T_ServerWhoAmI:
+		err = msgs.Unmarshal(recvMsg, &resp)
+		return resp, err
+	case msgs.T_Err:
+		var reason msgs.ErrorPayload
+		if err = msgs.Unmarshal(recvMsg, &reason); err != nil {
+			return resp, err
+		}
+		return resp, reason
+	default:
+		return resp, fmt.Errorf("expected ServerWhoAmI or Err, but got %s", recvMsg.Type)
+	}
+}
+
+// Asks the server which IP its registrar holds for our own SKID
+func (d *Daemon) lookupOwnIP(ctx context.Context, client msgs.Messenger) (ip net.IP, err error) {
+	sendMsg, err := msgs.Marshal(msgs.T_ClientGetIPs, msgs.GetIPsRequest{Skids: []string{d.skid}})
+	if err != nil {
+		return nil, err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	recvMsg, err := client.Call(callCtx, sendMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch recvMsg.Type {
+	case msgs.T_ServerIPs:
+		var resp msgs.GetIPsResponse
+		if err = msgs.Unmarshal(recvMsg, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Entries) == 0 {
+			return nil, errNotRegistered
+		}
+		return resp.Entries[0].IP, nil
+	case msgs.T_Err:
+		var reason msgs.ErrorPayload
+		if err = msgs.Unmarshal(recvMsg, &reason); err != nil {
+			return nil, err
+		}
+		if reason.Code == msgs.ErrC_NotFound {
+			return nil, fmt.Errorf("%w: %w", errNotRegistered, reason)
+		}
+		return nil, reason
+	default:
+		return nil, fmt.Errorf("expected ServerIPs or Err, but got %s", recvMsg.Type)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		hint time.Duration
+		min  time.Duration
+		max  time.Duration
+	}{
+		{0, 0, 0},
+		{-time.Second, 0, 0},
+		{minReconnectDelay, minReconnectDelay, 2 * minReconnectDelay},
+		{10 * time.Second, 10 * time.Second, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			if got := reconnectDelay(tt.hint); got < tt.min || got > tt.max {
+				t.Fatalf("reconnectDelay(%s) = %s, want within [%s, %s]", tt.hint, got, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestConnStateString(t *testing.T) {
+	tests := map[ConnState]string{
+		State_Disconnected: "disconnected",
+		State_Connecting:   "connecting",
+		State_Registered:   "registered",
+		ConnState(9):       "ConnState(9)",
+	}
+	for state, want := range tests {
+		if got := state.String(); got != want {
+			t.Errorf("ConnState(%d).String() = %q, want %q", int(state), got, want)
+		}
+	}
+}
+
+func TestServerPingTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"as sent", time.Minute, time.Minute},
+		{"missing", 0, defaultPingTimeout},
+		{"negative", -time.Second, defaultPingTimeout},
+		{"too short to tick", time.Nanosecond, defaultPingTimeout},
+	}
+	for _, tt := range tests {
+		got := serverPingTimeout(msgs.RegisterResponse{PingTimeout: tt.timeout})
+		if got != tt.want {
+			t.Errorf("%s: serverPingTimeout = %s, want %s", tt.name, got, tt.want)
+		}
+		if (got*3)/4 <= 0 {
+			t.Errorf("%s: ping interval of %s", tt.name, (got*3)/4)
+		}
+	}
+}
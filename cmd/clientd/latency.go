@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Round-trip times of Ping/Pong since the daemon started, across reconnects
+type LatencyStats struct {
+	// Pongs received in time
+	Count int
+	// Pings that got no Pong within --pong-timeout-seconds
+	Missed int
+	Last   time.Duration
+	Min    time.Duration
+	Max    time.Duration
+	Avg    time.Duration
+	// Exponentially weighted, so it follows recent changes
+	Smoothed time.Duration
+}
+
+// Weight of the newest sample in Smoothed, as in TCP's SRTT
+const smoothingFactor = 0.125
+
+func (s *LatencyStats) Observe(rtt time.Duration) {
+	s.Count++
+	s.Last = rtt
+	if s.Count == 1 {
+		s.Min, s.Max, s.Avg, s.Smoothed = rtt, rtt, rtt, rtt
+		return
+	}
+	s.Min = min(s.Min, rtt)
+	s.Max = max(s.Max, rtt)
+	s.Avg += (rtt - s.Avg) / time.Duration(s.Count)
+	s.Smoothed += time.Duration(smoothingFactor * float64(rtt-s.Smoothed))
+}
+
+func (s *LatencyStats) Miss() {
+	s.Missed++
+}
+
+func (s LatencyStats) String() string {
+	if s.Count == 0 {
+		return fmt.Sprintf("no pongs yet, %d missed", s.Missed)
+	}
+	return fmt.Sprintf(
+		"last %s, min %s, avg %s, smoothed %s, max %s over %d pongs, %d missed",
+		s.Last, s.Min, s.Avg, s.Smoothed, s.Max, s.Count, s.Missed)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		misses  int
+		want    LatencyStats
+	}{
+		{name: "none", want: LatencyStats{}},
+		{name: "misses only", misses: 2, want: LatencyStats{Missed: 2}},
+		{
+			name:    "one",
+			samples: []time.Duration{10 * ms},
+			want:    LatencyStats{Count: 1, Last: 10 * ms, Min: 10 * ms, Max: 10 * ms, Avg: 10 * ms, Smoothed: 10 * ms},
+		},
+		{
+			name:    "several",
+			samples: []time.Duration{10 * ms, 30 * ms, 20 * ms},
+			misses:  1,
+			want: LatencyStats{
+				Count:  3,
+				Missed: 1,
+				Last:   20 * ms,
+				Min:    10 * ms,
+				Max:    30 * ms,
+				Avg:    20 * ms,
+				// 10 + (30-10)/8 = 12.5, then 12.5 + (20-12.5)/8
+				Smoothed: 13437500 * time.Nanosecond,
+			},
+		},
+	}
+	for _, tt := range tests {
+		var s LatencyStats
+		for _, rtt := range tt.samples {
+			s.Observe(rtt)
+		}
+		for range tt.misses {
+			s.Miss()
+		}
+		if s != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, s, tt.want)
+		}
+		if s.String() == "" {
+			t.Errorf("%s: empty String()", tt.name)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/transport"
+)
+
+// Settings that change between hosts. Loaded from a TOML file given by
+// --config, then overridden by any of the matching flags given explicitly.
+type ServerConfig struct {
+	// Each with its own framing and limits
+	Listen []ListenerConfig `toml:"listen"`
+	// PEM-encoded server certificate and its private key
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// PEM bundles of the CAs that client certificates must chain to
+	ClientCAs []string `toml:"client-cas"`
+	// Data source name passed to the sqlite3 driver
+	Database string `toml:"database"`
+}
+
+var DefaultServerConfig = ServerConfig{
+	Listen:    []ListenerConfig{{Addr: "127.0.0.1:4430"}},
+	Cert:      "certs/self.pem",
+	Key:       "certs/self.key",
+	ClientCAs: []string{"certs/self.pem"},
+	Database:  "file:ipcache.db",
+}
+
+// Decodes the TOML file at `path` over `cfg`, so keys missing from the file
+// keep their current values. Unknown keys are an error, to catch typos.
+func LoadConfigFile(path string, cfg *ServerConfig) (err error) {
+	// The decoder writes into slices with room to spare, which may be
+	// shared with DefaultServerConfig
+	cfg.Listen = slices.Clone(cfg.Listen)
+	cfg.ClientCAs = slices.Clone(cfg.ClientCAs)
+
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// Reports every invalid field at once, rather than one per restart
+func (c ServerConfig) Validate() error {
+	var errs []error
+
+	if len(c.Listen) == 0 {
+		errs = append(errs, errors.New("listen: need at least one address"))
+	}
+	for _, lc := range c.Listen {
+		if err := lc.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("listen %q: %w", lc.Addr, err))
+		}
+	}
+
+	if c.Cert == "" {
+		errs = append(errs, errors.New("cert: path is empty"))
+	}
+	if c.Key == "" {
+		errs = append(errs, errors.New("key: path is empty"))
+	}
+	if len(c.ClientCAs) == 0 {
+		errs = append(errs, errors.New("client-cas: need at least one CA bundle"))
+	}
+	if c.Database == "" {
+		errs = append(errs, errors.New("database: DSN is empty"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err = net.LookupHost(host); err != nil {
+			return err
+		}
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("port %q is not in 1-65535", port)
+	}
+	return nil
+}
+
+// Loads the server keypair and client CA bundles into an mTLS config
+func (c ServerConfig) TlsConfig() (config *tls.Config, err error) {
+	config, err = transport.ServerTLSConfig(c.Cert, c.Key, c.ClientCAs...)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return config, nil
+}
+
+// One address to accept connections on, and how to talk to clients there.
+// Zero fields are filled in by WithDefaults from the flags of the same name.
+type ListenerConfig struct {
+	// host:port, IPv6 hosts in brackets, e.g. "[::1]:4430"
+	Addr    string `toml:"addr"`
+	Framing string `toml:"framing"`
+
+	MaxFrameBytes        int `toml:"max-frame-bytes"`
+	MaxPayloadBytes      int `toml:"max-payload-bytes"`
+	MaxPendingHandshakes int `toml:"max-pending-handshakes"`
+}
+
+// Parses "host:port[,key=value...]", where keys are those of the TOML
+// table, e.g. "[::1]:4430,framing=binary,max-frame-bytes=65536"
+func ParseListenerConfig(s string) (lc ListenerConfig, err error) {
+	fields := strings.Split(s, ",")
+	lc.Addr = fields[0]
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return lc, fmt.Errorf("listen %q: expected key=value, but got %q", s, field)
+		}
+		if err = lc.set(key, value); err != nil {
+			return lc, fmt.Errorf("listen %q: %w", s, err)
+		}
+	}
+	return lc, nil
+}
+
+// Takes either the string form of ParseListenerConfig, or a table, so that
+// config files listing plain addresses keep working
+func (lc *ListenerConfig) UnmarshalTOML(data any) (err error) {
+	switch v := data.(type) {
+	case string:
+		*lc, err = ParseListenerConfig(v)
+		return err
+	case map[string]any:
+		*lc = ListenerConfig{}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err = lc.set(key, v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("expected an address or a table, but got %T", data)
+	}
+}
+
+// `value` is a string from a flag, or whatever TOML decoded
+func (lc *ListenerConfig) set(key string, value any) (err error) {
+	switch key {
+	case "addr":
+		lc.Addr, err = stringValue(key, value)
+	case "framing":
+		lc.Framing, err = stringValue(key, value)
+	case "max-frame-bytes":
+		lc.MaxFrameBytes, err = intValue(key, value)
+	case "max-payload-bytes":
+		lc.MaxPayloadBytes, err = intValue(key, value)
+	case "max-pending-handshakes":
+		lc.MaxPendingHandshakes, err = intValue(key, value)
+	default:
+		err = fmt.Errorf("unknown key %q", key)
+	}
+	return err
+}
+
+func stringValue(key string, value any) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string, but got %T", key, value)
+	}
+	return s, nil
+}
+
+func intValue(key string, value any) (int, error) {
+	switch v := value.(type) {
+	case int64:
+		return int(v), nil
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("%s: expected an integer, but got %T", key, value)
+	}
+}
+
+// Fills the fields left unset from `defaults`
+func (lc ListenerConfig) WithDefaults(defaults ListenerConfig) ListenerConfig {
+	if lc.Framing == "" {
+		lc.Framing = defaults.Framing
+	}
+	if lc.MaxFrameBytes == 0 {
+		lc.MaxFrameBytes = defaults.MaxFrameBytes
+	}
+	if lc.MaxPayloadBytes == 0 {
+		lc.MaxPayloadBytes = defaults.MaxPayloadBytes
+	}
+	if lc.MaxPendingHandshakes == 0 {
+		lc.MaxPendingHandshakes = defaults.MaxPendingHandshakes
+	}
+	return lc
+}
+
+func (lc ListenerConfig) Validate() error {
+	var errs []error
+	if err := validateListenAddr(lc.Addr); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := msgs.ParseFraming(lc.Framing); err != nil {
+		errs = append(errs, err)
+	}
+	if err := lc.Limits().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if lc.MaxPendingHandshakes < 0 {
+		errs = append(errs, fmt.Errorf("max-pending-handshakes of %d is negative", lc.MaxPendingHandshakes))
+	}
+	return errors.Join(errs...)
+}
+
+func (lc ListenerConfig) Limits() msgs.Limits {
+	return msgs.Limits{MaxFrameSize: lc.MaxFrameBytes, MaxPayloadSize: lc.MaxPayloadBytes}
+}
+
+func (lc ListenerConfig) String() string {
+	return fmt.Sprintf("%s,framing=%s,max-frame-bytes=%d,max-payload-bytes=%d,max-pending-handshakes=%d",
+		lc.Addr, lc.Framing, lc.MaxFrameBytes, lc.MaxPayloadBytes, lc.MaxPendingHandshakes)
+}
+
+// --listen, may be given more than once
+type listenFlag []ListenerConfig
+
+func (l *listenFlag) String() string {
+	addrs := make([]string, len(*l))
+	for i, lc := range *l {
+		addrs[i] = lc.Addr
+	}
+	return strings.Join(addrs, " ")
+}
+
+func (l *listenFlag) Set(value string) error {
+	lc, err := ParseListenerConfig(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, lc)
+	return nil
+}
+
+// Flag that may be given more than once, e.g. --client-ca a --client-ca b
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestParseListenerConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ListenerConfig
+		wantErr bool
+	}{
+		{in: "127.0.0.1:4430", want: ListenerConfig{Addr: "127.0.0.1:4430"}},
+		{
+			in: "[::1]:4430,framing=binary,max-frame-bytes=65536,max-payload-bytes=65504,max-pending-handshakes=32",
+			want: ListenerConfig{
+				Addr:                 "[::1]:4430",
+				Framing:              "binary",
+				MaxFrameBytes:        65536,
+				MaxPayloadBytes:      65504,
+				MaxPendingHandshakes: 32,
+			},
+		},
+		{in: "127.0.0.1:4430,framing", wantErr: true},
+		{in: "127.0.0.1:4430,colour=blue", wantErr: true},
+		{in: "127.0.0.1:4430,max-frame-bytes=lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseListenerConfig(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseListenerConfig(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseListenerConfig(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFileListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		toml    string
+		want    []ListenerConfig
+		wantErr bool
+	}{
+		{
+			name: "addresses",
+			toml: `listen = ["127.0.0.1:4430", "[::1]:4430,framing=json"]`,
+			want: []ListenerConfig{{Addr: "127.0.0.1:4430"}, {Addr: "[::1]:4430", Framing: "json"}},
+		},
+		{
+			name: "tables",
+			toml: `
+[[listen]]
+addr = "127.0.0.1:4430"
+
+[[listen]]
+addr = "[::1]:4431"
+framing = "binary"
+max-frame-bytes = 65536
+max-payload-bytes = 65504
+max-pending-handshakes = 32
+`,
+			want: []ListenerConfig{
+				{Addr: "127.0.0.1:4430"},
+				{Addr: "[::1]:4431", Framing: "binary", MaxFrameBytes: 65536, MaxPayloadBytes: 65504, MaxPendingHandshakes: 32},
+			},
+		},
+		{
+			name: "unknown key",
+			toml: `
+[[listen]]
+addr = "127.0.0.1:4430"
+colour = "blue"
+`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			toml:    `listen = [4430]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "server.toml")
+			if err := os.WriteFile(path, []byte(tt.toml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			config := DefaultServerConfig
+			err := LoadConfigFile(path, &config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfigFile = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(config.Listen, tt.want) {
+				t.Fatalf("Listen = %v, want %v", config.Listen, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenerConfigWithDefaults(t *testing.T) {
+	defaults := ListenerConfig{Framing: "gob", MaxFrameBytes: 1 << 20, MaxPayloadBytes: 1<<20 - msgs.MaxFrameHeaderSize, MaxPendingHandshakes: 128}
+
+	got := ListenerConfig{Addr: "127.0.0.1:4430", Framing: "binary", MaxPendingHandshakes: 8}.WithDefaults(defaults)
+	want := ListenerConfig{
+		Addr:                 "127.0.0.1:4430",
+		Framing:              "binary",
+		MaxFrameBytes:        1 << 20,
+		MaxPayloadBytes:      1<<20 - msgs.MaxFrameHeaderSize,
+		MaxPendingHandshakes: 8,
+	}
+	if got != want {
+		t.Fatalf("WithDefaults = %+v, want %+v", got, want)
+	}
+}
+
+func TestListenerConfigValidate(t *testing.T) {
+	valid := ListenerConfig{
+		Addr:                 "127.0.0.1:4430",
+		Framing:              "gob",
+		MaxFrameBytes:        msgs.DefaultLimits.MaxFrameSize,
+		MaxPayloadBytes:      msgs.DefaultLimits.MaxPayloadSize,
+		MaxPendingHandshakes: 128,
+	}
+	tests := []struct {
+		name    string
+		modify  func(lc *ListenerConfig)
+		wantErr bool
+	}{
+		{"valid", func(lc *ListenerConfig) {}, false},
+		{"IPv6", func(lc *ListenerConfig) { lc.Addr = "[::1]:4430" }, false},
+		{"no port", func(lc *ListenerConfig) { lc.Addr = "127.0.0.1" }, true},
+		{"port 0", func(lc *ListenerConfig) { lc.Addr = "127.0.0.1:0" }, true},
+		{"unknown framing", func(lc *ListenerConfig) { lc.Framing = "xml" }, true},
+		{"payload over the frame", func(lc *ListenerConfig) { lc.MaxPayloadBytes = lc.MaxFrameBytes }, true},
+		{"negative handshakes", func(lc *ListenerConfig) { lc.MaxPendingHandshakes = -1 }, true},
+	}
+	for _, tt := range tests {
+		lc := valid
+		tt.modify(&lc)
+		if err := lc.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	config := DefaultServerConfig
+	if err := LoadConfigFile("../../server.example.toml", &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Listen) != 2 || config.Listen[1].Framing != "binary" {
+		t.Fatalf("Listen = %v, want the two listeners of the example", config.Listen)
+	}
+	if config.Database != "file:ipcache.db" {
+		t.Fatalf("Database = %q, want it outside the listener tables", config.Database)
+	}
+
+	defaults := ListenerConfig{
+		Framing:              "gob",
+		MaxFrameBytes:        msgs.DefaultLimits.MaxFrameSize,
+		MaxPayloadBytes:      msgs.DefaultLimits.MaxPayloadSize,
+		MaxPendingHandshakes: 128,
+	}
+	for i, lc := range config.Listen {
+		config.Listen[i] = lc.WithDefaults(defaults)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFileKeepsDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.toml")
+	toml := `
+client-cas = ["certs/other.pem"]
+
+[[listen]]
+framing = "binary"
+`
+	if err := os.WriteFile(path, []byte(toml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultListen, defaultClientCAs := DefaultServerConfig.Listen[0], DefaultServerConfig.ClientCAs[0]
+	config := DefaultServerConfig
+	if err := LoadConfigFile(path, &config); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ListenerConfig{Framing: "binary"}); config.Listen[0] != want {
+		t.Errorf("Listen = %v, want %v without the default address", config.Listen, want)
+	}
+	if DefaultServerConfig.Listen[0] != defaultListen || DefaultServerConfig.ClientCAs[0] != defaultClientCAs {
+		t.Errorf("DefaultServerConfig changed to %+v", DefaultServerConfig)
+	}
+}
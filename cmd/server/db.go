@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"reflect"
+	"slices"
 	"sync"
 	"time"
 
@@ -13,10 +17,13 @@ import (
 )
 
 var (
-	stmt_selectall         *sql.Stmt
-	stmt_insert_registrar  *sql.Stmt
-	stmt_insert_authgrants *sql.Stmt
-	stmt_delete_authgrants *sql.Stmt
+	ErrNotAuthorized     = errors.New("not authorized")
+	ErrNotRegistered     = errors.New("not registered")
+	ErrNotGranted        = errors.New("not granted")
+	ErrInvalidGrant      = errors.New("invalid grant")
+	ErrInvalidAddress    = errors.New("invalid address")
+	ErrInvalidService    = errors.New("invalid service")
+	ErrStaleRegistration = errors.New("stale registration")
 )
 
 const SQL_SelectAll =
@@ -40,26 +47,242 @@ const SQL_CreateTable_Registrar =
 			ip
 				TEXT
 				NOT NULL,
+			online
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			lastPingUtc
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			connectedSinceUtc
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			disconnectedAtUtc
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			ttlSeconds
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			expiresAtUtc
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			expired
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
 			PRIMARY KEY(skid)
 		)
 		WITHOUT ROWID
 	;`
+// Liveness columns added after the first release, with their definitions for
+// ALTER TABLE on databases created before them
+var SQL_Columns_Registrar = []struct{ Name, Def string }{
+	{"online", "INTEGER NOT NULL DEFAULT 0"},
+	{"lastPingUtc", "INTEGER NOT NULL DEFAULT 0"},
+	{"connectedSinceUtc", "INTEGER NOT NULL DEFAULT 0"},
+	{"disconnectedAtUtc", "INTEGER NOT NULL DEFAULT 0"},
+	{"ttlSeconds", "INTEGER NOT NULL DEFAULT 0"},
+	{"expiresAtUtc", "INTEGER NOT NULL DEFAULT 0"},
+	{"expired", "INTEGER NOT NULL DEFAULT 0"},
+}
+const SQL_TableInfo_Registrar = 
+	`SELECT
+		name
+	FROM
+		pragma_table_info('Registrar')
+	;`
 const SQL_InsertRow_Registrar = 
 	`INSERT INTO
-		Registrar (skid, unixTsUtc, ip)
+		Registrar (skid, unixTsUtc, ip, online, lastPingUtc, connectedSinceUtc, disconnectedAtUtc, ttlSeconds, expiresAtUtc, expired)
 	VALUES
-		(?, ?, ?)
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(skid)
 		DO UPDATE
 		SET
 			unixTsUtc = excluded.unixTsUtc,
-			ip = excluded.ip
+			ip = excluded.ip,
+			online = excluded.online,
+			lastPingUtc = excluded.lastPingUtc,
+			connectedSinceUtc = excluded.connectedSinceUtc,
+			disconnectedAtUtc = excluded.disconnectedAtUtc,
+			ttlSeconds = excluded.ttlSeconds,
+			expiresAtUtc = excluded.expiresAtUtc,
+			expired = excluded.expired
 		WHERE 
-			excluded.unixTsUtc > Registrar.unixTsUtc
+			excluded.unixTsUtc >= Registrar.unixTsUtc
+	;`
+const SQL_UpdatePing_Registrar = 
+	`UPDATE
+		Registrar
+	SET
+		lastPingUtc = ?1,
+		expiresAtUtc = ?1 + ttlSeconds
+	WHERE
+		skid = ?2 AND
+		ip = ?3 AND
+		online = 1
+	;`
+const SQL_UpdateOffline_Registrar = 
+	`UPDATE
+		Registrar
+	SET
+		online = 0,
+		disconnectedAtUtc = ?1,
+		expiresAtUtc = ?1 + ttlSeconds
+	WHERE
+		skid = ?2 AND
+		ip = ?3 AND
+		online = 1
+	;`
+// No connections survive a restart, so whatever was online was lost at the
+// last ping the server saw
+const SQL_MarkAllOffline_Registrar = 
+	`UPDATE
+		Registrar
+	SET
+		online = 0,
+		disconnectedAtUtc = MAX(lastPingUtc, connectedSinceUtc),
+		expiresAtUtc = MAX(lastPingUtc, connectedSinceUtc) + ttlSeconds
+	WHERE
+		online = 1
+	;`
+// Rows from before TTLs existed get the server default, counted from when
+// they were last seen
+const SQL_BackfillTTL_Registrar = 
+	`UPDATE
+		Registrar
+	SET
+		ttlSeconds = ?1,
+		expiresAtUtc = MAX(unixTsUtc, lastPingUtc, disconnectedAtUtc) + ?1
+	WHERE
+		ttlSeconds = 0
+	;`
+const SQL_UpdateExpired_Registrar = 
+	`UPDATE
+		Registrar
+	SET
+		expired = 1
+	WHERE
+		skid = ? AND
+		expiresAtUtc = ? AND
+		online = 0
+	;`
+const SQL_DeleteExpired_Registrar = 
+	`DELETE FROM
+		Registrar
+	WHERE
+		skid = ? AND
+		expiresAtUtc = ? AND
+		expired = 1
+	;`
+// Every address a daemon registered, including the one the server saw its
+// connection come from. Replaced as a whole on every registration.
+const SQL_CreateTable_RegistrarAddrs = 
+	`CREATE TABLE IF NOT EXISTS
+		RegistrarAddrs(
+			skid
+				TEXT
+				NOT NULL
+				COLLATE BINARY,
+			ip
+				TEXT
+				NOT NULL,
+			port
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			family
+				TEXT
+				NOT NULL,
+			scope
+				TEXT
+				NOT NULL,
+			label
+				TEXT
+				NOT NULL
+				DEFAULT '',
+			observed
+				INTEGER
+				NOT NULL
+				DEFAULT 0,
+			PRIMARY KEY(skid, ip, port)
+		)
+		WITHOUT ROWID
+	;`
+const SQL_InsertRow_RegistrarAddrs = 
+	`INSERT INTO
+		RegistrarAddrs (skid, ip, port, family, scope, label, observed)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?)
+	;`
+const SQL_DeleteSkid_RegistrarAddrs = 
+	`DELETE FROM
+		RegistrarAddrs
+	WHERE
+		skid = ?
+	;`
+const SQL_SelectAll_RegistrarAddrs = 
+	`SELECT
+		skid, ip, port, family, scope, label, observed
+	FROM
+		RegistrarAddrs
+	ORDER BY
+		skid, observed DESC, ip, port
+	;`
+// Named services a daemon registered, replaced as a whole on every
+// registration. Metadata is a JSON object.
+const SQL_CreateTable_RegistrarServices = 
+	`CREATE TABLE IF NOT EXISTS
+		RegistrarServices(
+			skid
+				TEXT
+				NOT NULL
+				COLLATE BINARY,
+			name
+				TEXT
+				NOT NULL,
+			protocol
+				TEXT
+				NOT NULL,
+			port
+				INTEGER
+				NOT NULL,
+			metadata
+				TEXT
+				NOT NULL
+				DEFAULT '{}',
+			PRIMARY KEY(skid, name, protocol)
+		)
+		WITHOUT ROWID
+	;`
+const SQL_InsertRow_RegistrarServices = 
+	`INSERT INTO
+		RegistrarServices (skid, name, protocol, port, metadata)
+	VALUES
+		(?, ?, ?, ?, ?)
+	;`
+const SQL_DeleteSkid_RegistrarServices = 
+	`DELETE FROM
+		RegistrarServices
+	WHERE
+		skid = ?
+	;`
+const SQL_SelectAll_RegistrarServices = 
+	`SELECT
+		skid, name, protocol, port, metadata
+	FROM
+		RegistrarServices
+	ORDER BY
+		skid, name, protocol
 	;`
 const SQL_SelectAll_Registrar = 
 	`SELECT
-		*
+		skid, unixTsUtc, ip, online, lastPingUtc, connectedSinceUtc, disconnectedAtUtc, ttlSeconds, expiresAtUtc, expired
 	FROM
 		Registrar
 	;`
@@ -93,7 +316,7 @@ const SQL_InitTable_AuthType =
 	VALUES
 		(0, 'GetIP')
 	;`
-const SQL_SelectAll_AuthGrants = 
+const SQL_SelectAll_AuthType = 
 	`SELECT
 		*
 	FROM
@@ -128,6 +351,8 @@ const SQL_InsertRow_AuthGrants =
 		'AuthorizationGrants' ('owner', 'other', 'type')
 	VALUES
 		(?, ?, ?)
+	ON CONFLICT(owner, other, type)
+		DO NOTHING
 	;`
 const SQL_DeleteRow_AuthGrants =
 	`DELETE FROM
@@ -137,56 +362,238 @@ const SQL_DeleteRow_AuthGrants =
 		other = ? AND
 		type = ?
 	;`
+const SQL_SelectAll_AuthGrants = 
+	`SELECT
+		owner, other, type
+	FROM
+		AuthorizationGrants
+	;`
 
 
 type IPCache struct {
-	db *sql.DB
+	db      *sql.DB
 	timeout time.Duration
+	ttl     TTLPolicy
 
 	registrar  *Registrar
 	authGrants *AuthGrants
 }
 
+// Most addresses a daemon may register, besides the observed one
+const MaxRegistrarAddrs = 32
+
+// Puts the observed `ip` first, then every requested address that is not a
+// duplicate of an earlier one. Family and scope are always derived here.
+func registrarAddrs(ip net.IP, requested []msgs.Address) (addrs []msgs.Address, err error) {
+	if len(requested) > MaxRegistrarAddrs {
+		return nil, fmt.Errorf("[ERROR] Got %d addresses, at most %d are allowed: %w", len(requested), MaxRegistrarAddrs, ErrInvalidAddress)
+	}
+
+	observed := msgs.NewAddress(ip, 0, "")
+	observed.Observed = true
+	addrs = append(addrs, observed)
+
+next:
+	for _, req := range requested {
+		if err = req.Validate(); err != nil {
+			return nil, fmt.Errorf("[ERROR] %w: %w", ErrInvalidAddress, err)
+		}
+		addr := msgs.NewAddress(req.IP, req.Port, req.Label)
+
+		for i := range addrs {
+			if addrs[i].IP.Equal(addr.IP) && addrs[i].Port == addr.Port {
+				if addrs[i].Label == "" {
+					addrs[i].Label = addr.Label
+				}
+				continue next
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Most services a daemon may register
+const MaxRegistrarServices = 32
+
+// Validates `requested` and rejects two services with the same name and protocol
+func registrarServices(requested []msgs.ServiceRecord) (services []msgs.ServiceRecord, err error) {
+	if len(requested) > MaxRegistrarServices {
+		return nil, fmt.Errorf("[ERROR] Got %d services, at most %d are allowed: %w", len(requested), MaxRegistrarServices, ErrInvalidService)
+	}
+
+	for _, svc := range requested {
+		if err = svc.Validate(); err != nil {
+			return nil, fmt.Errorf("[ERROR] %w: %w", ErrInvalidService, err)
+		}
+		dup := slices.ContainsFunc(services, func(other msgs.ServiceRecord) bool {
+			return other.Name == svc.Name && other.Protocol == svc.Protocol
+		})
+		if dup {
+			return nil, fmt.Errorf("[ERROR] %w: %s/%s is listed twice", ErrInvalidService, svc.Name, svc.Protocol)
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+func sameAddrs(a []msgs.Address, b []msgs.Address) bool {
+	return slices.EqualFunc(a, b, func(x msgs.Address, y msgs.Address) bool {
+		return x.IP.Equal(y.IP) && x.Port == y.Port && x.Label == y.Label && x.Observed == y.Observed
+	})
+}
+
+// Marks `skid` online at `ip`, to be kept for `ttl` after it was last seen,
+// reachable at `addrs` as built by registrarAddrs and offering `services`.
+// Registrations are ordered by when the server got them, not by the daemon's
+// clock. Reports whether the stored addresses of `skid` changed
 func (c *IPCache) Register(
+	ctx context.Context,
 	skid string,
-	unixTsUtc int64,
-	ip string,
-) (err error) {
-	// Do auth, perms check
+	ip net.IP,
+	ttl time.Duration,
+	addrs []msgs.Address,
+	services []msgs.ServiceRecord,
+) (changed bool, err error) {
+
+	now := time.Now().UTC().Unix()
+	ttlSeconds := int64(ttl / time.Second)
+	row := RegistrarRow{
+		Skid:              skid,
+		UnixTsUtc:         now,
+		IP:                ip,
+		Online:            true,
+		LastPingUtc:       now,
+		ConnectedSinceUtc: now,
+		TTLSeconds:        ttlSeconds,
+		ExpiresAtUtc:      now + ttlSeconds,
+		Addrs:             addrs,
+		Services:          services,
+	}
+	return c.registrar.Store(ctx, c.db, row)
+}
+
+// Records a ping from the daemon of `skid` connected from `ip`
+func (c *IPCache) Ping(ctx context.Context, skid string, ip net.IP) (err error) {
+	return c.registrar.Update(ctx, c.db, c.registrar.t.updatePing, skid, ip, func(rrow *RegistrarRow) {
+		rrow.LastPingUtc = time.Now().UTC().Unix()
+		rrow.ExpiresAtUtc = rrow.LastPingUtc + rrow.TTLSeconds
+	})
+}
+
+// Marks `skid` offline, unless it has since registered again from another IP
+func (c *IPCache) Disconnect(ctx context.Context, skid string, ip net.IP) (err error) {
+	return c.registrar.Update(ctx, c.db, c.registrar.t.updateOffline, skid, ip, func(rrow *RegistrarRow) {
+		rrow.Online = false
+		rrow.DisconnectedAtUtc = time.Now().UTC().Unix()
+		rrow.ExpiresAtUtc = rrow.DisconnectedAtUtc + rrow.TTLSeconds
+	})
+}
+
+// Returns the registrar entries of every owner that has granted `self` the GetIP permission
+func (c *IPCache) GetIPs(self string) (rrows []RegistrarRow, err error) {
+	for _, owner := range c.authGrants.Owners(self, AuthT_GetIP) {
+		rrow, ok := c.registrar.Load(owner)
+		if !ok {
+			continue
+		}
+		rrows = append(rrows, rrow)
+	}
 	return
 }
-func (c *IPCache) GetIPs(self string) (err error) {
-	// Do auth, perms check
+
+// Services of every daemon that granted `self` GetIP, or of `skids` only if
+// given. A non-empty `name` only keeps services by that name.
+func (c *IPCache) GetServices(self string, skids []string, name string) (entries []msgs.ServicesEntry, err error) {
+	var rrows []RegistrarRow
+	if len(skids) == 0 {
+		rrows, err = c.GetIPs(self)
+	} else {
+		for _, skid := range skids {
+			var rrow RegistrarRow
+			if rrow, err = c.GetIP(self, skid); err != nil {
+				return nil, err
+			}
+			rrows = append(rrows, rrow)
+		}
+	}
+
+	for _, rrow := range rrows {
+		entry := msgs.ServicesEntry{Skid: rrow.Skid, Online: rrow.Online}
+		for _, svc := range rrow.Services {
+			if name == "" || svc.Name == name {
+				entry.Services = append(entry.Services, svc)
+			}
+		}
+		entries = append(entries, entry)
+	}
 	return
 }
-func (c *IPCache) GetIP(self string, other string) (err error) {
-	// Do auth, perms check
+
+func (c *IPCache) CanGetIP(self string, other string) bool {
+	grant := AuthGrantsRow{Owner: other, Other: self, Type: AuthT_GetIP}
+	return self == other || c.authGrants.Has(grant)
+}
+
+// Returns the registrar entry of `other`, if `other` has granted `self` the GetIP permission.
+// A client is always allowed to look up its own entry.
+func (c *IPCache) GetIP(self string, other string) (rrow RegistrarRow, err error) {
+	if !c.CanGetIP(self, other) {
+		return rrow, fmt.Errorf("[ERROR] %s may not get the IP of %s: %w", self, other, ErrNotAuthorized)
+	}
+
+	rrow, ok := c.registrar.Load(other)
+	if !ok {
+		return rrow, fmt.Errorf("[ERROR] No IP stored for %s: %w", other, ErrNotRegistered)
+	}
 	return
 }
 func (c *IPCache) GrantAuth(
+	ctx context.Context,
 	owner string,
 	other string,
 	atype AuthType,
 ) (err error) {
-	return
+	entry := AuthGrantsRow{Owner: owner, Other: other, Type: atype}
+	if err = entry.Validate(); err != nil {
+		return
+	}
+	return c.authGrants.Store(ctx, c.db, entry)
 }
-func (c *IPCache) RevokeAuth(entry AuthGrantsRow) (err error) {
-	return
+func (c *IPCache) RevokeAuth(ctx context.Context, entry AuthGrantsRow) (err error) {
+	if err = entry.Validate(); err != nil {
+		return
+	}
+	return c.authGrants.Delete(ctx, c.db, entry)
 }
 
 func NewIPCache(
 	ctx context.Context,
 	db *sql.DB,
 	timeout time.Duration,
+	ttl TTLPolicy,
 ) (c *IPCache, err error) {
 	err = initDb(ctx, db)
 	if err != nil {
 		return
 	}
 
+	registrar, err := NewRegistrar(ctx, db, ttl.Default)
+	if err != nil {
+		return
+	}
+
+	authGrants, err := NewAuthGrants(ctx, db)
+	if err != nil {
+		return
+	}
+
 	c = &IPCache{
-		db: db,
-		timeout: timeout,
+		db:         db,
+		timeout:    timeout,
+		ttl:        ttl,
+		registrar:  registrar,
+		authGrants: authGrants,
 	}
 
 	return
@@ -195,22 +602,239 @@ func NewIPCache(
 type Registrar struct {
 	m *sync.Map
 	t *RegistrarTable
+	// Serializes read-modify-write of entries in `m`
+	mu sync.Mutex
 }
 
 type RegistrarTable struct {
-	selectAll *sql.Stmt
-	selectRow *sql.Stmt
-	insert    *sql.Stmt
+	selectAll     *sql.Stmt
+	selectRow     *sql.Stmt
+	insert        *sql.Stmt
+	updatePing    *sql.Stmt
+	updateOffline *sql.Stmt
+	updateExpired *sql.Stmt
+	deleteExpired *sql.Stmt
+
+	selectAllAddrs *sql.Stmt
+	insertAddr     *sql.Stmt
+	deleteAddrs    *sql.Stmt
+
+	selectAllServices *sql.Stmt
+	insertService     *sql.Stmt
+	deleteServices    *sql.Stmt
 }
 
 type RegistrarRow struct {
-	Skid string
+	Skid      string
 	UnixTsUtc int64
-	IP net.IP
+	IP        net.IP
+
+	// Whether a daemon is connected and registered right now
+	Online            bool
+	LastPingUtc       int64
+	ConnectedSinceUtc int64
+	// Zero while online, or if the daemon never disconnected
+	DisconnectedAtUtc int64
+
+	TTLSeconds   int64
+	ExpiresAtUtc int64
+	// Set by the sweeper once the entry is offline and past ExpiresAtUtc
+	Expired bool
+
+	// Observed address first, always present
+	Addrs []msgs.Address
+	Services []msgs.ServiceRecord
+}
+
+func (rrow RegistrarRow) Entry() msgs.IPEntry {
+	return msgs.IPEntry{
+		Skid:              rrow.Skid,
+		UnixTimestampUtc:  rrow.UnixTsUtc,
+		IP:                rrow.IP,
+		Online:            rrow.Online,
+		LastPingUtc:       rrow.LastPingUtc,
+		ConnectedSinceUtc: rrow.ConnectedSinceUtc,
+		DisconnectedAtUtc: rrow.DisconnectedAtUtc,
+		ExpiresAtUtc:      rrow.ExpiresAtUtc,
+		Expired:           rrow.Expired,
+		Addrs:             rrow.Addrs,
+	}
+}
+
+func NewRegistrar(ctx context.Context, db *sql.DB, defaultTTL time.Duration) (r *Registrar, err error) {
+	t := &RegistrarTable{}
+	if t.selectAll, err = db.PrepareContext(ctx, SQL_SelectAll_Registrar); err != nil {
+		return
+	}
+	if t.insert, err = db.PrepareContext(ctx, SQL_InsertRow_Registrar); err != nil {
+		return
+	}
+	if t.updatePing, err = db.PrepareContext(ctx, SQL_UpdatePing_Registrar); err != nil {
+		return
+	}
+	if t.updateOffline, err = db.PrepareContext(ctx, SQL_UpdateOffline_Registrar); err != nil {
+		return
+	}
+	if t.updateExpired, err = db.PrepareContext(ctx, SQL_UpdateExpired_Registrar); err != nil {
+		return
+	}
+	if t.deleteExpired, err = db.PrepareContext(ctx, SQL_DeleteExpired_Registrar); err != nil {
+		return
+	}
+	if t.selectAllAddrs, err = db.PrepareContext(ctx, SQL_SelectAll_RegistrarAddrs); err != nil {
+		return
+	}
+	if t.insertAddr, err = db.PrepareContext(ctx, SQL_InsertRow_RegistrarAddrs); err != nil {
+		return
+	}
+	if t.deleteAddrs, err = db.PrepareContext(ctx, SQL_DeleteSkid_RegistrarAddrs); err != nil {
+		return
+	}
+	if t.selectAllServices, err = db.PrepareContext(ctx, SQL_SelectAll_RegistrarServices); err != nil {
+		return
+	}
+	if t.insertService, err = db.PrepareContext(ctx, SQL_InsertRow_RegistrarServices); err != nil {
+		return
+	}
+	if t.deleteServices, err = db.PrepareContext(ctx, SQL_DeleteSkid_RegistrarServices); err != nil {
+		return
+	}
+
+	if _, err = db.ExecContext(ctx, SQL_BackfillTTL_Registrar, int64(defaultTTL/time.Second)); err != nil {
+		return
+	}
+	if _, err = db.ExecContext(ctx, SQL_MarkAllOffline_Registrar); err != nil {
+		return
+	}
+
+	rrows, err := t.SelectAll(ctx)
+	if err != nil {
+		return
+	}
+
+	m := &sync.Map{}
+	for _, rrow := range rrows {
+		log.Printf("[INFO] Got row from Registrar:\n\t- (skid: %s, ip: %s, last ping: %d)\n\n", rrow.Skid, rrow.IP, rrow.LastPingUtc)
+		m.Store(rrow.Skid, rrow)
+	}
+
+	return &Registrar{m: m, t: t}, err
+}
+
+func (r *Registrar) Load(skid string) (rrow RegistrarRow, ok bool) {
+	val, ok := r.m.Load(skid)
+	if !ok {
+		return
+	}
+	rrow, ok = val.(RegistrarRow)
+	if !ok {
+		log.Printf("[ERROR] Expected value with type `RegistrarRow` to be stored in Registrar\n\t- Got %v: %+v\n", reflect.TypeOf(val), val)
+	}
+	return
 }
 
-func NewRegistrar() {
+// Older entries never replace newer ones, as decided by the upsert in
+// SQL_InsertRow_Registrar, so a daemon reconnecting within the same second
+// still comes back online. Fails with ErrStaleRegistration if `rrow` is older
+// than the stored entry.
+func (r *Registrar) Store(ctx context.Context, db *sql.DB, rrow RegistrarRow) (changed bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
+	applied, err := r.t.Insert(ctx, db, rrow)
+	if err != nil {
+		return
+	}
+	if !applied {
+		return false, fmt.Errorf("[ERROR] %s has a newer entry than one from %d: %w", rrow.Skid, rrow.UnixTsUtc, ErrStaleRegistration)
+	}
+
+	prev, ok := r.Load(rrow.Skid)
+	r.m.Store(rrow.Skid, rrow)
+	return !ok || !prev.IP.Equal(rrow.IP) || !sameAddrs(prev.Addrs, rrow.Addrs), err
+}
+
+// Runs `stmt`, one of the RegistrarTable updates keyed on (timestamp, skid, ip),
+// and applies `update` to the cached entry if it is still online at `ip`
+func (r *Registrar) Update(
+	ctx context.Context,
+	db *sql.DB,
+	stmt *sql.Stmt,
+	skid string,
+	ip net.IP,
+	update func(rrow *RegistrarRow),
+) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rrow, ok := r.Load(skid)
+	if !ok || !rrow.Online || !rrow.IP.Equal(ip) {
+		return
+	}
+	update(&rrow)
+
+	var ts int64
+	if rrow.Online {
+		ts = rrow.LastPingUtc
+	} else {
+		ts = rrow.DisconnectedAtUtc
+	}
+	if err = r.t.Update(ctx, db, stmt, ts, skid, ip); err != nil {
+		return
+	}
+	r.m.Store(skid, rrow)
+	return
+}
+
+// Marks offline entries past their expiry as expired, and purges expired
+// entries `purgeAfter` past their expiry. Each entry is matched on its
+// expiry too, so one that was refreshed in the meantime is left alone.
+func (r *Registrar) Sweep(
+	ctx context.Context,
+	db *sql.DB,
+	now int64,
+	purgeAfter time.Duration,
+) (expired []RegistrarRow, purged []RegistrarRow, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rrows []RegistrarRow
+	r.m.Range(func(key any, val any) bool {
+		if rrow, ok := val.(RegistrarRow); ok {
+			rrows = append(rrows, rrow)
+		}
+		return true
+	})
+
+	purgeAfterSeconds := int64(purgeAfter / time.Second)
+	for _, rrow := range rrows {
+		switch {
+		case rrow.Online || now < rrow.ExpiresAtUtc:
+			continue
+
+		case !rrow.Expired:
+			if err = r.t.Exec(ctx, db, r.t.updateExpired, rrow.Skid, rrow.ExpiresAtUtc); err != nil {
+				return
+			}
+			rrow.Expired = true
+			r.m.Store(rrow.Skid, rrow)
+			expired = append(expired, rrow)
+
+		case now >= rrow.ExpiresAtUtc+purgeAfterSeconds:
+			if err = r.t.Exec(ctx, db, r.t.deleteExpired, rrow.Skid, rrow.ExpiresAtUtc); err != nil {
+				return
+			}
+			if err = r.t.Exec(ctx, db, r.t.deleteAddrs, rrow.Skid); err != nil {
+				return
+			}
+			if err = r.t.Exec(ctx, db, r.t.deleteServices, rrow.Skid); err != nil {
+				return
+			}
+			r.m.Delete(rrow.Skid)
+			purged = append(purged, rrow)
+		}
+	}
+	return
 }
 
 func (r *RegistrarTable) SelectAll(ctx context.Context) (rrows []RegistrarRow, err error) {
@@ -220,12 +844,219 @@ func (r *RegistrarTable) SelectAll(ctx context.Context) (rrows []RegistrarRow, e
 	}
 	defer rows.Close()
 
+	for rows.Next() {
+		var (
+			rrow  RegistrarRow
+			strIp string
+		)
+
+		err = rows.Scan(
+			&rrow.Skid,
+			&rrow.UnixTsUtc,
+			&strIp,
+			&rrow.Online,
+			&rrow.LastPingUtc,
+			&rrow.ConnectedSinceUtc,
+			&rrow.DisconnectedAtUtc,
+			&rrow.TTLSeconds,
+			&rrow.ExpiresAtUtc,
+			&rrow.Expired)
+		if err != nil {
+			return
+		}
+
+		rrow.IP = net.ParseIP(strIp)
+		if rrow.IP == nil {
+			err = fmt.Errorf("[ERROR] Failed to parse `%s` as an IP", strIp)
+			return
+		}
+		rrows = append(rrows, rrow)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	addrs, err := r.SelectAllAddrs(ctx)
+	if err != nil {
+		return
+	}
+	services, err := r.SelectAllServices(ctx)
+	if err != nil {
+		return
+	}
+	for i := range rrows {
+		rrows[i].Services = services[rrows[i].Skid]
+		rrows[i].Addrs = addrs[rrows[i].Skid]
+		// Rows from before RegistrarAddrs existed only have their observed IP
+		if len(rrows[i].Addrs) == 0 {
+			rrows[i].Addrs, _ = registrarAddrs(rrows[i].IP, nil)
+		}
+	}
+	return
+}
+
+func (r *RegistrarTable) SelectAllAddrs(ctx context.Context) (addrs map[string][]msgs.Address, err error) {
+	rows, err := r.selectAllAddrs.QueryContext(ctx)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	addrs = map[string][]msgs.Address{}
+	for rows.Next() {
+		var (
+			skid  string
+			addr  msgs.Address
+			strIp string
+		)
+
+		err = rows.Scan(&skid, &strIp, &addr.Port, &addr.Family, &addr.Scope, &addr.Label, &addr.Observed)
+		if err != nil {
+			return
+		}
+
+		addr.IP = net.ParseIP(strIp)
+		if addr.IP == nil {
+			err = fmt.Errorf("[ERROR] Failed to parse `%s` as an IP", strIp)
+			return
+		}
+		addrs[skid] = append(addrs[skid], addr)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (r *RegistrarTable) SelectAllServices(ctx context.Context) (services map[string][]msgs.ServiceRecord, err error) {
+	rows, err := r.selectAllServices.QueryContext(ctx)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	services = map[string][]msgs.ServiceRecord{}
+	for rows.Next() {
+		var (
+			skid     string
+			svc      msgs.ServiceRecord
+			metadata string
+		)
+
+		err = rows.Scan(&skid, &svc.Name, &svc.Protocol, &svc.Port, &metadata)
+		if err != nil {
+			return
+		}
+
+		if err = json.Unmarshal([]byte(metadata), &svc.Metadata); err != nil {
+			err = fmt.Errorf("[ERROR] Failed to parse metadata of service %s of %s\n\t- %w", svc.Name, skid, err)
+			return
+		}
+		if len(svc.Metadata) == 0 {
+			svc.Metadata = nil
+		}
+		services[skid] = append(services[skid], svc)
+	}
+
+	err = rows.Err()
 	return
 }
 
-type AuthType int64
+// Upserts `rrow` and, if it was newer than what was stored, replaces its
+// addresses and services, all in one transaction. Reports whether the upsert applied.
+func (r *RegistrarTable) Insert(ctx context.Context, db *sql.DB, rrow RegistrarRow) (applied bool, err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable, ReadOnly: false})
+	if err != nil {
+		return
+	}
+
+	log.Printf("[RegistrarTable.Insert] %+v\n", rrow)
+	result, err := tx.
+		StmtContext(ctx, r.insert).
+		ExecContext(
+			ctx,
+			rrow.Skid,
+			rrow.UnixTsUtc,
+			rrow.IP.String(),
+			rrow.Online,
+			rrow.LastPingUtc,
+			rrow.ConnectedSinceUtc,
+			rrow.DisconnectedAtUtc,
+			rrow.TTLSeconds,
+			rrow.ExpiresAtUtc,
+			rrow.Expired)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		return false, fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		rollbackErr := tx.Rollback()
+		return false, errors.Join(err, rollbackErr)
+	}
+
+	if _, err = tx.StmtContext(ctx, r.deleteAddrs).ExecContext(ctx, rrow.Skid); err != nil {
+		rollbackErr := tx.Rollback()
+		return false, fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+	insertAddr := tx.StmtContext(ctx, r.insertAddr)
+	for _, addr := range rrow.Addrs {
+		_, err = insertAddr.ExecContext(ctx, rrow.Skid, addr.IP.String(), addr.Port, addr.Family, addr.Scope, addr.Label, addr.Observed)
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			return false, fmt.Errorf("%w\n\t%w", rollbackErr, err)
+		}
+	}
+
+	if _, err = tx.StmtContext(ctx, r.deleteServices).ExecContext(ctx, rrow.Skid); err != nil {
+		rollbackErr := tx.Rollback()
+		return false, fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+	insertService := tx.StmtContext(ctx, r.insertService)
+	for _, svc := range rrow.Services {
+		metadata, err := json.Marshal(svc.Metadata)
+		if err == nil && svc.Metadata == nil {
+			metadata = []byte("{}")
+		}
+		if err == nil {
+			_, err = insertService.ExecContext(ctx, rrow.Skid, svc.Name, svc.Protocol, svc.Port, string(metadata))
+		}
+		if err != nil {
+			rollbackErr := tx.Rollback()
+			return false, fmt.Errorf("%w\n\t%w", rollbackErr, err)
+		}
+	}
+
+	err = tx.Commit()
+	return err == nil, err
+}
+
+func (r *RegistrarTable) Update(ctx context.Context, db *sql.DB, stmt *sql.Stmt, unixTsUtc int64, skid string, ip net.IP) (err error) {
+	return r.Exec(ctx, db, stmt, unixTsUtc, skid, ip.String())
+}
+
+// Runs one of the RegistrarTable statements in its own transaction
+func (r *RegistrarTable) Exec(ctx context.Context, db *sql.DB, stmt *sql.Stmt, args ...any) (err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable, ReadOnly: false})
+	if err != nil {
+		return
+	}
+
+	_, err = tx.
+		StmtContext(ctx, stmt).
+		ExecContext(ctx, args...)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		return fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+
+	err = tx.Commit()
+	return
+}
+
+type AuthType = msgs.AuthType
 const (
-	AuthT_GetIP AuthType = 0
+	AuthT_GetIP = msgs.AuthT_GetIP
 )
 
 type AuthGrants struct {
@@ -242,7 +1073,141 @@ type AuthGrantsTable struct {
 type AuthGrantsRow struct {
 	Owner string
 	Other string
-	Type AuthType
+	Type  AuthType
+}
+
+func (arow AuthGrantsRow) Validate() (err error) {
+	switch {
+	case arow.Other == "":
+		return fmt.Errorf("[ERROR] Grant is missing the SKID of the other client: %w", ErrInvalidGrant)
+	case arow.Owner == arow.Other:
+		return fmt.Errorf("[ERROR] Client %s cannot grant permissions to itself: %w", arow.Owner, ErrInvalidGrant)
+	case arow.Type != AuthT_GetIP:
+		return fmt.Errorf("[ERROR] Unknown authorization type %d: %w", arow.Type, ErrInvalidGrant)
+	}
+	return
+}
+
+func NewAuthGrants(ctx context.Context, db *sql.DB) (a *AuthGrants, err error) {
+	t := &AuthGrantsTable{}
+	if t.selectAll, err = db.PrepareContext(ctx, SQL_SelectAll_AuthGrants); err != nil {
+		return
+	}
+	if t.insert, err = db.PrepareContext(ctx, SQL_InsertRow_AuthGrants); err != nil {
+		return
+	}
+	if t.remove, err = db.PrepareContext(ctx, SQL_DeleteRow_AuthGrants); err != nil {
+		return
+	}
+
+	arows, err := t.SelectAll(ctx)
+	if err != nil {
+		return
+	}
+
+	// Keyed on the whole row, values are unused
+	m := &sync.Map{}
+	for _, arow := range arows {
+		m.Store(arow, struct{}{})
+	}
+
+	return &AuthGrants{m: m, t: t}, err
+}
+
+func (a *AuthGrants) Has(arow AuthGrantsRow) bool {
+	_, ok := a.m.Load(arow)
+	return ok
+}
+
+// Returns every owner that has granted `other` the permission `atype`
+func (a *AuthGrants) Owners(other string, atype AuthType) (owners []string) {
+	a.m.Range(func(key, _ any) bool {
+		arow, ok := key.(AuthGrantsRow)
+		if ok && arow.Other == other && arow.Type == atype {
+			owners = append(owners, arow.Owner)
+		}
+		return true
+	})
+	return
+}
+
+func (a *AuthGrants) Store(ctx context.Context, db *sql.DB, arow AuthGrantsRow) (err error) {
+	if err = a.t.Insert(ctx, db, arow); err != nil {
+		return
+	}
+	a.m.Store(arow, struct{}{})
+	return
+}
+
+func (a *AuthGrants) Delete(ctx context.Context, db *sql.DB, arow AuthGrantsRow) (err error) {
+	if err = a.t.Delete(ctx, db, arow); err != nil {
+		return
+	}
+	a.m.Delete(arow)
+	return
+}
+
+func (a *AuthGrantsTable) SelectAll(ctx context.Context) (arows []AuthGrantsRow, err error) {
+	rows, err := a.selectAll.QueryContext(ctx)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var arow AuthGrantsRow
+		err = rows.Scan(&arow.Owner, &arow.Other, &arow.Type)
+		if err != nil {
+			return
+		}
+		arows = append(arows, arow)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (a *AuthGrantsTable) Insert(ctx context.Context, db *sql.DB, arow AuthGrantsRow) (err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable, ReadOnly: false})
+	if err != nil {
+		return
+	}
+
+	log.Printf("[AuthGrantsTable.Insert] %+v\n", arow)
+	_, err = tx.
+		StmtContext(ctx, a.insert).
+		ExecContext(ctx, arow.Owner, arow.Other, arow.Type)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		return fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func (a *AuthGrantsTable) Delete(ctx context.Context, db *sql.DB, arow AuthGrantsRow) (err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable, ReadOnly: false})
+	if err != nil {
+		return
+	}
+
+	log.Printf("[AuthGrantsTable.Delete] %+v\n", arow)
+	res, err := tx.
+		StmtContext(ctx, a.remove).
+		ExecContext(ctx, arow.Owner, arow.Other, arow.Type)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		return fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		rollbackErr := tx.Rollback()
+		return errors.Join(rollbackErr, fmt.Errorf("[ERROR] No grant stored for %+v: %w", arow, ErrNotGranted))
+	}
+
+	err = tx.Commit()
+	return
 }
 
 
@@ -251,6 +1216,15 @@ func initDb(ctx context.Context, db *sql.DB) (err error) {
 	if err != nil {
 		return err
 	}
+	if err = migrateRegistrar(ctx, db); err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, SQL_CreateTable_RegistrarAddrs); err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, SQL_CreateTable_RegistrarServices); err != nil {
+		return err
+	}
 
 	// Check if Enum-style table exists, else create and insert values into it
 	row := db.QueryRowContext(ctx, SQL_TableExists_AuthType)
@@ -291,75 +1265,40 @@ func initDb(ctx context.Context, db *sql.DB) (err error) {
 		return err
 	}
 
-	stmt_insert_registrar, err = db.PrepareContext(ctx, SQL_InsertRow_Registrar)
-	if err != nil {
-		return err
-	}
-
 	return
 }
 
-func getRegistrar(ctx context.Context, db *sql.DB) (registrar *sync.Map, err error) {
-	var rows *sql.Rows
-	if rows, err = db.QueryContext(ctx, SQL_SelectAll_Registrar); err != nil {
-		log.Println(err)
-		return
+// Adds the columns in SQL_Columns_Registrar to a Registrar table created
+// before they existed
+func migrateRegistrar(ctx context.Context, db *sql.DB) (err error) {
+	rows, err := db.QueryContext(ctx, SQL_TableInfo_Registrar)
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
 
-	registrar = &sync.Map{}
-	var ignored int64
+	have := map[string]bool{}
 	for rows.Next() {
-		var (
-			clientId,
-			clientStrIp string
-			clientIP net.IP
-		)
-
-		err = rows.Scan(&clientId, &ignored, &clientStrIp)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		clientIP = net.ParseIP(clientStrIp)
-		if clientIP == nil {
-			err = fmt.Errorf("[ERROR] Failed to parse `%s` as an IP", clientStrIp)
-			return
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
 		}
-		log.Printf("[INFO] Got row from Registrar:\n\t- (skid: %s, ip: %s)\n\n", clientId, clientIP)
-		registrar.Store(clientId, clientIP)
+		have[name] = true
 	}
-
 	if err = rows.Err(); err != nil {
-		log.Println(err)
-		return
-	}
-
-	return
-}
-
-func insertRegistrar(
-	ctx context.Context,
-	db *sql.DB,
-	client msgs.Client,
-	ts int64,
-) (err error) {
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelLinearizable, ReadOnly: false})
-	if err != nil {
-		return
+		return err
 	}
 
-	log.Printf("[insertRegistrar] %+v\n", client)
-	_, err = tx.
-		StmtContext(ctx, stmt_insert_registrar).
-		ExecContext(ctx, client.Id, ts, client.IP.String())
-	if err != nil {
-		rollbackErr := tx.Rollback()
-		return fmt.Errorf("%w\n\t%w", rollbackErr, err)
+	for _, col := range SQL_Columns_Registrar {
+		if have[col.Name] {
+			continue
+		}
+		log.Printf("[INFO] Adding column %s to Registrar\n", col.Name)
+		_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE Registrar ADD COLUMN %s %s;", col.Name, col.Def))
+		if err != nil {
+			return err
+		}
 	}
-
-	err = tx.Commit()
 	return
 }
 
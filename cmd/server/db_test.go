@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestClientAuthorizationHandler(t *testing.T) {
+	c := newTestCache(t)
+	alice := testClient("alice", "192.0.2.1")
+
+	tests := []struct {
+		name    string
+		msgT    msgs.MessageType
+		grant   msgs.GrantRequest
+		wantErr msgs.ErrorCode
+		wantHas bool
+	}{
+		{name: "grant", msgT: msgs.T_ClientGrantAuthorization, grant: msgs.GrantRequest{Other: "bob"}, wantHas: true},
+		{name: "grant again", msgT: msgs.T_ClientGrantAuthorization, grant: msgs.GrantRequest{Other: "bob"}, wantHas: true},
+		{name: "grant to self", msgT: msgs.T_ClientGrantAuthorization, grant: msgs.GrantRequest{Other: "alice"}, wantErr: msgs.ErrC_BadRequest},
+		{name: "grant to nobody", msgT: msgs.T_ClientGrantAuthorization, grant: msgs.GrantRequest{}, wantErr: msgs.ErrC_BadRequest},
+		{name: "grant unknown type", msgT: msgs.T_ClientGrantAuthorization, grant: msgs.GrantRequest{Other: "bob", Type: 7}, wantErr: msgs.ErrC_BadRequest},
+		{name: "revoke", msgT: msgs.T_ClientRevokeAuthorization, grant: msgs.GrantRequest{Other: "bob"}, wantHas: false},
+		{name: "revoke again", msgT: msgs.T_ClientRevokeAuthorization, grant: msgs.GrantRequest{Other: "bob"}, wantErr: msgs.ErrC_NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &recordingMessenger{}
+			req, err := msgs.Marshal(tt.msgT, tt.grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ClientAuthorizationHandler(m, alice, req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := m.reply(t)
+			if tt.wantErr != msgs.ErrC_Unknown {
+				if code := errCode(t, reply); code != tt.wantErr {
+					t.Fatalf("Err code = %s, want %s", code, tt.wantErr)
+				}
+				return
+			}
+			if reply.Type != msgs.T_Ok {
+				t.Fatalf("got %s, want Ok", reply.Type)
+			}
+			grant := AuthGrantsRow{Owner: "alice", Other: tt.grant.Other, Type: tt.grant.Type}
+			if has := c.authGrants.Has(grant); has != tt.wantHas {
+				t.Fatalf("Has(%+v) = %v, want %v", grant, has, tt.wantHas)
+			}
+		})
+	}
+}
+
+func TestAuthGrantsPersist(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+	grantTestAuth(t, c, "alice", "bob")
+	grantTestAuth(t, c, "alice", "carol")
+	if err := c.RevokeAuth(ctx, AuthGrantsRow{Owner: "alice", Other: "carol", Type: AuthT_GetIP}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewIPCache(ctx, db, dbTimeout, ttlPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.authGrants.Has(AuthGrantsRow{Owner: "alice", Other: "bob", Type: AuthT_GetIP}) {
+		t.Error("grant to bob was lost on reload")
+	}
+	if reloaded.authGrants.Has(AuthGrantsRow{Owner: "alice", Other: "carol", Type: AuthT_GetIP}) {
+		t.Error("revoked grant to carol is back after reload")
+	}
+	if reloaded.authGrants.Has(AuthGrantsRow{Owner: "bob", Other: "alice", Type: AuthT_GetIP}) {
+		t.Error("grants must not be symmetric")
+	}
+
+	err = reloaded.RevokeAuth(ctx, AuthGrantsRow{Owner: "alice", Other: "carol", Type: AuthT_GetIP})
+	if !errors.Is(err, ErrNotGranted) {
+		t.Fatalf("revoking a missing grant = %v, want ErrNotGranted", err)
+	}
+}
+
+func TestRegistrarLiveness(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+	ip, otherIP := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	start := time.Now().UTC().Unix()
+
+	registerTestDaemon(t, c, "alice", ip.String())
+
+	steps := []struct {
+		name        string
+		do          func() error
+		wantOnline  bool
+		wantOffline bool
+	}{
+		{"registered", func() error { return nil }, true, false},
+		{"pinged", func() error { return c.Ping(ctx, "alice", ip) }, true, false},
+		{"ping from another IP is ignored", func() error { return c.Ping(ctx, "alice", otherIP) }, true, false},
+		{"disconnect from another IP is ignored", func() error { return c.Disconnect(ctx, "alice", otherIP) }, true, false},
+		{"disconnected", func() error { return c.Disconnect(ctx, "alice", ip) }, false, true},
+		{"ping once offline is ignored", func() error { return c.Ping(ctx, "alice", ip) }, false, true},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		rrow, ok := c.registrar.Load("alice")
+		if !ok {
+			t.Fatalf("%s: entry is gone", step.name)
+		}
+		if rrow.Online != step.wantOnline {
+			t.Errorf("%s: Online = %v, want %v", step.name, rrow.Online, step.wantOnline)
+		}
+		if rrow.ConnectedSinceUtc < start || rrow.LastPingUtc < rrow.ConnectedSinceUtc {
+			t.Errorf("%s: connected since %d, last ping %d, want both from %d on", step.name, rrow.ConnectedSinceUtc, rrow.LastPingUtc, start)
+		}
+		if step.wantOffline != (rrow.DisconnectedAtUtc != 0) {
+			t.Errorf("%s: DisconnectedAtUtc = %d", step.name, rrow.DisconnectedAtUtc)
+		}
+		lastSeen := rrow.LastPingUtc
+		if step.wantOffline {
+			lastSeen = rrow.DisconnectedAtUtc
+		}
+		if rrow.ExpiresAtUtc != lastSeen+rrow.TTLSeconds {
+			t.Errorf("%s: expires at %d, want last seen %d plus TTL %d", step.name, rrow.ExpiresAtUtc, lastSeen, rrow.TTLSeconds)
+		}
+	}
+
+	// Whatever was in memory must also have been written through
+	want, _ := c.registrar.Load("alice")
+	reloaded, err := NewIPCache(ctx, db, dbTimeout, ttlPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := reloaded.registrar.Load("alice")
+	if !ok || got.Online || got.DisconnectedAtUtc != want.DisconnectedAtUtc || got.ExpiresAtUtc != want.ExpiresAtUtc {
+		t.Fatalf("reloaded %+v, want %+v", got, want)
+	}
+}
+
+func TestRegistrarAddrs(t *testing.T) {
+	observed := net.ParseIP("198.51.100.1")
+	addr := func(ip string, port int, label string) msgs.Address {
+		return msgs.Address{IP: net.ParseIP(ip), Port: port, Label: label}
+	}
+	tooMany := make([]msgs.Address, MaxRegistrarAddrs+1)
+	for i := range tooMany {
+		tooMany[i] = addr("203.0.113.1", i+1, "")
+	}
+
+	tests := []struct {
+		name      string
+		requested []msgs.Address
+		// IP:port of each stored address, in order; nil to only check the rest
+		want    []string
+		wantErr bool
+	}{
+		{name: "observed only", want: []string{"198.51.100.1:0"}},
+		{
+			name:      "observed first",
+			requested: []msgs.Address{addr("10.0.0.1", 0, "lan"), addr("203.0.113.7", 22, "wan")},
+			want:      []string{"198.51.100.1:0", "10.0.0.1:0", "203.0.113.7:22"},
+		},
+		{
+			name:      "duplicates dropped",
+			requested: []msgs.Address{addr("10.0.0.1", 0, "lan"), addr("10.0.0.1", 0, "other"), addr("10.0.0.1", 22, "")},
+			want:      []string{"198.51.100.1:0", "10.0.0.1:0", "10.0.0.1:22"},
+		},
+		{
+			name:      "duplicate of the observed one",
+			requested: []msgs.Address{addr("198.51.100.1", 0, "wan")},
+			want:      []string{"198.51.100.1:0"},
+		},
+		{name: "most allowed", requested: tooMany[:MaxRegistrarAddrs]},
+		{name: "too many", requested: tooMany, wantErr: true},
+		{name: "unspecified", requested: []msgs.Address{addr("0.0.0.0", 0, "")}, wantErr: true},
+		{name: "bad port", requested: []msgs.Address{addr("10.0.0.1", 65536, "")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := registrarAddrs(observed, tt.requested)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAddress) {
+					t.Fatalf("registrarAddrs = %v, want ErrInvalidAddress", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !addrs[0].Observed || !addrs[0].IP.Equal(observed) {
+				t.Fatalf("first address %+v, want the observed one", addrs[0])
+			}
+			for _, a := range addrs[1:] {
+				if a.Observed {
+					t.Errorf("%s marked observed", a)
+				}
+			}
+			for _, a := range addrs {
+				if a.Family != msgs.AddrFamily(a.IP) || a.Scope != msgs.AddrScope(a.IP) {
+					t.Errorf("%s has family %q and scope %q", a, a.Family, a.Scope)
+				}
+			}
+			if tt.want == nil {
+				return
+			}
+			got := make([]string, len(addrs))
+			for i, a := range addrs {
+				got[i] = net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("registrarAddrs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The observed address takes the label of a duplicate the daemon sent
+func TestRegistrarAddrsLabelsObserved(t *testing.T) {
+	addrs, err := registrarAddrs(net.ParseIP("198.51.100.1"), []msgs.Address{{IP: net.ParseIP("198.51.100.1"), Label: "wan"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Label != "wan" {
+		t.Fatalf("registrarAddrs = %v, want the observed address labelled wan", addrs)
+	}
+}
+
+func TestRegistrarServices(t *testing.T) {
+	ssh := msgs.ServiceRecord{Name: "ssh", Protocol: msgs.Proto_TCP, Port: 22}
+	tooMany := make([]msgs.ServiceRecord, MaxRegistrarServices+1)
+	for i := range tooMany {
+		tooMany[i] = msgs.ServiceRecord{Name: "svc-" + strconv.Itoa(i), Protocol: msgs.Proto_TCP, Port: i + 1}
+	}
+
+	tests := []struct {
+		name      string
+		requested []msgs.ServiceRecord
+		wantErr   bool
+	}{
+		{name: "none"},
+		{name: "one", requested: []msgs.ServiceRecord{ssh}},
+		{name: "same name on both protocols", requested: []msgs.ServiceRecord{ssh, {Name: "ssh", Protocol: msgs.Proto_UDP, Port: 22}}},
+		{name: "most allowed", requested: tooMany[:MaxRegistrarServices]},
+		{name: "same name and protocol twice", requested: []msgs.ServiceRecord{ssh, {Name: "ssh", Protocol: msgs.Proto_TCP, Port: 2222}}, wantErr: true},
+		{name: "too many", requested: tooMany, wantErr: true},
+		{name: "invalid", requested: []msgs.ServiceRecord{{Name: "ssh", Protocol: "sctp", Port: 22}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		services, err := registrarServices(tt.requested)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidService) {
+				t.Errorf("%s: registrarServices = %v, want ErrInvalidService", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || len(services) != len(tt.requested) {
+			t.Errorf("%s: registrarServices = %d services, %v, want all %d", tt.name, len(services), err, len(tt.requested))
+		}
+	}
+}
+
+func TestGetServices(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+	services := []msgs.ServiceRecord{
+		{Name: "ssh", Protocol: msgs.Proto_TCP, Port: 22},
+		{Name: "http", Protocol: msgs.Proto_TCP, Port: 80, Metadata: map[string]string{"path": "/"}},
+	}
+	for _, skid := range []string{"alice", "bob"} {
+		addrs, _ := registrarAddrs(net.ParseIP("192.0.2.1"), nil)
+		if _, err := c.Register(ctx, skid, net.ParseIP("192.0.2.1"), time.Hour, addrs, services); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grantTestAuth(t, c, "alice", "carol")
+
+	tests := []struct {
+		name      string
+		skids     []string
+		svcName   string
+		wantSkids []string
+		wantNames []string
+		wantErr   error
+	}{
+		{name: "every granted daemon", wantSkids: []string{"alice"}, wantNames: []string{"ssh", "http"}},
+		{name: "by name", svcName: "ssh", wantSkids: []string{"alice"}, wantNames: []string{"ssh"}},
+		{name: "unknown name", svcName: "smtp", wantSkids: []string{"alice"}},
+		{name: "granted SKID", skids: []string{"alice"}, wantSkids: []string{"alice"}, wantNames: []string{"ssh", "http"}},
+		{name: "SKID not granted", skids: []string{"bob"}, wantErr: ErrNotAuthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := c.GetServices("carol", tt.skids, tt.svcName)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GetServices = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var skids, names []string
+			for _, entry := range entries {
+				skids = append(skids, entry.Skid)
+				for _, svc := range entry.Services {
+					names = append(names, svc.Name)
+				}
+			}
+			if !slices.Equal(skids, tt.wantSkids) || !slices.Equal(names, tt.wantNames) {
+				t.Fatalf("GetServices = %v with %v, want %v with %v", skids, names, tt.wantSkids, tt.wantNames)
+			}
+		})
+	}
+
+	// Services survive a restart, in name order
+	reloaded, err := NewIPCache(ctx, db, dbTimeout, ttlPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrow, _ := reloaded.registrar.Load("alice")
+	if len(rrow.Services) != len(services) || rrow.Services[0].Name != "http" || rrow.Services[0].Metadata["path"] != "/" {
+		t.Fatalf("reloaded services %v, want %v", rrow.Services, services)
+	}
+}
+
+func TestRegistrarStoreOutOfOrder(t *testing.T) {
+	ip, otherIP := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	tests := []struct {
+		name string
+		// Of the second registration, relative to the first
+		age     int64
+		wantErr bool
+	}{
+		{"newer", -1, false},
+		{"same second", 0, false},
+		{"older", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			ctx := context.Background()
+			registerTestDaemon(t, c, "alice", ip.String())
+			first, _ := c.registrar.Load("alice")
+
+			second := RegistrarRow{Skid: "alice", UnixTsUtc: first.UnixTsUtc - tt.age, IP: otherIP, Online: true}
+			_, err := c.registrar.Store(ctx, c.db, second)
+			if tt.wantErr != errors.Is(err, ErrStaleRegistration) {
+				t.Fatalf("Store = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+
+			wantIP := otherIP
+			if tt.wantErr {
+				wantIP = ip
+			}
+			rrow, _ := c.registrar.Load("alice")
+			if !rrow.IP.Equal(wantIP) {
+				t.Errorf("entry at %s, want %s", rrow.IP, wantIP)
+			}
+			reloaded, err := NewIPCache(ctx, db, dbTimeout, ttlPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rrow, _ = reloaded.registrar.Load("alice"); !rrow.IP.Equal(wantIP) {
+				t.Errorf("reloaded entry at %s, want %s", rrow.IP, wantIP)
+			}
+		})
+	}
+}
+
+// A registration the registrar refuses as stale must not be acknowledged
+func TestDaemonRegisterStale(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+
+	// As if the server's clock had stepped back since
+	future := RegistrarRow{Skid: "alice", UnixTsUtc: time.Now().Unix() + 3600, IP: net.ParseIP("192.0.2.1")}
+	if _, err := c.registrar.Store(ctx, c.db, future); err != nil {
+		t.Fatal(err)
+	}
+
+	messenger := &recordingMessenger{}
+	s := NewSession(testClient("alice", "192.0.2.1"), messenger, time.Minute, Rate{})
+	s.Negotiated(msgs.Version_1_1_0)
+	if err := DaemonRegisterHandler(s, testRequest(t, msgs.T_DaemonRegister, msgs.RegisterRequest{})); !errors.Is(err, ErrStaleRegistration) {
+		t.Fatalf("DaemonRegisterHandler = %v, want ErrStaleRegistration", err)
+	}
+	if code := errCode(t, messenger.reply(t)); code != msgs.ErrC_Conflict {
+		t.Errorf("Err code = %s, want Conflict", code)
+	}
+	if _, ok := daemons.Load("alice"); ok {
+		t.Error("refused session is still in daemons")
+	}
+}
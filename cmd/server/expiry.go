@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How long registrar entries are kept after their daemon was last seen
+type TTLPolicy struct {
+	// Applied when the daemon does not ask for a TTL
+	Default time.Duration
+	// Upper bound on what a daemon may ask for
+	Max time.Duration
+	// Time between an entry being marked expired and being deleted
+	PurgeAfter time.Duration
+}
+
+func (p TTLPolicy) Validate() error {
+	var errs []error
+	if p.Default < time.Second {
+		errs = append(errs, fmt.Errorf("registrar TTL of %s is shorter than 1s", p.Default))
+	}
+	if p.Max < p.Default {
+		errs = append(errs, fmt.Errorf("max registrar TTL of %s is shorter than the default of %s", p.Max, p.Default))
+	}
+	if p.PurgeAfter < 0 {
+		errs = append(errs, fmt.Errorf("purge delay of %s is negative", p.PurgeAfter))
+	}
+	return errors.Join(errs...)
+}
+
+// The TTL granted to a daemon asking for `requested`, where zero asks for the default
+func (p TTLPolicy) Resolve(requested time.Duration) time.Duration {
+	switch {
+	case requested <= 0:
+		return p.Default
+	case requested < time.Second:
+		return time.Second
+	case requested > p.Max:
+		return p.Max
+	default:
+		return requested.Truncate(time.Second)
+	}
+}
+
+func (c *IPCache) Sweep(ctx context.Context) (err error) {
+	now := time.Now().UTC().Unix()
+	expired, purged, err := c.registrar.Sweep(ctx, c.db, now, c.ttl.PurgeAfter)
+
+	for _, rrow := range expired {
+		log.Printf("[SWEEP] Expired entry of %s\n\t- IP: %s, offline since %s\n", rrow.Skid, rrow.IP, time.Unix(rrow.DisconnectedAtUtc, 0).UTC())
+	}
+	for _, rrow := range purged {
+		log.Printf("[SWEEP] Purged entry of %s\n\t- IP: %s, expired at %s\n", rrow.Skid, rrow.IP, time.Unix(rrow.ExpiresAtUtc, 0).UTC())
+	}
+	return err
+}
+
+// Sweeps the registrar every `interval` until ctx is cancelled
+func RunSweeper(ctx context.Context, c *IPCache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweepCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			if err := c.Sweep(sweepCtx); err != nil {
+				log.Println("[ERROR] Registrar sweep failed\n\t-", err)
+			}
+			cancel()
+		}
+	}
+}
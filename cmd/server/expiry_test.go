@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTTLPolicyResolve(t *testing.T) {
+	p := TTLPolicy{Default: time.Hour, Max: 24 * time.Hour}
+	tests := []struct {
+		requested time.Duration
+		want      time.Duration
+	}{
+		{0, time.Hour},
+		{-time.Minute, time.Hour},
+		{time.Millisecond, time.Second},
+		{90*time.Second + 500*time.Millisecond, 90 * time.Second},
+		{48 * time.Hour, 24 * time.Hour},
+		{24 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := p.Resolve(tt.requested); got != tt.want {
+			t.Errorf("Resolve(%s) = %s, want %s", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestTTLPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  TTLPolicy
+		wantErr bool
+	}{
+		{"valid", TTLPolicy{Default: time.Hour, Max: 24 * time.Hour, PurgeAfter: time.Hour}, false},
+		{"purge right away", TTLPolicy{Default: time.Hour, Max: time.Hour}, false},
+		{"default under a second", TTLPolicy{Default: time.Millisecond, Max: time.Hour}, true},
+		{"max under default", TTLPolicy{Default: time.Hour, Max: time.Minute}, true},
+		{"negative purge delay", TTLPolicy{Default: time.Hour, Max: time.Hour, PurgeAfter: -time.Second}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRegistrarSweep(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+	purgeAfter := time.Hour
+
+	registerTestDaemon(t, c, "online", "192.0.2.1")
+	registerTestDaemon(t, c, "offline", "192.0.2.2")
+	if err := c.Disconnect(ctx, "offline", net.ParseIP("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	offline, _ := c.registrar.Load("offline")
+	expiresAt := offline.ExpiresAtUtc
+
+	tests := []struct {
+		name        string
+		now         int64
+		wantExpired []string
+		wantPurged  []string
+		// Whether the offline entry is still in the registrar afterwards
+		wantKept bool
+	}{
+		{name: "before expiry", now: expiresAt - 1, wantKept: true},
+		{name: "at expiry", now: expiresAt, wantExpired: []string{"offline"}, wantKept: true},
+		{name: "already expired", now: expiresAt + 1, wantKept: true},
+		{name: "at purge", now: expiresAt + int64(purgeAfter/time.Second), wantPurged: []string{"offline"}},
+		{name: "nothing left to sweep", now: expiresAt + 2*int64(purgeAfter/time.Second)},
+	}
+	for _, tt := range tests {
+		expired, purged, err := c.registrar.Sweep(ctx, db, tt.now, purgeAfter)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := skidsOf(expired); !slices.Equal(got, tt.wantExpired) {
+			t.Errorf("%s: expired %v, want %v", tt.name, got, tt.wantExpired)
+		}
+		if got := skidsOf(purged); !slices.Equal(got, tt.wantPurged) {
+			t.Errorf("%s: purged %v, want %v", tt.name, got, tt.wantPurged)
+		}
+		if _, ok := c.registrar.Load("offline"); ok != tt.wantKept {
+			t.Errorf("%s: offline entry kept = %v, want %v", tt.name, ok, tt.wantKept)
+		}
+		if rrow, ok := c.registrar.Load("online"); !ok || rrow.Expired {
+			t.Fatalf("%s: online entry swept", tt.name)
+		}
+	}
+
+	// The purge must have reached the database too
+	reloaded, err := NewIPCache(ctx, db, dbTimeout, ttlPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.registrar.Load("offline"); ok {
+		t.Fatal("purged entry is back after reload")
+	}
+}
+
+// Registering again after expiry revives the entry instead of it being purged
+func TestRegistrarSweepSkipsRevived(t *testing.T) {
+	c := newTestCache(t)
+	ctx := context.Background()
+
+	registerTestDaemon(t, c, "alice", "192.0.2.1")
+	if err := c.Disconnect(ctx, "alice", net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	rrow, _ := c.registrar.Load("alice")
+	if _, _, err := c.registrar.Sweep(ctx, db, rrow.ExpiresAtUtc, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	registerTestDaemon(t, c, "alice", "192.0.2.1")
+	expired, purged, err := c.registrar.Sweep(ctx, db, rrow.ExpiresAtUtc+int64(time.Hour/time.Second), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 || len(purged) != 0 {
+		t.Fatalf("swept %v and %v, want the revived entry left alone", skidsOf(expired), skidsOf(purged))
+	}
+	if rrow, ok := c.registrar.Load("alice"); !ok || !rrow.Online || rrow.Expired {
+		t.Fatalf("revived entry is %+v, want online", rrow)
+	}
+}
+
+func skidsOf(rrows []RegistrarRow) (skids []string) {
+	for _, rrow := range rrows {
+		skids = append(skids, rrow.Skid)
+	}
+	return skids
+}
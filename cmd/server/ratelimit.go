@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Sustained rate and burst size of a TokenBucket
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (r Rate) Enabled() bool {
+	return r.PerSecond > 0 && r.Burst > 0
+}
+
+// Holds up to Burst tokens, refilled at PerSecond; every allowed event takes one
+type TokenBucket struct {
+	rate Rate
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Starts full
+func NewTokenBucket(rate Rate) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: float64(rate.Burst), last: time.Now()}
+}
+
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(float64(b.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var ErrTooManyConns = errors.New("too many connections")
+
+// Caps on concurrent sessions; zero leaves one uncapped
+type ConnLimits struct {
+	Max     int
+	PerIP   int
+	PerSkid int
+}
+
+// Counts live connections, overall and per client IP, and live sessions per
+// SKID. Connections are counted from accept, before their TLS handshake, so
+// that a flood is refused before it costs any; the SKID is only known after.
+type ConnLimiter struct {
+	limits ConnLimits
+
+	mu     sync.Mutex
+	total  int
+	byIP   map[string]int
+	bySkid map[string]int
+}
+
+func NewConnLimiter(limits ConnLimits) *ConnLimiter {
+	return &ConnLimiter{
+		limits: limits,
+		byIP:   make(map[string]int),
+		bySkid: make(map[string]int),
+	}
+}
+
+// For transport.ListenConfig.Admit: takes a slot for the peer of `conn`,
+// handed back by `release` once the connection closes
+func (l *ConnLimiter) Admit(conn net.Conn) (release func(), err error) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err = l.AcquireIP(ip); err != nil {
+		return nil, err
+	}
+	return func() { l.ReleaseIP(ip) }, nil
+}
+
+// Takes a connection slot for `ip`, to be handed back with ReleaseIP, or
+// reports which cap it would exceed
+func (l *ConnLimiter) AcquireIP(ip string) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.limits.Max > 0 && l.total >= l.limits.Max:
+		return fmt.Errorf("[ERROR] Server is at its cap of %d connections: %w", l.limits.Max, ErrTooManyConns)
+	case l.limits.PerIP > 0 && l.byIP[ip] >= l.limits.PerIP:
+		return fmt.Errorf("[ERROR] %s is at its cap of %d connections: %w", ip, l.limits.PerIP, ErrTooManyConns)
+	}
+	l.total++
+	l.byIP[ip]++
+	return nil
+}
+
+func (l *ConnLimiter) ReleaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// Takes a session slot for `skid`, to be handed back with ReleaseSkid
+func (l *ConnLimiter) AcquireSkid(skid string) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.PerSkid > 0 && l.bySkid[skid] >= l.limits.PerSkid {
+		return fmt.Errorf("[ERROR] %s is at its cap of %d connections: %w", skid, l.limits.PerSkid, ErrTooManyConns)
+	}
+	l.bySkid[skid]++
+	return nil
+}
+
+func (l *ConnLimiter) ReleaseSkid(skid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.bySkid[skid]--; l.bySkid[skid] <= 0 {
+		delete(l.bySkid, skid)
+	}
+}
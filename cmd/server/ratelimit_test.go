@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		rate Rate
+		// Allowed out of 10 events in a row, too fast for any refill
+		want int
+	}{
+		{"burst of one", Rate{PerSecond: 0.001, Burst: 1}, 1},
+		{"burst of five", Rate{PerSecond: 0.001, Burst: 5}, 5},
+		{"burst above the events", Rate{PerSecond: 0.001, Burst: 20}, 10},
+	}
+	for _, tt := range tests {
+		b := NewTokenBucket(tt.rate)
+		allowed := 0
+		for range 10 {
+			if b.Allow() {
+				allowed++
+			}
+		}
+		if allowed != tt.want {
+			t.Errorf("%s: allowed %d, want %d", tt.name, allowed, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	b := NewTokenBucket(Rate{PerSecond: 1, Burst: 1})
+	if !b.Allow() || b.Allow() {
+		t.Fatal("want exactly the burst allowed")
+	}
+	// Two seconds' worth of tokens, capped at the burst
+	b.mu.Lock()
+	b.last = b.last.Add(-2 * time.Second)
+	b.mu.Unlock()
+	if !b.Allow() {
+		t.Error("not allowed after refilling")
+	}
+	if b.Allow() {
+		t.Error("refilled past the burst")
+	}
+}
+
+func TestConnLimiterIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ConnLimits
+		// Acquired in order; each wants an error or not
+		ips     []string
+		wantErr []bool
+	}{
+		{"uncapped", ConnLimits{}, []string{"a", "a", "b"}, []bool{false, false, false}},
+		{"overall", ConnLimits{Max: 2}, []string{"a", "b", "c"}, []bool{false, false, true}},
+		{"per IP", ConnLimits{PerIP: 1}, []string{"a", "b", "a"}, []bool{false, false, true}},
+		{"per SKID is not checked", ConnLimits{PerSkid: 1}, []string{"a", "a"}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		l := NewConnLimiter(tt.limits)
+		for i, ip := range tt.ips {
+			err := l.AcquireIP(ip)
+			if (err != nil) != tt.wantErr[i] {
+				t.Errorf("%s: AcquireIP %d = %v, wantErr %v", tt.name, i, err, tt.wantErr[i])
+			}
+			if err != nil && !errors.Is(err, ErrTooManyConns) {
+				t.Errorf("%s: AcquireIP %d = %v, want ErrTooManyConns", tt.name, i, err)
+			}
+		}
+	}
+}
+
+func TestConnLimiterRelease(t *testing.T) {
+	l := NewConnLimiter(ConnLimits{Max: 1, PerSkid: 1})
+	if err := l.AcquireIP("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AcquireIP("b"); err == nil {
+		t.Fatal("AcquireIP over the overall cap succeeded")
+	}
+	l.ReleaseIP("a")
+	if err := l.AcquireIP("b"); err != nil {
+		t.Errorf("AcquireIP after ReleaseIP = %v", err)
+	}
+
+	if err := l.AcquireSkid("skid"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AcquireSkid("skid"); !errors.Is(err, ErrTooManyConns) {
+		t.Fatalf("AcquireSkid over the cap = %v, want ErrTooManyConns", err)
+	}
+	if err := l.AcquireSkid("other"); err != nil {
+		t.Errorf("AcquireSkid of another SKID = %v", err)
+	}
+	l.ReleaseSkid("skid")
+	if err := l.AcquireSkid("skid"); err != nil {
+		t.Errorf("AcquireSkid after ReleaseSkid = %v", err)
+	}
+}
+
+// A net.Conn that only knows its peer's address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestConnLimiterAdmit(t *testing.T) {
+	l := NewConnLimiter(ConnLimits{PerIP: 1})
+	conn := addrConn{remote: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4000}}
+	other := addrConn{remote: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4001}}
+
+	release, err := l.Admit(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same IP, another port
+	if _, err = l.Admit(other); !errors.Is(err, ErrTooManyConns) {
+		t.Fatalf("Admit over the per-IP cap = %v, want ErrTooManyConns", err)
+	}
+	release()
+	if _, err = l.Admit(other); err != nil {
+		t.Errorf("Admit after release = %v", err)
+	}
+}
+
+// Rate limits apply before the session's state is checked, so a client
+// flooding out-of-order messages is throttled too
+func TestServerRouterMiddlewareOrder(t *testing.T) {
+	r := NewServerRouter(NewMetrics())
+	messenger := &recordingMessenger{}
+	s := NewSession(testClient("skid", "127.0.0.1"), messenger, time.Minute, Rate{PerSecond: 0.001, Burst: 1})
+
+	// Still handshaking, so nothing is allowed
+	want := []msgs.ErrorCode{msgs.ErrC_InvalidState, msgs.ErrC_RateLimited, msgs.ErrC_RateLimited}
+	for i, code := range want {
+		if err := r.Dispatch(s, testRequest(t, msgs.T_String, "hi")); err != nil {
+			t.Fatal(err)
+		}
+		sent := messenger.Sent()
+		if len(sent) != i+1 {
+			t.Fatalf("sent %d messages after %d requests", len(sent), i+1)
+		}
+		if got := errCode(t, sent[i]); got != code {
+			t.Errorf("request %d answered with %s, want %s", i, got, code)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// Handles one message on a session. A non-nil error ends the connection;
+// refusals the client should hear about are replied with replyError instead.
+type HandlerFunc func(s *Session, recvMsg msgs.Message) error
+
+// Wraps the handler of `route`, or the next Middleware
+type Middleware func(route *Route, next HandlerFunc) HandlerFunc
+
+// A handler and what a session needs to reach it
+type Route struct {
+	Type    msgs.MessageType
+	Handler HandlerFunc
+
+	// Role the session must have; Role_Unknown lets any session through
+	Role SessionRole
+	// If set, the client must hold this grant from every SKID the message
+	// targets, as listed by Targets
+	Auth    *AuthType
+	Targets func(recvMsg msgs.Message) (skids []string, err error)
+	// Per session; the zero Rate is unlimited
+	Rate Rate
+}
+
+// Dispatches messages to the Route registered for their MessageType. Use and
+// Handle set it up before serving; Dispatch may then run on any goroutine.
+type Router struct {
+	routes     map[msgs.MessageType]*Route
+	middleware []Middleware
+	// Each route's handler wrapped in the middleware, built by Use and Handle
+	handlers map[msgs.MessageType]HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes:   make(map[msgs.MessageType]*Route),
+		handlers: make(map[msgs.MessageType]HandlerFunc),
+	}
+}
+
+// Middleware runs in the order given, the first one outermost
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+	for _, route := range r.routes {
+		r.handlers[route.Type] = r.chain(route)
+	}
+}
+
+// Panics if `route.Type` already has a route, like http.ServeMux
+func (r *Router) Handle(route Route) {
+	if _, ok := r.routes[route.Type]; ok {
+		panic(fmt.Sprintf("route for %s registered twice", route.Type))
+	}
+	r.routes[route.Type] = &route
+	r.handlers[route.Type] = r.chain(&route)
+}
+
+// Wraps the handler of `route` in every middleware
+func (r *Router) chain(route *Route) HandlerFunc {
+	handler := route.Handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](route, handler)
+	}
+	return handler
+}
+
+func (r *Router) Dispatch(s *Session, recvMsg msgs.Message) (err error) {
+	handler, ok := r.handlers[recvMsg.Type]
+	if !ok {
+		return fmt.Errorf("[ERROR] Unimplemented message type:\n\t- %s\n", recvMsg.Type)
+	}
+	return handler(s, recvMsg)
+}
+
+// Lists the SKIDs of a payload that names them, for Route.Targets
+func targetsOf[T interface{ TargetSkids() []string }](recvMsg msgs.Message) (skids []string, err error) {
+	var req T
+	if err = msgs.Unmarshal(recvMsg, &req); err != nil {
+		return nil, err
+	}
+	return req.TargetSkids(), nil
+}
+
+///////////////////////////////
+// Middleware
+///////////////////////////////
+
+func LogMiddleware(route *Route, next HandlerFunc) HandlerFunc {
+	return func(s *Session, recvMsg msgs.Message) (err error) {
+		log.Printf("Received from %+v: %s\n", s.Client, recvMsg.Type)
+		start := time.Now()
+		err = next(s, recvMsg)
+		log.Printf("\t- Handled %s in %s\n", recvMsg.Type, time.Since(start).Round(time.Microsecond))
+		return err
+	}
+}
+
+// Refuses messages the session's state or role does not allow
+func StateMiddleware(route *Route, next HandlerFunc) HandlerFunc {
+	return func(s *Session, recvMsg msgs.Message) (err error) {
+		err = s.Check(recvMsg.Type)
+		if err == nil && route.Role != Role_Unknown && s.Role != route.Role {
+			err = &StateError{State: s.State, Role: s.Role, Type: recvMsg.Type, Reason: fmt.Sprintf("requires role %s", route.Role)}
+		}
+		if err != nil {
+			log.Println("[ERROR]", err)
+			return replyError(s.Messenger, recvMsg, msgs.ErrC_InvalidState, err)
+		}
+
+		if err = next(s, recvMsg); err != nil {
+			return err
+		}
+		s.Handled(recvMsg.Type)
+		return nil
+	}
+}
+
+// Applies the session's overall rate, then the route's own
+func RateLimitMiddleware(route *Route, next HandlerFunc) HandlerFunc {
+	return func(s *Session, recvMsg msgs.Message) (err error) {
+		switch {
+		case s.rate != nil && !s.rate.Allow():
+			err = fmt.Errorf("[ERROR] %s exceeded %g messages per second: %w", s.Client.Id, s.rate.rate.PerSecond, ErrRateLimited)
+		case route.Rate.Enabled() && !s.bucket(route.Type, route.Rate).Allow():
+			err = fmt.Errorf("[ERROR] %s exceeded %g %s per second: %w", s.Client.Id, route.Rate.PerSecond, recvMsg.Type, ErrRateLimited)
+		default:
+			return next(s, recvMsg)
+		}
+		log.Println(err)
+		return replyError(s.Messenger, recvMsg, msgs.ErrC_RateLimited, err)
+	}
+}
+
+// Checks Route.Auth against every SKID the message targets. Payloads that
+// fail to parse are left for the handler to refuse.
+func AuthorizeMiddleware(route *Route, next HandlerFunc) HandlerFunc {
+	if route.Auth == nil || route.Targets == nil {
+		return next
+	}
+	return func(s *Session, recvMsg msgs.Message) (err error) {
+		skids, err := route.Targets(recvMsg)
+		if err != nil {
+			return next(s, recvMsg)
+		}
+		for _, skid := range skids {
+			grant := AuthGrantsRow{Owner: skid, Other: s.Client.Id, Type: *route.Auth}
+			if skid == s.Client.Id || cache.authGrants.Has(grant) {
+				continue
+			}
+			err = fmt.Errorf("[ERROR] %s was not granted %s by %s: %w", s.Client.Id, *route.Auth, skid, ErrNotAuthorized)
+			log.Println(err)
+			return replyError(s.Messenger, recvMsg, msgs.ErrC_NotAuthorized, err)
+		}
+		return next(s, recvMsg)
+	}
+}
+
+///////////////////////////////
+// Metrics
+///////////////////////////////
+
+type MessageStats struct {
+	Count int
+	// Handled with an error that ended the connection
+	Errors int
+	Total  time.Duration
+}
+
+// Counts of handled messages per MessageType, across all sessions
+type Metrics struct {
+	mu     sync.Mutex
+	byType map[msgs.MessageType]MessageStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{byType: make(map[msgs.MessageType]MessageStats)}
+}
+
+func (m *Metrics) Middleware(route *Route, next HandlerFunc) HandlerFunc {
+	return func(s *Session, recvMsg msgs.Message) (err error) {
+		start := time.Now()
+		err = next(s, recvMsg)
+		elapsed := time.Since(start)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		stats := m.byType[route.Type]
+		stats.Count++
+		stats.Total += elapsed
+		if err != nil {
+			stats.Errors++
+		}
+		m.byType[route.Type] = stats
+		return err
+	}
+}
+
+func (m *Metrics) Snapshot() map[msgs.MessageType]MessageStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := make(map[msgs.MessageType]MessageStats, len(m.byType))
+	for msgT, stats := range m.byType {
+		snapshot[msgT] = stats
+	}
+	return snapshot
+}
+
+func (m *Metrics) Log() {
+	snapshot := m.Snapshot()
+	types := make([]msgs.MessageType, 0, len(snapshot))
+	for msgT := range snapshot {
+		types = append(types, msgT)
+	}
+	slices.Sort(types)
+
+	for _, msgT := range types {
+		stats := snapshot[msgT]
+		avg := stats.Total / time.Duration(stats.Count)
+		log.Printf("[METRICS] %s: %d handled, %d errors, avg %s\n", msgT, stats.Count, stats.Errors, avg.Round(time.Microsecond))
+	}
+}
+
+// Logs the metrics every `interval` until ctx is cancelled
+func RunMetricsLogger(ctx context.Context, m *Metrics, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Log()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// A middleware that appends `name` to `calls` when run, and counts how
+// often it wrapped a handler in `built`
+func tracingMiddleware(name string, calls *[]string, built *int) Middleware {
+	return func(route *Route, next HandlerFunc) HandlerFunc {
+		*built++
+		return func(s *Session, recvMsg msgs.Message) error {
+			*calls = append(*calls, name)
+			return next(s, recvMsg)
+		}
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// Use is called before Handle when set, after otherwise
+		useFirst bool
+	}{
+		{"middleware first", true},
+		{"routes first", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			built := 0
+			r := NewRouter()
+			use := func() {
+				r.Use(tracingMiddleware("outer", &calls, &built), tracingMiddleware("inner", &calls, &built))
+			}
+			handler := func(s *Session, recvMsg msgs.Message) error {
+				calls = append(calls, "handler")
+				return nil
+			}
+
+			if tt.useFirst {
+				use()
+			}
+			r.Handle(Route{Type: msgs.T_Ping, Handler: handler})
+			r.Handle(Route{Type: msgs.T_ClientWhoAmI, Handler: handler})
+			if !tt.useFirst {
+				use()
+			}
+
+			for range 3 {
+				if err := r.Dispatch(nil, msgs.Message{Type: msgs.T_Ping}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var want []string
+			for range 3 {
+				want = append(want, "outer", "inner", "handler")
+			}
+			if !slices.Equal(calls, want) {
+				t.Errorf("calls = %v, want %v", calls, want)
+			}
+			// Two middleware around two routes, wrapped once each
+			if built != 4 {
+				t.Errorf("middleware wrapped %d handlers, want 4", built)
+			}
+		})
+	}
+}
+
+func TestRouterDispatchUnknownType(t *testing.T) {
+	r := NewRouter()
+	r.Handle(Route{Type: msgs.T_Ping, Handler: func(s *Session, recvMsg msgs.Message) error { return nil }})
+	if err := r.Dispatch(nil, msgs.Message{Type: msgs.T_Hello}); err == nil {
+		t.Error("Dispatch of a type without a route succeeded")
+	}
+}
+
+func TestRouterHandleTwicePanics(t *testing.T) {
+	r := NewRouter()
+	handler := func(s *Session, recvMsg msgs.Message) error { return nil }
+	r.Handle(Route{Type: msgs.T_Ping, Handler: handler})
+	defer func() {
+		if recover() == nil {
+			t.Error("second Handle of the same type did not panic")
+		}
+	}()
+	r.Handle(Route{Type: msgs.T_Ping, Handler: handler})
+}
@@ -3,35 +3,79 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"reflect"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/transport"
 	"github.com/mattn/go-sqlite3"
 )
 
 var (
 	parsedTlsHandshakeTimeoutSeconds uint
 	parsedPingTimeoutSeconds         uint
+	parsedFraming                    string
+	parsedMaxFrameBytes              int
+	parsedMaxPayloadBytes            int
+	parsedConfigPath                 string
+	parsedListen                     listenFlag
+	parsedCert                       string
+	parsedKey                        string
+	parsedClientCAs                  stringsFlag
+	parsedDatabase                   string
+	parsedRegistrarTTLSeconds        uint
+	parsedMaxRegistrarTTLSeconds     uint
+	parsedPurgeAfterSeconds          uint
+	parsedSweepIntervalSeconds       uint
+	parsedMetricsIntervalSeconds     uint
+	parsedShutdownTimeoutSeconds     uint
+	parsedReconnectAfterSeconds      uint
+	parsedMaxConns                   int
+	parsedMaxConnsPerIP              int
+	parsedMaxConnsPerSkid            int
+	parsedMaxPendingHandshakes       int
+	parsedSessionRate                float64
+	parsedSessionBurst               int
 
 	tlsHandshakeTimeout time.Duration
 	pingTimeout         time.Duration
+	config              ServerConfig
+	ttlPolicy           TTLPolicy
+	sweepInterval       time.Duration
+	metricsInterval     time.Duration
+	shutdownTimeout     time.Duration
+	reconnectAfter      time.Duration
+	sessionRate         Rate
 )
 
+// How long a shutdown notice may take to write before the client is given up on
+const shutdownWriteTimeout = time.Second
+
 var (
-	rootCtx   context.Context
-	db        *sql.DB
-	dbTimeout time.Duration
-	registrar *sync.Map
-	daemons   *sync.Map
+	rootCtx       context.Context
+	db            *sql.DB
+	dbTimeout     time.Duration
+	cache         *IPCache
+	daemons       *sync.Map
+	subscriptions *Subscriptions
+	metrics       *Metrics
+	router        *Router
+	sessions      *SessionSet
+	connLimiter   *ConnLimiter
+
+	// Orders updates of `daemons` with the registrar writes they go with
+	daemonsMu sync.Mutex
 )
 
 func init() {
@@ -39,8 +83,34 @@ func init() {
 
 	flag.UintVar(&parsedTlsHandshakeTimeoutSeconds, "tls-handshake-timeout-seconds", 5, "max time to complete TLS handshake before server kills connection")
 	flag.UintVar(&parsedPingTimeoutSeconds, "ping-timeout-seconds", 60*10, "max time between pings to server for daemons, before server kills connection")
+	flag.StringVar(&parsedFraming, "framing", "gob", "wire framing of listeners that don't set their own; one of <gob | binary | json | cbor>, gob is the default for older clients")
+	flag.IntVar(&parsedMaxFrameBytes, "max-frame-bytes", msgs.DefaultLimits.MaxFrameSize, "max size of a single message on the wire, for listeners that don't set their own; larger messages get an Err and the connection is closed")
+	flag.IntVar(&parsedMaxPayloadBytes, "max-payload-bytes", msgs.DefaultLimits.MaxPayloadSize, "max size of a single message payload, for listeners that don't set their own; must leave room for a 32 byte header within --max-frame-bytes")
+	flag.StringVar(&parsedConfigPath, "config", "", "path to a TOML config file; flags given explicitly override its values")
+	flag.Var(&parsedListen, "listen", "host:port to listen on, optionally followed by settings of its own, e.g. [::1]:4430,framing=binary,max-frame-bytes=65536,max-payload-bytes=65504,max-pending-handshakes=32; may be repeated; IPv6 hosts in brackets (default "+DefaultServerConfig.Listen[0].Addr+")")
+	flag.StringVar(&parsedCert, "cert", DefaultServerConfig.Cert, "path to the PEM-encoded server certificate")
+	flag.StringVar(&parsedKey, "key", DefaultServerConfig.Key, "path to the PEM-encoded private key of --cert")
+	flag.Var(&parsedClientCAs, "client-ca", "path to a PEM bundle of CAs trusted to sign client certificates, may be repeated (default "+DefaultServerConfig.ClientCAs[0]+")")
+	flag.StringVar(&parsedDatabase, "db", DefaultServerConfig.Database, "sqlite3 data source name")
+	flag.UintVar(&parsedRegistrarTTLSeconds, "registrar-ttl-seconds", 7*24*60*60, "how long an entry is kept after its daemon was last seen, unless the daemon asks for another TTL")
+	flag.UintVar(&parsedMaxRegistrarTTLSeconds, "max-registrar-ttl-seconds", 30*24*60*60, "upper bound on the TTL a daemon may ask for")
+	flag.UintVar(&parsedPurgeAfterSeconds, "purge-after-seconds", 7*24*60*60, "how long an expired entry is kept, marked expired, before it is deleted")
+	flag.UintVar(&parsedSweepIntervalSeconds, "sweep-interval-seconds", 60, "how often to look for expired entries")
+	flag.UintVar(&parsedShutdownTimeoutSeconds, "shutdown-timeout-seconds", 10, "on SIGINT or SIGTERM, how long to wait for connections to finish before closing them")
+	flag.UintVar(&parsedReconnectAfterSeconds, "shutdown-reconnect-after-seconds", 5, "how long clients are told to wait before reconnecting after a shutdown")
+	flag.IntVar(&parsedMaxConns, "max-conns", 1024, "max connections open at once; 0 for no cap")
+	flag.IntVar(&parsedMaxConnsPerIP, "max-conns-per-ip", 64, "max connections open at once from one IP; 0 for no cap")
+	flag.IntVar(&parsedMaxConnsPerSkid, "max-conns-per-skid", 8, "max connections open at once with one client certificate; 0 for no cap")
+	flag.IntVar(&parsedMaxPendingHandshakes, "max-pending-handshakes", transport.DefaultMaxPendingHandshakes, "max TLS handshakes in progress at once, per listener, for listeners that don't set their own")
+	flag.Float64Var(&parsedSessionRate, "session-rate", 20, "messages per second a connection may sustain, on top of per-message-type limits; 0 for no limit")
+	flag.IntVar(&parsedSessionBurst, "session-burst", 40, "messages a connection may send at once before --session-rate applies")
+	flag.UintVar(&parsedMetricsIntervalSeconds, "metrics-interval-seconds", 5*60, "how often to log per-message-type counts and latencies; 0 disables")
 
 	daemons = &sync.Map{}
+	subscriptions = NewSubscriptions()
+	metrics = NewMetrics()
+	router = NewServerRouter(metrics)
+	sessions = NewSessionSet()
 }
 
 func main() {
@@ -50,21 +120,126 @@ func main() {
 	flag.Parse()
 	log.Println("[DEBUG] --tls-handshake-timeout-seconds", parsedTlsHandshakeTimeoutSeconds)
 	log.Println("[DEBUG] --ping-timeout-seconds", parsedPingTimeoutSeconds)
+	log.Println("[DEBUG] --framing", parsedFraming)
+	log.Println("[DEBUG] --max-frame-bytes", parsedMaxFrameBytes)
+	log.Println("[DEBUG] --max-payload-bytes", parsedMaxPayloadBytes)
+	log.Println("[DEBUG] --config", parsedConfigPath)
+	log.Println("[DEBUG] --registrar-ttl-seconds", parsedRegistrarTTLSeconds)
+	log.Println("[DEBUG] --max-registrar-ttl-seconds", parsedMaxRegistrarTTLSeconds)
+	log.Println("[DEBUG] --purge-after-seconds", parsedPurgeAfterSeconds)
+	log.Println("[DEBUG] --sweep-interval-seconds", parsedSweepIntervalSeconds)
+	log.Println("[DEBUG] --metrics-interval-seconds", parsedMetricsIntervalSeconds)
+	log.Println("[DEBUG] --shutdown-timeout-seconds", parsedShutdownTimeoutSeconds)
+	log.Println("[DEBUG] --shutdown-reconnect-after-seconds", parsedReconnectAfterSeconds)
+	log.Println("[DEBUG] --max-conns", parsedMaxConns)
+	log.Println("[DEBUG] --max-conns-per-ip", parsedMaxConnsPerIP)
+	log.Println("[DEBUG] --max-conns-per-skid", parsedMaxConnsPerSkid)
+	log.Println("[DEBUG] --max-pending-handshakes", parsedMaxPendingHandshakes)
+	log.Println("[DEBUG] --session-rate", parsedSessionRate)
+	log.Println("[DEBUG] --session-burst", parsedSessionBurst)
 
 	pingTimeout = time.Second * time.Duration(parsedPingTimeoutSeconds)
 	tlsHandshakeTimeout = time.Second * time.Duration(parsedTlsHandshakeTimeoutSeconds)
 
+	var err error
+	ttlPolicy = TTLPolicy{
+		Default:    time.Second * time.Duration(parsedRegistrarTTLSeconds),
+		Max:        time.Second * time.Duration(parsedMaxRegistrarTTLSeconds),
+		PurgeAfter: time.Second * time.Duration(parsedPurgeAfterSeconds),
+	}
+	if err = ttlPolicy.Validate(); err != nil {
+		log.Println("[FATAL]", err)
+		return
+	}
+	sweepInterval = time.Second * time.Duration(parsedSweepIntervalSeconds)
+	metricsInterval = time.Second * time.Duration(parsedMetricsIntervalSeconds)
+	shutdownTimeout = time.Second * time.Duration(parsedShutdownTimeoutSeconds)
+	reconnectAfter = time.Second * time.Duration(parsedReconnectAfterSeconds)
+	if parsedMaxConns < 0 || parsedMaxConnsPerIP < 0 || parsedMaxConnsPerSkid < 0 {
+		log.Println("[FATAL] --max-conns, --max-conns-per-ip and --max-conns-per-skid must not be negative")
+		return
+	}
+	connLimiter = NewConnLimiter(ConnLimits{
+		Max:     parsedMaxConns,
+		PerIP:   parsedMaxConnsPerIP,
+		PerSkid: parsedMaxConnsPerSkid,
+	})
+	sessionRate = Rate{PerSecond: parsedSessionRate, Burst: parsedSessionBurst}
+	if parsedSessionRate > 0 && parsedSessionBurst < 1 {
+		log.Println("[FATAL] --session-burst must be at least 1 when --session-rate is set")
+		return
+	}
+	if sweepInterval <= 0 {
+		log.Println("[FATAL] --sweep-interval-seconds must be positive")
+		return
+	}
+
+	// Precedence: explicit flags > config file > defaults
+	config = DefaultServerConfig
+	if parsedConfigPath != "" {
+		if err = LoadConfigFile(parsedConfigPath, &config); err != nil {
+			log.Println("[FATAL]", err)
+			return
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = parsedListen
+		case "cert":
+			config.Cert = parsedCert
+		case "key":
+			config.Key = parsedKey
+		case "client-ca":
+			config.ClientCAs = parsedClientCAs
+		case "db":
+			config.Database = parsedDatabase
+		}
+	})
+	listenerDefaults := ListenerConfig{
+		Framing:              parsedFraming,
+		MaxFrameBytes:        parsedMaxFrameBytes,
+		MaxPayloadBytes:      parsedMaxPayloadBytes,
+		MaxPendingHandshakes: parsedMaxPendingHandshakes,
+	}
+	listen := make([]ListenerConfig, len(config.Listen))
+	for i, lc := range config.Listen {
+		listen[i] = lc.WithDefaults(listenerDefaults)
+	}
+	config.Listen = listen
+	log.Printf("[DEBUG] config: %+v\n", config)
+
+	if err = config.Validate(); err != nil {
+		log.Println("[FATAL] Invalid config\n\t-", strings.ReplaceAll(err.Error(), "\n", "\n\t- "))
+		return
+	}
+
+	///////////////////////////////
+	// Read in certificates, CA bundles
+	///////////////////////////////
+	tlsConfig, err := config.TlsConfig()
+	if err != nil {
+		log.Println("[FATAL]", err)
+		return
+	}
+
 	///////////////////////////////
 	// Establish connection to SQLite3 DB
 	///////////////////////////////
 	sql3V, _, _ := sqlite3.Version()
 	log.Printf("[DEBUG] sqlite3 version: %v\n", sql3V)
 
-	var err error
-	rootCtx = context.Background()
-	db, err = sql.Open("sqlite3", "file:ipcache.db")
+	// Cancelled on SIGINT or SIGTERM. rootCtx outlives it until connections
+	// are drained, so that their last database writes still go through.
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var cancelRoot context.CancelFunc
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+	defer cancelRoot()
+
+	db, err = sql.Open("sqlite3", config.Database)
 	if err != nil {
-		log.Println(err)
+		log.Println("[FATAL] Failed to open database", config.Database, "\n\t-", err)
 		return
 	}
 	defer db.Close()
@@ -73,230 +248,665 @@ func main() {
 	pingCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
 	defer cancel()
 	if err = db.PingContext(pingCtx); err != nil {
-		log.Println(err)
+		log.Println("[FATAL] Failed to connect to database", config.Database, "\n\t-", err)
 		return
 	}
 
 	initCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
 	defer cancel()
-	if err = initDb(initCtx, db); err != nil {
-		log.Println(err)
-		return
-	}
-
-	registrarCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
-	defer cancel()
-	registrar, err = getRegistrar(registrarCtx, db)
+	cache, err = NewIPCache(initCtx, db, dbTimeout, ttlPolicy)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	go RunSweeper(rootCtx, cache, sweepInterval)
+	if metricsInterval > 0 {
+		go RunMetricsLogger(rootCtx, metrics, metricsInterval)
+	}
 
 	///////////////////////////////
-	// Read in certificates, CA bundles
-	// Referencing https://smallstep.com/hello-mtls/doc/combined/go/go
-	// Referencing https://gist.github.com/denji/12b3a568f092ab951456
+	// Start server
 	///////////////////////////////
-	caCert, _ := os.ReadFile("certs/self.pem")
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	cert, err := tls.LoadX509KeyPair("./certs/self.pem", "./certs/self.key")
-	if err != nil {
-		panic(err)
+	listeners := make([]listener, 0, len(config.Listen))
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for _, lc := range config.Listen {
+		// Checked by config.Validate
+		framing, _ := msgs.ParseFraming(lc.Framing)
+
+		ln, err := transport.Listen(transport.ListenConfig{
+			Addr:             lc.Addr,
+			TLS:              tlsConfig,
+			HandshakeTimeout: tlsHandshakeTimeout,
+
+			MaxPendingHandshakes: lc.MaxPendingHandshakes,
+			// The overall and per-IP caps, before the handshake
+			Admit: connLimiter.Admit,
+		})
+		if err != nil {
+			log.Println("[FATAL] Failed to listen on", lc.Addr, "\n\t-", err)
+			return
+		}
+		log.Printf("[INFO] Listening on %s with %s framing\n", ln.Addr(), framing)
+		listeners = append(listeners, listener{Listener: ln, framing: framing, limits: lc.Limits()})
 	}
 
-	// BUG: Will need to synchronize for concurrent r/w
-	// mutex: sync.RWLock
-	// atomic CAS: atomics
-	// sync.Map
-	config := &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{cert},
-		ClientCAs:    caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+	wg := sync.WaitGroup{}
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln listener) {
+			defer wg.Done()
+			acceptLoop(ln)
+		}(ln)
 	}
+
 	///////////////////////////////
-	// Start server
+	// Shut down: stop accepting, tell clients, drain, then close the DB
 	///////////////////////////////
-	ln, err := tls.Listen("tcp", "127.0.0.1:4430", config)
-	if err != nil {
-		panic(err)
+	<-shutdownCtx.Done()
+	// Restores the default signal handling, so that a second Ctrl-C kills
+	// the process instead of waiting on the drain
+	stop()
+	log.Println("[INFO] Shutting down, no longer accepting connections")
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	wg.Wait()
+
+	sessions.Shutdown(msgs.ShutdownNotice{Reason: "server is shutting down", ReconnectAfter: reconnectAfter})
+	if !sessions.Wait(shutdownTimeout) {
+		log.Printf("[ERROR] Connections still open after %s, closing them\n", shutdownTimeout)
+		cancelRoot()
+		if !sessions.Wait(shutdownWriteTimeout) {
+			log.Println("[ERROR] Gave up waiting on connections")
+		}
 	}
-	defer ln.Close()
+	cancelRoot()
+	log.Println("[INFO] All connections closed, closing the database")
+}
 
+// A transport.Listener, and how the sessions accepted on it talk
+type listener struct {
+	*transport.Listener
+	framing msgs.Framing
+	limits  msgs.Limits
+}
+
+func acceptLoop(ln listener) {
 	for {
-		netconn, err := ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("[ERROR] Failed to accept connection\n\t-", err)
-			continue
-		}
-
-		conn, ok := netconn.(*tls.Conn)
-		if !ok {
-			log.Println("[ERROR] Connection established but failed tls.Conn type assert.")
-			netconn.Close()
-			continue
+			return
 		}
-		log.Println("[INFO] New tls.Conn established with", conn.RemoteAddr(), ", still need to do TLS handshake")
+		log.Println("[INFO] TLS handshake succeeded with", conn.RemoteAddr())
 
-		go TlsServe(conn)
+		sessions.Go(func() { TlsServe(conn, ln.framing, ln.limits) })
 	}
 }
 
-func TlsServe(conn *tls.Conn) {
+func TlsServe(conn *tls.Conn, framing msgs.Framing, limits msgs.Limits) {
 	defer conn.Close()
 
 	var (
 		err     error
 		client  msgs.Client
 		recvMsg msgs.Message
-		//isDaemon   = false
-		//isFirstMsg = true
 	)
 
-	// TLS timeout
-	err = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
-	if err != nil {
-		log.Println("[ERROR] Failed to set a timeout for TLS handshake, rejecting conn.\n\t-", err)
-		return
-	}
-	// NOTE: The TLS handshake is normally performed lazily, but do eagerly to fail fast
-	if err = conn.Handshake(); err != nil {
-		log.Println("[ERROR] Failed TLS handshake for", conn.RemoteAddr(), ".\n\t- Reason:", err)
+	// NOTE: transport.Listener has already completed the TLS handshake
+	if client, err = msgs.NewClient(conn); err != nil {
+		log.Println(err)
 		return
 	}
-	// Unset TLS timeout
-	if err = conn.SetDeadline(time.Time{}); err != nil {
-		log.Println("[ERROR] Failed to unset timeout for TLS handshake.\n\t-", err)
+
+	// TODO: Need some kind of session identifier next???
+	// Side-effect from VerifyConnection to tell us client's SubjectKeyId/pubkey/session?
+	// func GetConnPubkey(conn *tls.Conn) { ... }
+
+	server := msgs.NewAsyncMessengerWithFraming(rootCtx, conn, framing)
+	defer server.Close()
+	if err = server.SetLimits(limits); err != nil {
+		log.Println(err)
 		return
 	}
-	log.Println("[INFO] TLS handshake succeeded!")
 
-	if client, err = msgs.NewClient(conn); err != nil {
+	// transport.Listener has checked the overall and per-IP caps already
+	if err = connLimiter.AcquireSkid(client.Id); err != nil {
 		log.Println(err)
+		refuseSession(server, msgs.ErrC_TooManyConnections, err)
 		return
 	}
+	defer connLimiter.ReleaseSkid(client.Id)
 
-	// TODO: Need some kind of session identifier next???
-	// Side-effect from VerifyConnection to tell us client's SubjectKeyId/pubkey/session?
-	// func GetConnPubkey(conn *tls.Conn) { ... }
+	session := NewSession(client, server, pingTimeout, sessionRate)
+	defer session.Close()
 
-	server := msgs.NewMessenger(conn)
+	version, err := msgs.AcceptHandshake(server, tlsHandshakeTimeout)
+	if err != nil {
+		log.Println("[ERROR] Failed version handshake for", conn.RemoteAddr(), ".\n\t- Reason:", err)
+		return
+	}
+	session.Negotiated(version)
+	if !sessions.Add(session) {
+		log.Println("[INFO] Shutting down, closing new connection from", conn.RemoteAddr())
+		return
+	}
+	defer sessions.Remove(session)
+	log.Printf("[INFO] Negotiated protocol version %s with %+v\n", version, client)
 
 	for {
 		recvMsg, err = server.Receive()
-		switch err {
-		case nil:
+		switch {
+		case err == nil:
 			break
-		case io.EOF:
+		case errors.Is(err, io.EOF):
 			log.Println("Connection closed")
 			return
+		case errors.Is(err, msgs.ErrMessageTooLarge):
+			// The rest of the oversized message is still on the wire, so the stream can't be recovered
+			log.Println(err)
+			if err = replyError(server, recvMsg, msgs.ErrC_MessageTooLarge, err); err != nil {
+				log.Println(err)
+			}
+			return
+		case errors.Is(err, msgs.ErrUnsupportedVersion):
+			log.Println(err)
+			if err = replyError(server, recvMsg, msgs.ErrC_UnsupportedVersion, err); err != nil {
+				log.Println(err)
+				return
+			}
+			continue
 		default:
 			log.Println(err)
 			return
 		}
-		log.Printf("Received from %+v: %s\n", client, recvMsg.Type)
-
-		err = nil
-		switch recvMsg.Type {
-		case msgs.T_String:
-			log.Printf("\t- Payload: %s\n", recvMsg.Payload)
-		case msgs.T_DaemonRegister:
-			err = DaemonRegisterHandler(server, pingTimeout, client, recvMsg)
-			defer deleteDaemon(client, err)
-		case msgs.T_Ping:
-			err = PingHandler(server, pingTimeout)
+		if err = router.Dispatch(session, recvMsg); err != nil {
+			log.Println(err)
+			return
+		}
+		if session.Draining() {
+			log.Println("[INFO] Shutting down, closing connection from", conn.RemoteAddr())
+			return
+		}
+	}
+}
 
-		default:
-			err = fmt.Errorf("[ERROR] Unimplemented message type:\n\t- %s\n", recvMsg.Type)
+// Per-session rates, generous enough for interactive use
+var (
+	queryRate = Rate{PerSecond: 10, Burst: 20}
+	writeRate = Rate{PerSecond: 1, Burst: 5}
+)
+
+// Every message the server handles, with what a session needs to send it
+func NewServerRouter(metrics *Metrics) *Router {
+	getIP := AuthT_GetIP
+
+	r := NewRouter()
+	r.Use(LogMiddleware, metrics.Middleware, RateLimitMiddleware, StateMiddleware, AuthorizeMiddleware)
+
+	r.Handle(Route{
+		Type: msgs.T_String,
+		Rate: queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) (err error) {
+			var text string
+			if err = msgs.Unmarshal(recvMsg, &text); err == nil {
+				log.Printf("\t- Payload: %s\n", text)
+			}
+			return err
+		},
+	})
+	r.Handle(Route{
+		Type: msgs.T_DaemonRegister,
+		Rate: writeRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return DaemonRegisterHandler(s, recvMsg)
+		},
+	})
+	r.Handle(Route{
+		Type: msgs.T_Ping,
+		Role: Role_Daemon,
+		Rate: writeRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return PingHandler(s.Messenger, s.PingTimeout, s.Client, recvMsg)
+		},
+	})
+	r.Handle(Route{
+		Type:    msgs.T_ClientGetIPs,
+		Auth:    &getIP,
+		Targets: targetsOf[msgs.GetIPsRequest],
+		Rate:    queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return ClientGetIPsHandler(s.Messenger, s.Client, recvMsg)
+		},
+	})
+	for _, msgT := range []msgs.MessageType{msgs.T_ClientGrantAuthorization, msgs.T_ClientRevokeAuthorization} {
+		r.Handle(Route{
+			Type: msgT,
+			Rate: writeRate,
+			Handler: func(s *Session, recvMsg msgs.Message) error {
+				return ClientAuthorizationHandler(s.Messenger, s.Client, recvMsg)
+			},
+		})
+	}
+	r.Handle(Route{
+		Type:    msgs.T_ClientSubscribe,
+		Auth:    &getIP,
+		Targets: targetsOf[msgs.SubscribeRequest],
+		Rate:    queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return ClientSubscribeHandler(s.Messenger, s.sub, recvMsg)
+		},
+	})
+	r.Handle(Route{
+		Type: msgs.T_ClientUnsubscribe,
+		Rate: queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return ClientSubscribeHandler(s.Messenger, s.sub, recvMsg)
+		},
+	})
+	r.Handle(Route{
+		Type: msgs.T_ClientWhoAmI,
+		Rate: queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return ClientWhoAmIHandler(s.Messenger, s.Client, recvMsg)
+		},
+	})
+	r.Handle(Route{
+		Type:    msgs.T_ClientGetServices,
+		Auth:    &getIP,
+		Targets: targetsOf[msgs.GetServicesRequest],
+		Rate:    queryRate,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return ClientGetServicesHandler(s.Messenger, s.Client, recvMsg)
+		},
+	})
+	// Sent again after the handshake, so only there to be refused by StateMiddleware
+	r.Handle(Route{
+		Type: msgs.T_Hello,
+		Handler: func(s *Session, recvMsg msgs.Message) error {
+			return nil
+		},
+	})
+	return r
+}
+
+// Needs the whole session, since it may take over from an earlier one
+func DaemonRegisterHandler(
+	session *Session,
+	recvMsg msgs.Message,
+) (err error) {
+	server, pingTimeout, client := session.Messenger, session.PingTimeout, session.Client
+
+	// An empty payload asks for the defaults
+	var req msgs.RegisterRequest
+	if err = msgs.Unmarshal(recvMsg, &req); err != nil {
+		log.Println(err)
+		sendErr := replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+		return errors.Join(err, sendErr)
+	}
+	ttl := ttlPolicy.Resolve(req.TTL)
+	addrs, err := registrarAddrs(client.IP, req.Addrs)
+	if err != nil {
+		log.Println(err)
+		sendErr := replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+		return errors.Join(err, sendErr)
+	}
+	services, err := registrarServices(req.Services)
+	if err != nil {
+		log.Println(err)
+		sendErr := replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+		return errors.Join(err, sendErr)
+	}
+
+	// The newest registration of a SKID is the one deleteDaemon acts on. One
+	// from the same IP is most likely the daemon reconnecting before the
+	// server noticed its old connection died, so it takes over and the old
+	// session is closed. A registration the registrar refuses leaves the
+	// previous session in place.
+	registrarCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
+	defer cancel()
+	daemonsMu.Lock()
+	changed, err := cache.Register(registrarCtx, client.Id, client.IP, ttl, addrs, services)
+	var old *Session
+	if err == nil {
+		if val, ok := daemons.Swap(client.Id, session); ok {
+			if old, ok = val.(*Session); !ok {
+				log.Printf("[ERROR] Expected value with type `*Session` to be stored in `daemons`\n\t- Got %v: %+v\n", reflect.TypeOf(val), val)
+			}
 		}
+	}
+	daemonsMu.Unlock()
+	if errors.Is(err, ErrStaleRegistration) {
+		log.Println(err)
+		sendErr := replyError(server, recvMsg, msgs.ErrC_Conflict, err)
+		return errors.Join(err, sendErr)
+	}
+	if err != nil {
+		return err
+	}
 
+	if old != nil && old != session && old.Client.IP.Equal(client.IP) {
+		log.Printf("[INFO] %s registered again from %s, closing its previous session\n", client.Id, client.IP)
+		old.Evict()
+	}
+	// The session only becomes Registered, and so only gets deleteDaemon on
+	// Close, if the rest succeeds
+	defer func() {
 		if err != nil {
-			log.Println(err)
-			return
+			deleteDaemon(session)
 		}
+	}()
+	if changed {
+		if rrow, ok := cache.registrar.Load(client.Id); ok {
+			subscriptions.Notify(rrow)
+		}
+	}
 
+	log.Printf("\t- Successfully stored entry in daemons: %+v\n", client.IP)
+	log.Printf("\t- Registered addresses: %v\n", addrs)
+	log.Printf("\t- Registered services: %v\n", services)
+	log.Printf("\t- Responding with ping timeout of %v, TTL of %v ...\n", pingTimeout, ttl)
+
+	timeoutMsg, err := msgs.Marshal(msgs.T_ServerRegistered, msgs.RegisterResponse{
+		PingTimeout: pingTimeout,
+		ServerTime:  time.Now().UTC().Unix(),
+		TTL:         ttl,
+	})
+	if err != nil {
+		return err
+	}
+	if err = server.Reply(recvMsg, timeoutMsg); err != nil {
+		return err
 	}
+	log.Printf("\t- Sent response. Resetting SetReadTimeout(%v).\n\n", pingTimeout)
+
+	err = server.SetReadTimeout(pingTimeout)
+	if err != nil {
+		return err
+	}
+
+	return
 }
 
-func DaemonRegisterHandler(
+// Answers every Ping with a Pong echoing its timestamp, so the daemon can
+// tell the server is alive and measure the round trip
+func PingHandler(
 	server msgs.Messenger,
 	pingTimeout time.Duration,
 	client msgs.Client,
 	recvMsg msgs.Message,
 ) (err error) {
-	// Handles duplicate ID and IP registration
-	var ipstr string
-	if val, ok := daemons.Load(client.Id); ok {
-		// Type-check `any` value
-		ipstr, ok = val.(string)
-		if !ok {
-			log.Printf("[ERROR] Expected value with type `string` to be stored in `daemons`\n\t- Got %v: %+v\n", reflect.TypeOf(ipstr), ipstr)
-		}
+	// An empty payload is an unstamped Ping, still answered
+	var ping msgs.PingPayload
+	if err = msgs.Unmarshal(recvMsg, &ping); err != nil {
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	}
 
-		// Found duplicate: terminate connection
-		if ipstr == client.IP.String() {
-			err = fmt.Errorf("[ERROR] Rejecting new registration for same client ID and IP\n\t- Client: %+v\n", client)
+	// Session.Check only lets registered daemons through
+	pingCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
+	defer cancel()
+	if err = cache.Ping(pingCtx, client.Id, client.IP); err != nil {
+		return err
+	}
+
+	log.Printf("\t- Resetting SetReadTimeout(%v).\n\n", pingTimeout)
+	if err = server.SetReadTimeout(pingTimeout); err != nil {
+		return err
+	}
+
+	pongMsg, err := msgs.Marshal(msgs.T_Pong, msgs.PongPayload{
+		PingSentUnixNano: ping.SentUnixNano,
+		ServerUnixNano:   time.Now().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	return server.Reply(recvMsg, pongMsg)
+}
+
+func ClientGetIPsHandler(
+	server msgs.Messenger,
+	client msgs.Client,
+	recvMsg msgs.Message,
+) (err error) {
+	var req msgs.GetIPsRequest
+	if err = msgs.Unmarshal(recvMsg, &req); err != nil {
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	}
 
-			errMsg := msgs.Err()
-			errMsg.Payload = []byte(err.Error())
-			sendErr := server.Send(errMsg)
-			if sendErr != nil {
-				err = fmt.Errorf("[ERROR] Failed to send errMsg to client: %w\n\t- %w\n", err, sendErr)
+	var rrows []RegistrarRow
+	if len(req.Skids) == 0 {
+		rrows, err = cache.GetIPs(client.Id)
+	} else {
+		for _, skid := range req.Skids {
+			var rrow RegistrarRow
+			if rrow, err = cache.GetIP(client.Id, skid); err != nil {
+				break
 			}
-			return err
+			rrows = append(rrows, rrow)
 		}
-	} else {
-		// Not duplicated
-		ipstr = client.IP.String()
-		daemons.Store(client.Id, ipstr)
 	}
 
-	registrarCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
-	defer cancel()
-	err = insertRegistrar(registrarCtx, db, client, recvMsg.UnixTimestampUtc)
+	// Lookup failures are reported to the client, but don't kill the connection
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, ErrNotAuthorized):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_NotAuthorized, err)
+	case errors.Is(err, ErrNotRegistered):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_NotFound, err)
+	default:
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_Internal, errors.New("failed to look up IPs"))
+	}
+
+	entries := make([]msgs.IPEntry, 0, len(rrows))
+	for _, rrow := range rrows {
+		entries = append(entries, rrow.Entry())
+	}
+
+	log.Printf("\t- Responding with %d IPs\n", len(entries))
+	ipsMsg, err := msgs.Marshal(msgs.T_ServerIPs, msgs.GetIPsResponse{Entries: entries})
 	if err != nil {
 		return err
 	}
-	registrar.Store(client.Id, client.IP)
+	return server.Reply(recvMsg, ipsMsg)
+}
 
-	log.Printf("\t- Successfully stored entry in daemons: %+v\n", ipstr)
-	log.Printf("\t- Responding with ping timeout as String(%v) ...\n", pingTimeout)
+// Same authorization as ClientGetIPs: a client sees the services of a daemon
+// only if it may get that daemon's IP
+func ClientGetServicesHandler(
+	server msgs.Messenger,
+	client msgs.Client,
+	recvMsg msgs.Message,
+) (err error) {
+	var req msgs.GetServicesRequest
+	if err = msgs.Unmarshal(recvMsg, &req); err != nil {
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	}
+
+	entries, err := cache.GetServices(client.Id, req.Skids, req.Name)
+
+	// Lookup failures are reported to the client, but don't kill the connection
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, ErrNotAuthorized):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_NotAuthorized, err)
+	case errors.Is(err, ErrNotRegistered):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_NotFound, err)
+	default:
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_Internal, errors.New("failed to look up services"))
+	}
 
-	timeoutMsg := msgs.String(pingTimeout.String())
-	if err = server.Send(timeoutMsg); err != nil {
+	log.Printf("\t- Responding with the services of %d daemons\n", len(entries))
+	servicesMsg, err := msgs.Marshal(msgs.T_ServerServices, msgs.GetServicesResponse{Entries: entries})
+	if err != nil {
 		return err
 	}
-	log.Printf("\t- Sent response. Resetting SetReadTimeout(%v).\n\n", pingTimeout)
+	return server.Reply(recvMsg, servicesMsg)
+}
 
-	err = server.SetReadTimeout(pingTimeout)
+// Reflects back how the server sees the client, to debug NAT and certificates
+func ClientWhoAmIHandler(
+	server msgs.Messenger,
+	client msgs.Client,
+	recvMsg msgs.Message,
+) (err error) {
+	resp := msgs.WhoAmIResponse{
+		Skid:    client.Id,
+		IP:      client.IP,
+		Port:    client.Port,
+		Subject: client.Subject,
+	}
+	whoamiMsg, err := msgs.Marshal(msgs.T_ServerWhoAmI, resp)
 	if err != nil {
 		return err
 	}
+	return server.Reply(recvMsg, whoamiMsg)
+}
 
-	return
+func ClientAuthorizationHandler(
+	server msgs.Messenger,
+	client msgs.Client,
+	recvMsg msgs.Message,
+) (err error) {
+	var grant msgs.GrantRequest
+	if err = msgs.Unmarshal(recvMsg, &grant); err != nil {
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	}
+
+	entry := AuthGrantsRow{Owner: client.Id, Other: grant.Other, Type: grant.Type}
+	log.Printf("\t- %s %+v\n", recvMsg.Type, entry)
+
+	authCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
+	defer cancel()
+	if recvMsg.Type == msgs.T_ClientGrantAuthorization {
+		err = cache.GrantAuth(authCtx, entry.Owner, entry.Other, entry.Type)
+	} else {
+		err = cache.RevokeAuth(authCtx, entry)
+	}
+
+	// Rejected grants are reported to the client, but don't kill the connection
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, ErrInvalidGrant):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	case errors.Is(err, ErrNotGranted):
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_NotFound, err)
+	default:
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_Internal, errors.New("failed to persist the authorization change"))
+	}
+
+	okMsg, err := msgs.OkMessage(fmt.Sprintf("%s %s for %s", recvMsg.Type, grant.Type, grant.Other))
+	if err != nil {
+		return err
+	}
+	return server.Reply(recvMsg, okMsg)
 }
 
-func PingHandler(server msgs.Messenger, pingTimeout time.Duration) (err error) {
-	log.Printf("\t- Resetting SetReadTimeout(%v).\n\n", pingTimeout)
-	err = server.SetReadTimeout(pingTimeout)
-	return err
+func ClientSubscribeHandler(
+	server msgs.Messenger,
+	sub *subscriber,
+	recvMsg msgs.Message,
+) (err error) {
+	var req msgs.SubscribeRequest
+	if err = msgs.Unmarshal(recvMsg, &req); err != nil {
+		log.Println(err)
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, err)
+	}
+	if len(req.Skids) == 0 {
+		return replyError(server, recvMsg, msgs.ErrC_BadRequest, errors.New("no SKIDs given"))
+	}
+
+	if recvMsg.Type == msgs.T_ClientUnsubscribe {
+		subscriptions.Remove(sub, req.Skids)
+	} else {
+		// Checked again on every push, in case the grant is revoked later
+		for _, skid := range req.Skids {
+			if !cache.CanGetIP(sub.client.Id, skid) {
+				err = fmt.Errorf("[ERROR] %s may not get the IP of %s: %w", sub.client.Id, skid, ErrNotAuthorized)
+				log.Println(err)
+				return replyError(server, recvMsg, msgs.ErrC_NotAuthorized, err)
+			}
+		}
+		subscriptions.Add(sub, req.Skids)
+	}
+
+	log.Printf("\t- %s %v\n", recvMsg.Type, req.Skids)
+	okMsg, err := msgs.OkMessage(fmt.Sprintf("%s for %d SKIDs", recvMsg.Type, len(req.Skids)))
+	if err != nil {
+		return err
+	}
+	return server.Reply(recvMsg, okMsg)
+}
+
+// Tells a client refused before the version handshake why, without waiting
+// on it. msgs.Handshake reads the Err in place of the HelloAck.
+func refuseSession(server msgs.Messenger, code msgs.ErrorCode, reason error) {
+	if err := server.SetWriteTimeout(tlsHandshakeTimeout); err != nil {
+		log.Println(err)
+		return
+	}
+	errMsg, err := msgs.ErrorMessage(code, reason.Error())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Nothing was negotiated, so send a frame every client can read
+	errMsg.Version = msgs.Version_1_0_0
+	if err = server.Send(errMsg); err != nil {
+		log.Println(err)
+	}
+}
+
+func replyError(
+	server msgs.Messenger,
+	recvMsg msgs.Message,
+	code msgs.ErrorCode,
+	reason error,
+) (err error) {
+	errMsg, err := msgs.ErrorMessage(code, reason.Error())
+	if err != nil {
+		return err
+	}
+	return server.Reply(recvMsg, errMsg)
 }
 
-func deleteDaemon(daemon msgs.Client, registerErr error) {
-	if registerErr != nil {
+// Marks the daemon of `s` offline, unless a newer session of the same SKID
+// has registered since
+func deleteDaemon(s *Session) {
+	daemon := s.Client
+	daemonsMu.Lock()
+	defer daemonsMu.Unlock()
+	if !daemons.CompareAndDelete(daemon.Id, s) {
+		log.Printf("[INFO] %s has registered again since, leaving it online\n", daemon.Id)
 		return
 	}
+	log.Printf(
+		"[INFO] Successfully deleted key-value pair from daemons\n\t- key: %v\n\t- value: %v\n\n",
+		daemon.Id,
+		daemon.IP)
 
-	ipstr := daemon.IP.String()
-	deleted := daemons.CompareAndDelete(daemon.Id, ipstr)
-	if deleted {
-		log.Printf(
-			"[INFO] Successfully deleted key-value pair from daemons\n\t- key: %v\n\t- value: %v\n\n",
-			daemon.Id,
-			ipstr)
-	} else {
-		log.Printf("[INFO] Delete failed, could not find key `%s`\n\b", daemon.Id)
+	offlineCtx, cancel := context.WithTimeout(rootCtx, dbTimeout)
+	defer cancel()
+	if err := cache.Disconnect(offlineCtx, daemon.Id, daemon.IP); err != nil {
+		log.Println("[ERROR] Failed to mark daemon offline\n\t-", err)
 	}
 }
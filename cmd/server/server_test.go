@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// Points the server's globals at a fresh database in a temp dir
+func newTestCache(t *testing.T) *IPCache {
+	t.Helper()
+
+	testDb, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "ipcache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDb.Close() })
+
+	rootCtx = context.Background()
+	db = testDb
+	dbTimeout = 3 * time.Second
+	ttlPolicy = TTLPolicy{Default: time.Hour, Max: 24 * time.Hour, PurgeAfter: time.Hour}
+	daemons = &sync.Map{}
+	subscriptions = NewSubscriptions()
+
+	cache, err = NewIPCache(context.Background(), testDb, dbTimeout, ttlPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func registerTestDaemon(t *testing.T, c *IPCache, skid string, ip string) {
+	t.Helper()
+
+	addrs, err := registrarAddrs(net.ParseIP(ip), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Register(context.Background(), skid, net.ParseIP(ip), ttlPolicy.Default, addrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func grantTestAuth(t *testing.T, c *IPCache, owner string, other string) {
+	t.Helper()
+	if err := c.GrantAuth(context.Background(), owner, other, AuthT_GetIP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClient(skid string, ip string) msgs.Client {
+	return msgs.Client{Id: skid, IP: net.ParseIP(ip), Port: 50000, Subject: "CN=" + skid}
+}
+
+func testRequest(t *testing.T, msgT msgs.MessageType, payload any) msgs.Message {
+	t.Helper()
+	msg, err := msgs.Marshal(msgT, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.RequestId = 1
+	return msg
+}
+
+// Records what handlers send instead of writing it to a connection. Methods
+// handlers are not expected to call panic on the nil Messenger.
+type recordingMessenger struct {
+	msgs.Messenger
+
+	mu        sync.Mutex
+	sent      []msgs.Message
+	readAfter time.Duration
+	closed    bool
+}
+
+func (m *recordingMessenger) Send(msg msgs.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *recordingMessenger) Reply(req msgs.Message, resp msgs.Message) error {
+	resp.ReplyTo = req.RequestId
+	return m.Send(resp)
+}
+
+func (m *recordingMessenger) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *recordingMessenger) SetReadTimeout(timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readAfter = timeout
+	return nil
+}
+
+func (m *recordingMessenger) SetReadDeadline(deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readAfter = time.Until(deadline)
+	return nil
+}
+
+func (m *recordingMessenger) SetWriteTimeout(timeout time.Duration) error {
+	return nil
+}
+
+func (m *recordingMessenger) Sent() []msgs.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sent)
+}
+
+// The only message sent so far
+func (m *recordingMessenger) reply(t *testing.T) msgs.Message {
+	t.Helper()
+	sent := m.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	return sent[0]
+}
+
+// The code of `msg`, or a failed test if it is not an Err
+func errCode(t *testing.T, msg msgs.Message) msgs.ErrorCode {
+	t.Helper()
+	if msg.Type != msgs.T_Err {
+		t.Fatalf("got %s, want Err", msg.Type)
+	}
+	var reason msgs.ErrorPayload
+	if err := msgs.Unmarshal(msg, &reason); err != nil {
+		t.Fatal(err)
+	}
+	return reason.Code
+}
+
+func TestClientGetIPsHandler(t *testing.T) {
+	c := newTestCache(t)
+	registerTestDaemon(t, c, "alice", "192.0.2.1")
+	registerTestDaemon(t, c, "bob", "192.0.2.2")
+	grantTestAuth(t, c, "alice", "carol")
+
+	tests := []struct {
+		name      string
+		self      string
+		skids     []string
+		wantSkids []string
+		wantErr   msgs.ErrorCode
+	}{
+		{name: "every granted entry", self: "carol", wantSkids: []string{"alice"}},
+		{name: "granted SKID", self: "carol", skids: []string{"alice"}, wantSkids: []string{"alice"}},
+		{name: "own entry", self: "bob", skids: []string{"bob"}, wantSkids: []string{"bob"}},
+		{name: "no grants", self: "dave", wantSkids: []string{}},
+		{name: "SKID not granted", self: "carol", skids: []string{"bob"}, wantErr: msgs.ErrC_NotAuthorized},
+		{name: "one of two not granted", self: "carol", skids: []string{"alice", "bob"}, wantErr: msgs.ErrC_NotAuthorized},
+		{name: "own entry not registered", self: "carol", skids: []string{"carol"}, wantErr: msgs.ErrC_NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &recordingMessenger{}
+			req, err := msgs.Marshal(msgs.T_ClientGetIPs, msgs.GetIPsRequest{Skids: tt.skids})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ClientGetIPsHandler(m, testClient(tt.self, "198.51.100.1"), req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := m.reply(t)
+			if tt.wantErr != msgs.ErrC_Unknown {
+				if code := errCode(t, reply); code != tt.wantErr {
+					t.Fatalf("Err code = %s, want %s", code, tt.wantErr)
+				}
+				return
+			}
+
+			var resp msgs.GetIPsResponse
+			if err = msgs.Unmarshal(reply, &resp); err != nil {
+				t.Fatal(err)
+			}
+			skids := []string{}
+			for _, entry := range resp.Entries {
+				skids = append(skids, entry.Skid)
+			}
+			slices.Sort(skids)
+			if !slices.Equal(skids, tt.wantSkids) {
+				t.Fatalf("got entries of %v, want %v", skids, tt.wantSkids)
+			}
+		})
+	}
+}
+
+// A session of `skid` from `ip` that has sent DaemonRegister
+func registerTestSession(t *testing.T, skid string, ip string) (*Session, *recordingMessenger) {
+	t.Helper()
+
+	messenger := &recordingMessenger{}
+	s := NewSession(testClient(skid, ip), messenger, time.Minute, Rate{})
+	s.Negotiated(msgs.Version_1_1_0)
+	if err := DaemonRegisterHandler(s, testRequest(t, msgs.T_DaemonRegister, msgs.RegisterRequest{})); err != nil {
+		t.Fatal(err)
+	}
+	if reply := messenger.reply(t); reply.Type != msgs.T_ServerRegistered {
+		t.Fatalf("DaemonRegister answered with %s, want ServerRegistered", reply.Type)
+	}
+	s.Handled(msgs.T_DaemonRegister)
+	return s, messenger
+}
+
+func (m *recordingMessenger) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func TestDaemonRegisterTakesOver(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstIP   string
+		secondIP  string
+		wantEvict bool
+	}{
+		{"same IP", "192.0.2.1", "192.0.2.1", true},
+		{"other IP", "192.0.2.1", "192.0.2.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+
+			first, firstMessenger := registerTestSession(t, "alice", tt.firstIP)
+			second, _ := registerTestSession(t, "alice", tt.secondIP)
+			if firstMessenger.isClosed() != tt.wantEvict {
+				t.Fatalf("first session closed = %v, want %v", firstMessenger.isClosed(), tt.wantEvict)
+			}
+
+			// The first session ending must leave the second one online
+			first.Close()
+			if rrow, ok := c.registrar.Load("alice"); !ok || !rrow.Online || !rrow.IP.Equal(net.ParseIP(tt.secondIP)) {
+				t.Fatalf("after the first session closed, registrar has %+v, want %s online", rrow, tt.secondIP)
+			}
+
+			second.Close()
+			if rrow, _ := c.registrar.Load("alice"); rrow.Online {
+				t.Fatal("daemon still online after its last session closed")
+			}
+			if _, ok := daemons.Load("alice"); ok {
+				t.Fatal("daemons still holds a closed session")
+			}
+		})
+	}
+}
+
+// A registration the registrar refuses must leave the previous session,
+// whatever its IP, as the one daemons and the registrar know
+func TestDaemonRegisterFailureKeepsPrevious(t *testing.T) {
+	tests := []struct {
+		name     string
+		secondIP string
+	}{
+		{"same IP", "192.0.2.1"},
+		{"other IP", "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			first, firstMessenger := registerTestSession(t, "alice", "192.0.2.1")
+
+			// As if the server's clock had stepped back since
+			rrow, _ := c.registrar.Load("alice")
+			rrow.UnixTsUtc += 3600
+			if _, err := c.registrar.Store(context.Background(), c.db, rrow); err != nil {
+				t.Fatal(err)
+			}
+
+			messenger := &recordingMessenger{}
+			second := NewSession(testClient("alice", tt.secondIP), messenger, time.Minute, Rate{})
+			second.Negotiated(msgs.Version_1_1_0)
+			if err := DaemonRegisterHandler(second, testRequest(t, msgs.T_DaemonRegister, msgs.RegisterRequest{})); err == nil {
+				t.Fatal("DaemonRegisterHandler succeeded")
+			}
+			second.Close()
+
+			if firstMessenger.isClosed() {
+				t.Error("first session was evicted by a failed registration")
+			}
+			if val, _ := daemons.Load("alice"); val != first {
+				t.Errorf("daemons holds %v, want the first session", val)
+			}
+			if rrow, _ := c.registrar.Load("alice"); !rrow.Online || !rrow.IP.Equal(net.ParseIP("192.0.2.1")) {
+				t.Errorf("registrar has %+v, want the first session online", rrow)
+			}
+		})
+	}
+}
+
+// The client CLI queries with the same certificate, and often from the same
+// host, as the clientd next to it, and must not knock it offline
+func TestQueryClientSharingDaemonSkid(t *testing.T) {
+	type request struct {
+		msgT    msgs.MessageType
+		payload any
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"WhoAmI", []request{{msgs.T_ClientWhoAmI, nil}}},
+		{"GetIPs", []request{{msgs.T_ClientGetIPs, msgs.GetIPsRequest{}}}},
+		{"register after querying", []request{{msgs.T_ClientWhoAmI, nil}, {msgs.T_DaemonRegister, msgs.RegisterRequest{}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			r := NewServerRouter(NewMetrics())
+			daemon, daemonMessenger := registerTestSession(t, "alice", "192.0.2.1")
+
+			messenger := &recordingMessenger{}
+			query := NewSession(testClient("alice", "192.0.2.1"), messenger, time.Minute, Rate{})
+			query.Negotiated(msgs.Version_1_1_0)
+			for _, req := range tt.requests {
+				if err := r.Dispatch(query, testRequest(t, req.msgT, req.payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if query.Role != Role_Query {
+				t.Errorf("query session has role %s, want Query", query.Role)
+			}
+			query.Close()
+
+			if daemonMessenger.isClosed() {
+				t.Error("daemon session was evicted")
+			}
+			if val, _ := daemons.Load("alice"); val != daemon {
+				t.Errorf("daemons holds %v, want the daemon session", val)
+			}
+			if rrow, _ := c.registrar.Load("alice"); !rrow.Online {
+				t.Error("daemon went offline when the query session closed")
+			}
+		})
+	}
+}
+
+func TestClientWhoAmIHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		client msgs.Client
+	}{
+		{"IPv4", testClient("alice", "198.51.100.1")},
+		{"IPv6", msgs.Client{Id: "bob", IP: net.ParseIP("2001:db8::1"), Port: 4431, Subject: "CN=bob,O=example"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &recordingMessenger{}
+			req := msgs.WhoAmI()
+			req.RequestId = 7
+			if err := ClientWhoAmIHandler(m, tt.client, req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := m.reply(t)
+			if reply.Type != msgs.T_ServerWhoAmI || reply.ReplyTo != req.RequestId {
+				t.Fatalf("got %s replying to %d, want ServerWhoAmI replying to %d", reply.Type, reply.ReplyTo, req.RequestId)
+			}
+			var resp msgs.WhoAmIResponse
+			if err := msgs.Unmarshal(reply, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Skid != tt.client.Id || !resp.IP.Equal(tt.client.IP) || resp.Port != tt.client.Port || resp.Subject != tt.client.Subject {
+				t.Fatalf("got %+v, want the connection as seen by the server, %+v", resp, tt.client)
+			}
+		})
+	}
+}
+
+func TestPingHandler(t *testing.T) {
+	sent := time.Now()
+	stamped, err := msgs.PingAt(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		ping     msgs.Message
+		wantSent int64
+		wantErr  msgs.ErrorCode
+	}{
+		{name: "stamped", ping: stamped, wantSent: sent.UnixNano()},
+		{name: "unstamped", ping: msgs.Ping()},
+		{name: "bad payload", ping: msgs.Message{Type: msgs.T_Ping, Payload: []byte(`{"SentUnixNano": "soon"}`)}, wantErr: msgs.ErrC_BadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			registerTestDaemon(t, c, "alice", "192.0.2.1")
+			// Pings are recorded to the second, so pretend the last one was a minute ago
+			before, _ := c.registrar.Load("alice")
+			before.LastPingUtc -= 60
+			c.registrar.m.Store("alice", before)
+
+			m := &recordingMessenger{}
+			tt.ping.RequestId = 3
+			if err := PingHandler(m, time.Minute, testClient("alice", "192.0.2.1"), tt.ping); err != nil {
+				t.Fatal(err)
+			}
+			reply := m.reply(t)
+			if reply.ReplyTo != tt.ping.RequestId {
+				t.Errorf("ReplyTo = %d, want %d", reply.ReplyTo, tt.ping.RequestId)
+			}
+			if tt.wantErr != msgs.ErrC_Unknown {
+				if code := errCode(t, reply); code != tt.wantErr {
+					t.Fatalf("Err code = %s, want %s", code, tt.wantErr)
+				}
+				return
+			}
+
+			var pong msgs.PongPayload
+			if err := msgs.Unmarshal(reply, &pong); err != nil || reply.Type != msgs.T_Pong {
+				t.Fatalf("got %s, %v, want Pong", reply.Type, err)
+			}
+			if pong.PingSentUnixNano != tt.wantSent || pong.ServerUnixNano < sent.UnixNano() {
+				t.Errorf("Pong echoes %d at %d, want %d at or after %d", pong.PingSentUnixNano, pong.ServerUnixNano, tt.wantSent, sent.UnixNano())
+			}
+			if after, _ := c.registrar.Load("alice"); after.LastPingUtc <= before.LastPingUtc {
+				t.Errorf("last ping still %d after a Ping", after.LastPingUtc)
+			}
+			if m.readAfter != time.Minute {
+				t.Errorf("read timeout %s, want it reset to the ping timeout", m.readAfter)
+			}
+		})
+	}
+}
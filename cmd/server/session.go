@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+type SessionState int
+
+const (
+	// Waiting on Hello; handled by msgs.AcceptHandshake
+	SessionS_Handshaking SessionState = iota
+	// Version negotiated; may register as a daemon or start querying
+	SessionS_Connected
+	// Registered as a daemon; pings keep its registrar entry alive
+	SessionS_Registered
+	// Connection gone, registrar entry marked offline
+	SessionS_Closed
+)
+
+var sessionStateName = map[SessionState]string{
+	SessionS_Handshaking: "Handshaking",
+	SessionS_Connected:   "Connected",
+	SessionS_Registered:  "Registered",
+	SessionS_Closed:      "Closed",
+}
+
+func (s SessionState) String() string {
+	return sessionStateName[s]
+}
+
+type SessionRole int
+
+const (
+	// No message past the handshake yet
+	Role_Unknown SessionRole = iota
+	// Registered with DaemonRegister; may also query
+	Role_Daemon
+	// Started querying without registering, and can no longer register
+	Role_Query
+)
+
+var sessionRoleName = map[SessionRole]string{
+	Role_Unknown: "Unknown",
+	Role_Daemon:  "Daemon",
+	Role_Query:   "Query",
+}
+
+func (r SessionRole) String() string {
+	return sessionRoleName[r]
+}
+
+var ErrOutOfOrder = errors.New("message out of order")
+
+// A message the session's state does not allow, answered with InvalidState
+type StateError struct {
+	State  SessionState
+	Role   SessionRole
+	Type   msgs.MessageType
+	Reason string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s not allowed in state %s, role %s: %s", e.Type, e.State, e.Role, e.Reason)
+}
+
+func (e *StateError) Unwrap() error {
+	return ErrOutOfOrder
+}
+
+// Everything the server knows about one connection. Client and Messenger are
+// set once by NewSession, and may be used from any goroutine, e.g. by
+// SessionSet.Shutdown or a newer session taking over. The rest belongs to
+// the connection's own goroutine, except `draining`, which is guarded by `mu`.
+type Session struct {
+	Client    msgs.Client
+	Messenger msgs.Messenger
+	State     SessionState
+	Role      SessionRole
+	Version   msgs.ProtocolVersion
+
+	// Max time between two pings once registered
+	PingTimeout  time.Duration
+	ConnectedAt  time.Time
+	RegisteredAt time.Time
+	LastPingAt   time.Time
+
+	sub *subscriber
+	// Every message, whatever its type; nil if unlimited
+	rate    *TokenBucket
+	buckets map[msgs.MessageType]*TokenBucket
+
+	mu sync.Mutex
+	// Set by Drain; the session ends once the message in hand is answered
+	draining bool
+}
+
+func NewSession(client msgs.Client, messenger msgs.Messenger, pingTimeout time.Duration, rate Rate) *Session {
+	s := &Session{
+		Client:      client,
+		Messenger:   messenger,
+		State:       SessionS_Handshaking,
+		PingTimeout: pingTimeout,
+		ConnectedAt: time.Now(),
+		sub:         newSubscriber(client, messenger),
+		buckets:     make(map[msgs.MessageType]*TokenBucket),
+	}
+	if rate.Enabled() {
+		s.rate = NewTokenBucket(rate)
+	}
+	return s
+}
+
+// The rate limiter of `msgT` on this session, created on first use
+func (s *Session) bucket(msgT msgs.MessageType, rate Rate) *TokenBucket {
+	b, ok := s.buckets[msgT]
+	if !ok {
+		b = NewTokenBucket(rate)
+		s.buckets[msgT] = b
+	}
+	return b
+}
+
+func (s *Session) Negotiated(version msgs.ProtocolVersion) {
+	s.Version = version
+	s.State = SessionS_Connected
+}
+
+// Whether a message of type `msgT` may be handled right now
+func (s *Session) Check(msgT msgs.MessageType) (err error) {
+	reason := ""
+	switch {
+	case s.State == SessionS_Closed:
+		reason = "session is closed"
+	case s.State == SessionS_Handshaking:
+		reason = "expected Hello"
+	case msgT == msgs.T_Hello:
+		reason = "version was already negotiated"
+	case msgT == msgs.T_DaemonRegister && s.State == SessionS_Registered:
+		reason = "already registered on this connection"
+	case msgT == msgs.T_DaemonRegister && s.Role == Role_Query:
+		reason = "DaemonRegister must be the first message after the handshake"
+	default:
+		return nil
+	}
+	return &StateError{State: s.State, Role: s.Role, Type: msgT, Reason: reason}
+}
+
+// Moves the session along after a message of type `msgT` was handled successfully
+func (s *Session) Handled(msgT msgs.MessageType) {
+	switch {
+	case msgT == msgs.T_DaemonRegister:
+		s.State = SessionS_Registered
+		s.Role = Role_Daemon
+		s.RegisteredAt = time.Now()
+	case msgT == msgs.T_Ping:
+		s.LastPingAt = time.Now()
+	case s.Role == Role_Unknown:
+		s.Role = Role_Query
+	}
+}
+
+// Stops reading from the session, from any goroutine. A handler resetting
+// the read deadline can't undo this, since the connection's own goroutine
+// checks Draining after every message.
+func (s *Session) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	if err := s.Messenger.SetReadDeadline(time.Now()); err != nil {
+		log.Printf("[ERROR] Failed to stop reading from %+v\n\t- %v\n", s.Client, err)
+	}
+}
+
+func (s *Session) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Ends the session from another goroutine, e.g. when its daemon registered
+// again on a new connection. The session's own goroutine then calls Close.
+func (s *Session) Evict() {
+	if err := s.Messenger.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close the session of %+v\n\t- %v\n", s.Client, err)
+	}
+}
+
+// Marks the daemon offline if it had registered, and drops its
+// subscriptions. Safe to call more than once.
+func (s *Session) Close() {
+	subscriptions.RemoveAll(s.sub)
+	s.sub.stop()
+	if s.State == SessionS_Registered {
+		deleteDaemon(s)
+	}
+	s.State = SessionS_Closed
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestSessionCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		state SessionState
+		role  SessionRole
+		msgT  msgs.MessageType
+		ok    bool
+	}{
+		{"hello while handshaking", SessionS_Handshaking, Role_Unknown, msgs.T_Hello, false},
+		{"query while handshaking", SessionS_Handshaking, Role_Unknown, msgs.T_ClientGetIPs, false},
+		{"second hello", SessionS_Connected, Role_Unknown, msgs.T_Hello, false},
+		{"register first", SessionS_Connected, Role_Unknown, msgs.T_DaemonRegister, true},
+		{"query first", SessionS_Connected, Role_Unknown, msgs.T_ClientGetIPs, true},
+		{"register after querying", SessionS_Connected, Role_Query, msgs.T_DaemonRegister, false},
+		{"register twice", SessionS_Registered, Role_Daemon, msgs.T_DaemonRegister, false},
+		{"ping once registered", SessionS_Registered, Role_Daemon, msgs.T_Ping, true},
+		{"query once registered", SessionS_Registered, Role_Daemon, msgs.T_ClientGetIPs, true},
+		{"anything once closed", SessionS_Closed, Role_Daemon, msgs.T_Ping, false},
+	}
+	for _, tt := range tests {
+		s := &Session{State: tt.state, Role: tt.role}
+		err := s.Check(tt.msgT)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Check = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrOutOfOrder) {
+			t.Errorf("%s: Check = %v, want ErrOutOfOrder", tt.name, err)
+		}
+	}
+}
+
+func TestSessionHandled(t *testing.T) {
+	tests := []struct {
+		name      string
+		msgs      []msgs.MessageType
+		wantState SessionState
+		wantRole  SessionRole
+	}{
+		{"nothing yet", nil, SessionS_Connected, Role_Unknown},
+		{"register", []msgs.MessageType{msgs.T_DaemonRegister}, SessionS_Registered, Role_Daemon},
+		{"register then query", []msgs.MessageType{msgs.T_DaemonRegister, msgs.T_ClientGetIPs}, SessionS_Registered, Role_Daemon},
+		{"query", []msgs.MessageType{msgs.T_ClientGetIPs}, SessionS_Connected, Role_Query},
+	}
+	for _, tt := range tests {
+		s := NewSession(testClient("skid", "127.0.0.1"), &recordingMessenger{}, time.Minute, Rate{})
+		if s.State != SessionS_Handshaking {
+			t.Fatalf("new session in state %s", s.State)
+		}
+		s.Negotiated(msgs.Version_1_1_0)
+		for _, msgT := range tt.msgs {
+			s.Handled(msgT)
+		}
+		if s.State != tt.wantState || s.Role != tt.wantRole {
+			t.Errorf("%s: state %s, role %s, want %s, %s", tt.name, s.State, s.Role, tt.wantState, tt.wantRole)
+		}
+		if s.Version != msgs.Version_1_1_0 {
+			t.Errorf("%s: version %v, want %v", tt.name, s.Version, msgs.Version_1_1_0)
+		}
+	}
+}
+
+func TestSessionDrain(t *testing.T) {
+	messenger := &recordingMessenger{readAfter: time.Minute}
+	s := NewSession(testClient("skid", "127.0.0.1"), messenger, time.Minute, Rate{})
+	if s.Draining() {
+		t.Fatal("new session is draining")
+	}
+
+	s.Drain()
+	if !s.Draining() {
+		t.Fatal("Draining() = false after Drain")
+	}
+	messenger.mu.Lock()
+	readAfter := messenger.readAfter
+	messenger.mu.Unlock()
+	if readAfter > 0 {
+		t.Errorf("read deadline %s away after Drain, want passed", readAfter)
+	}
+
+	// A handler resetting the read timeout does not undo Drain
+	messenger.SetReadTimeout(time.Minute)
+	if !s.Draining() {
+		t.Error("Draining() = false after the read timeout was reset")
+	}
+}
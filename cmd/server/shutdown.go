@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// Every live connection, so that shutdown can tell them and wait for them
+type SessionSet struct {
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[*Session]struct{}
+	closed   bool
+}
+
+func NewSessionSet() *SessionSet {
+	return &SessionSet{sessions: make(map[*Session]struct{})}
+}
+
+// Runs `serve` on its own goroutine, counted by Wait
+func (ss *SessionSet) Go(serve func()) {
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done()
+		serve()
+	}()
+}
+
+// Reports false once shutdown began, in which case the session should end
+func (ss *SessionSet) Add(s *Session) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.closed {
+		return false
+	}
+	ss.sessions[s] = struct{}{}
+	return true
+}
+
+func (ss *SessionSet) Remove(s *Session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sessions, s)
+}
+
+// Sends `notice` to every session and stops reading from them, so each one
+// ends once the message it is handling, if any, is answered. Later sessions
+// are refused by Add.
+func (ss *SessionSet) Shutdown(notice msgs.ShutdownNotice) {
+	ss.mu.Lock()
+	ss.closed = true
+	sessions := make([]*Session, 0, len(ss.sessions))
+	for s := range ss.sessions {
+		sessions = append(sessions, s)
+	}
+	ss.mu.Unlock()
+
+	noticeMsg, err := msgs.Marshal(msgs.T_ServerShutdown, notice)
+	if err != nil {
+		log.Println("[ERROR] Failed to build the shutdown notice\n\t-", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err == nil {
+				// A client that stopped reading must not hold up the others
+				s.Messenger.SetWriteTimeout(shutdownWriteTimeout)
+				if sendErr := s.Messenger.Send(noticeMsg); sendErr != nil {
+					log.Printf("[ERROR] Failed to send the shutdown notice to %+v\n\t- %v\n", s.Client, sendErr)
+				}
+			}
+			s.Drain()
+		}()
+	}
+	wg.Wait()
+	log.Printf("[INFO] Sent the shutdown notice to %d sessions\n", len(sessions))
+}
+
+// Reports whether every session ended within `timeout`
+func (ss *SessionSet) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		ss.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
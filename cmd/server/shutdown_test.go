@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+func TestSessionSetShutdown(t *testing.T) {
+	ss := NewSessionSet()
+	messengers := []*recordingMessenger{{readAfter: time.Minute}, {readAfter: time.Minute}}
+	sessions := make([]*Session, len(messengers))
+	for i, messenger := range messengers {
+		sessions[i] = NewSession(testClient("skid", "127.0.0.1"), messenger, time.Minute, Rate{})
+		if !ss.Add(sessions[i]) {
+			t.Fatalf("Add of session %d refused before Shutdown", i)
+		}
+	}
+	// Ended before shutdown, so it hears nothing
+	gone := &recordingMessenger{}
+	goneSession := NewSession(testClient("gone", "127.0.0.1"), gone, time.Minute, Rate{})
+	ss.Add(goneSession)
+	ss.Remove(goneSession)
+
+	notice := msgs.ShutdownNotice{Reason: "test", ReconnectAfter: time.Second}
+	ss.Shutdown(notice)
+
+	for i, messenger := range messengers {
+		sent := messenger.Sent()
+		if len(sent) != 1 || sent[0].Type != msgs.T_ServerShutdown {
+			t.Fatalf("session %d was sent %v, want one ServerShutdown", i, sent)
+		}
+		var got msgs.ShutdownNotice
+		if err := msgs.Unmarshal(sent[0], &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != notice {
+			t.Errorf("session %d got notice %+v, want %+v", i, got, notice)
+		}
+		if !sessions[i].Draining() {
+			t.Errorf("session %d is not draining", i)
+		}
+		messenger.mu.Lock()
+		readAfter := messenger.readAfter
+		messenger.mu.Unlock()
+		if readAfter > 0 {
+			t.Errorf("session %d may still read for %s", i, readAfter)
+		}
+	}
+	if sent := gone.Sent(); len(sent) != 0 {
+		t.Errorf("removed session was sent %v", sent)
+	}
+
+	late := NewSession(testClient("late", "127.0.0.1"), &recordingMessenger{}, time.Minute, Rate{})
+	if ss.Add(late) {
+		t.Error("Add after Shutdown = true, want false")
+	}
+}
+
+func TestSessionSetWait(t *testing.T) {
+	tests := []struct {
+		name string
+		// How long the one session takes to end
+		serve time.Duration
+		want  bool
+	}{
+		{"ends in time", 0, true},
+		{"outlives the timeout", time.Second, false},
+	}
+	for _, tt := range tests {
+		ss := NewSessionSet()
+		ss.Go(func() { time.Sleep(tt.serve) })
+		if got := ss.Wait(100 * time.Millisecond); got != tt.want {
+			t.Errorf("%s: Wait = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// Notifications that may wait on one subscriber. One that falls further
+// behind has stopped reading, and is disconnected.
+const SubscriberQueueSize = 32
+
+// A connection that wants to hear about IP changes. Notifications are queued
+// and written by a goroutine of its own, started on the first subscription.
+type subscriber struct {
+	client    msgs.Client
+	messenger msgs.Messenger
+
+	queue     chan msgs.Message
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newSubscriber(client msgs.Client, messenger msgs.Messenger) *subscriber {
+	return &subscriber{
+		client:    client,
+		messenger: messenger,
+		queue:     make(chan msgs.Message, SubscriberQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (sub *subscriber) start() {
+	sub.startOnce.Do(func() { go sub.writeLoop() })
+}
+
+// Ends the writer; queued notifications are dropped. Safe to call more than once.
+func (sub *subscriber) stop() {
+	sub.stopOnce.Do(func() { close(sub.done) })
+}
+
+func (sub *subscriber) writeLoop() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case notification := <-sub.queue:
+			if err := sub.messenger.Send(notification); err != nil {
+				log.Printf("[ERROR] Failed to notify %s\n\t- %v\n", sub.client.Id, err)
+				return
+			}
+		}
+	}
+}
+
+// Reports false if the queue is full
+func (sub *subscriber) push(notification msgs.Message) bool {
+	select {
+	case <-sub.done:
+		return true
+	case sub.queue <- notification:
+		return true
+	default:
+		return false
+	}
+}
+
+type Subscriptions struct {
+	mu     sync.Mutex
+	bySkid map[string]map[*subscriber]struct{}
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{bySkid: make(map[string]map[*subscriber]struct{})}
+}
+
+func (s *Subscriptions) Add(sub *subscriber, skids []string) {
+	sub.start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, skid := range skids {
+		subs, ok := s.bySkid[skid]
+		if !ok {
+			subs = make(map[*subscriber]struct{})
+			s.bySkid[skid] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+}
+
+func (s *Subscriptions) Remove(sub *subscriber, skids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, skid := range skids {
+		s.removeLocked(sub, skid)
+	}
+}
+
+func (s *Subscriptions) RemoveAll(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for skid := range s.bySkid {
+		s.removeLocked(sub, skid)
+	}
+}
+
+func (s *Subscriptions) removeLocked(sub *subscriber, skid string) {
+	subs, ok := s.bySkid[skid]
+	if !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(s.bySkid, skid)
+	}
+}
+
+func (s *Subscriptions) Subscribers(skid string) (subs []*subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.bySkid[skid] {
+		subs = append(subs, sub)
+	}
+	return
+}
+
+// Pushes the new entry of `rrow.Skid` to every subscriber still allowed to get it.
+// Grants are checked now rather than at subscribe time, since they may have been revoked since.
+func (s *Subscriptions) Notify(rrow RegistrarRow) {
+	notification, err := msgs.Marshal(msgs.T_ServerIPChanged, msgs.IPChangedNotification{
+		Entry: rrow.Entry(),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, sub := range s.Subscribers(rrow.Skid) {
+		if !cache.CanGetIP(sub.client.Id, rrow.Skid) {
+			log.Printf("[INFO] Not notifying %s of %s, no longer authorized\n", sub.client.Id, rrow.Skid)
+			continue
+		}
+
+		// Don't hold up the registering daemon on a slow subscriber, nor
+		// keep queueing for one that stopped reading
+		if !sub.push(notification) {
+			log.Printf("[ERROR] %s is %d notifications behind, disconnecting it\n", sub.client.Id, SubscriberQueueSize)
+			s.RemoveAll(sub)
+			sub.stop()
+			go sub.messenger.Close()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dayvidpham/ipcache/internal/msgs"
+)
+
+// A subscriber that never reads: Send blocks until the messenger is closed
+type stalledMessenger struct {
+	recordingMessenger
+	unblock chan struct{}
+}
+
+func newStalledMessenger() *stalledMessenger {
+	return &stalledMessenger{unblock: make(chan struct{})}
+}
+
+func (m *stalledMessenger) Send(msg msgs.Message) error {
+	<-m.unblock
+	return net.ErrClosed
+}
+
+func (m *stalledMessenger) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.unblock)
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	c := newTestCache(t)
+	registerTestDaemon(t, c, "alice", "192.0.2.1")
+	grantTestAuth(t, c, "alice", "bob")
+	grantTestAuth(t, c, "alice", "carol")
+
+	bobMessenger := &recordingMessenger{}
+	bob := newSubscriber(testClient("bob", "198.51.100.1"), bobMessenger)
+	carolMessenger := &recordingMessenger{}
+	carol := newSubscriber(testClient("carol", "198.51.100.2"), carolMessenger)
+	defer bob.stop()
+	defer carol.stop()
+	subscriptions.Add(bob, []string{"alice"})
+	subscriptions.Add(carol, []string{"alice"})
+
+	// Revoked after subscribing, so carol must not hear about alice any more
+	if err := c.RevokeAuth(rootCtx, AuthGrantsRow{Owner: "alice", Other: "carol", Type: AuthT_GetIP}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		registerTestDaemon(t, c, "alice", ip)
+		rrow, _ := c.registrar.Load("alice")
+		subscriptions.Notify(rrow)
+	}
+
+	waitFor(t, "bob's notifications", func() bool { return len(bobMessenger.Sent()) == 2 })
+	for i, want := range []string{"192.0.2.2", "192.0.2.3"} {
+		msg := bobMessenger.Sent()[i]
+		var notification msgs.IPChangedNotification
+		if err := msgs.Unmarshal(msg, &notification); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ReplyTo != 0 || !notification.Entry.IP.Equal(net.ParseIP(want)) {
+			t.Errorf("notification %d: %s replying to %d, want %s unsolicited", i, notification.Entry.IP, msg.ReplyTo, want)
+		}
+	}
+	if sent := carolMessenger.Sent(); len(sent) != 0 {
+		t.Errorf("carol got %d notifications after the grant was revoked", len(sent))
+	}
+}
+
+func TestNotifyDisconnectsStalledSubscriber(t *testing.T) {
+	c := newTestCache(t)
+	registerTestDaemon(t, c, "alice", "192.0.2.1")
+	grantTestAuth(t, c, "alice", "bob")
+
+	messenger := newStalledMessenger()
+	bob := newSubscriber(testClient("bob", "198.51.100.1"), messenger)
+	defer bob.stop()
+	subscriptions.Add(bob, []string{"alice"})
+	rrow, _ := c.registrar.Load("alice")
+
+	// One is held by the writer, the rest fill the queue
+	subscriptions.Notify(rrow)
+	waitFor(t, "the writer to take the first notification", func() bool { return len(bob.queue) == 0 })
+	for range SubscriberQueueSize {
+		subscriptions.Notify(rrow)
+	}
+	if len(subscriptions.Subscribers("alice")) != 1 {
+		t.Fatal("subscriber dropped before its queue was full")
+	}
+
+	subscriptions.Notify(rrow)
+	if subs := subscriptions.Subscribers("alice"); len(subs) != 0 {
+		t.Fatalf("%d subscribers left, want the stalled one removed", len(subs))
+	}
+	select {
+	case <-messenger.unblock:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled subscriber was not disconnected")
+	}
+}
@@ -2,4 +2,10 @@ module github.com/dayvidpham/ipcache
 
 go 1.22.6
 
-require github.com/mattn/go-sqlite3 v1.14.24 // indirect
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/mattn/go-sqlite3 v1.14.24
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
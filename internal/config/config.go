@@ -0,0 +1,245 @@
+// Package config loads the connection settings shared by client and clientd.
+//
+// Every setting can come from, in order of precedence:
+//  1. a flag given explicitly, e.g. --server
+//  2. an environment variable, e.g. IPCACHE_SERVER
+//  3. a TOML config file, given by --config or IPCACHE_CONFIG
+//  4. the default in DefaultClientConfig
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dayvidpham/ipcache/internal/msgs"
+	"github.com/dayvidpham/ipcache/internal/transport"
+)
+
+const EnvPrefix = "IPCACHE_"
+
+var ErrRequired = errors.New("required but not set")
+
+type ClientConfig struct {
+	Server           string `toml:"server"`
+	Port             uint   `toml:"port"`
+	Cert             string `toml:"cert"`
+	PrivateKey       string `toml:"privatekey"`
+	ServerRootCACert string `toml:"server-root-ca-cert"`
+	Framing          string `toml:"framing"`
+	ServerName       string `toml:"server-name"`
+}
+
+var DefaultClientConfig = ClientConfig{
+	Framing: "gob",
+}
+
+// One setting, reachable by flag, environment variable and config file key
+type field struct {
+	name     string
+	usage    string
+	required bool
+	ptr      func(c *ClientConfig) any
+}
+
+// Flag names double as config file keys
+var fields = []field{
+	{"server", "server to connect to; examples <ipcache.com | 192.168.0.1 | ::1>", true,
+		func(c *ClientConfig) any { return &c.Server }},
+	{"port", "server port to connect to; examples <8080 | 4430>", true,
+		func(c *ClientConfig) any { return &c.Port }},
+	{"cert", "path to your certificate", true,
+		func(c *ClientConfig) any { return &c.Cert }},
+	{"privatekey", "path to your private key that was used to sign your certificate", true,
+		func(c *ClientConfig) any { return &c.PrivateKey }},
+	{"server-root-ca-cert", "path to the expected server root CA certificate, used for verification", true,
+		func(c *ClientConfig) any { return &c.ServerRootCACert }},
+	{"framing", "wire framing expected by the server; one of <gob | binary | json | cbor>, gob unless the server listener was set to another", false,
+		func(c *ClientConfig) any { return &c.Framing }},
+	{"server-name", "name checked against the server certificate and sent as SNI; defaults to --server", false,
+		func(c *ClientConfig) any { return &c.ServerName }},
+}
+
+// IPCACHE_SERVER_ROOT_CA_CERT for --server-root-ca-cert
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Describes where a setting can come from, for error messages
+func (f field) sources() string {
+	return fmt.Sprintf("--%s / %s / %q", f.name, envName(f.name), f.name)
+}
+
+// Holds the values bound to a FlagSet until Load merges them with the
+// environment and config file
+type ClientFlags struct {
+	fs         *flag.FlagSet
+	flagged    ClientConfig
+	configPath string
+}
+
+// Registers --config and one flag per ClientConfig field on `fs`
+func BindClientFlags(fs *flag.FlagSet) *ClientFlags {
+	f := &ClientFlags{fs: fs}
+	fs.StringVar(&f.configPath, "config", "", "path to a TOML config file; also read from "+envName("config"))
+
+	for _, fld := range fields {
+		usage := fld.usage + "; also read from " + envName(fld.name)
+		switch p := fld.ptr(&f.flagged).(type) {
+		case *string:
+			fs.StringVar(p, fld.name, *fld.ptr(&DefaultClientConfig).(*string), usage)
+		case *uint:
+			fs.UintVar(p, fld.name, *fld.ptr(&DefaultClientConfig).(*uint), usage)
+		}
+	}
+	return f
+}
+
+// Merges flags, environment and config file into a validated ClientConfig.
+// Must be called after the FlagSet has been parsed.
+func (f *ClientFlags) Load() (cfg ClientConfig, err error) {
+	cfg = DefaultClientConfig
+
+	path, ok := os.LookupEnv(envName("config"))
+	if f.isSet("config") || !ok {
+		path = f.configPath
+	}
+	if path != "" {
+		if err = LoadFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err = cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+
+	for _, fld := range fields {
+		if !f.isSet(fld.name) {
+			continue
+		}
+		switch p := fld.ptr(&cfg).(type) {
+		case *string:
+			*p = *fld.ptr(&f.flagged).(*string)
+		case *uint:
+			*p = *fld.ptr(&f.flagged).(*uint)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (f *ClientFlags) isSet(name string) (set bool) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// Decodes the TOML file at `path` over `cfg`, so keys missing from the file
+// keep their current values. Unknown keys are an error, to catch typos.
+func LoadFile(path string, cfg *ClientConfig) (err error) {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+func (c *ClientConfig) applyEnv() error {
+	for _, fld := range fields {
+		value, ok := os.LookupEnv(envName(fld.name))
+		if !ok {
+			continue
+		}
+		switch p := fld.ptr(c).(type) {
+		case *string:
+			*p = value
+		case *uint:
+			n, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return fmt.Errorf("%s: %w", envName(fld.name), err)
+			}
+			*p = uint(n)
+		}
+	}
+	return nil
+}
+
+// Reports every missing or invalid field at once, by name
+func (c ClientConfig) Validate() error {
+	var errs []error
+
+	for _, fld := range fields {
+		if !fld.required {
+			continue
+		}
+		switch p := fld.ptr(&c).(type) {
+		case *string:
+			if *p == "" {
+				errs = append(errs, fmt.Errorf("%s: %w", fld.sources(), ErrRequired))
+			}
+		case *uint:
+			if *p == 0 {
+				errs = append(errs, fmt.Errorf("%s: %w", fld.sources(), ErrRequired))
+			}
+		}
+	}
+
+	if c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is not in 1-65535", c.Port))
+	}
+	if _, err := msgs.ParseFraming(c.Framing); err != nil {
+		errs = append(errs, fmt.Errorf("framing: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// host:port of the server, with IPv6 hosts in brackets
+func (c ClientConfig) Addr() string {
+	return net.JoinHostPort(c.Server, strconv.FormatUint(uint64(c.Port), 10))
+}
+
+func (c ClientConfig) ParsedFraming() (msgs.Framing, error) {
+	return msgs.ParseFraming(c.Framing)
+}
+
+// Loads the client keypair and the server root CA into an mTLS config
+func (c ClientConfig) TlsConfig() (config *tls.Config, err error) {
+	config, err = transport.ClientTLSConfig(c.Cert, c.PrivateKey, c.ServerRootCACert)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return config, nil
+}
+
+// Everything transport.Dial needs except timeouts and retries, which are up
+// to the caller
+func (c ClientConfig) DialConfig() (cfg transport.DialConfig, err error) {
+	config, err := c.TlsConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg = transport.DialConfig{
+		Addr:       c.Addr(),
+		TLS:        config,
+		ServerName: c.ServerName,
+	}
+	return cfg, nil
+}
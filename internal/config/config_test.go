@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Leaves only the IPCACHE_ variables in `env` set, restored after the test
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range append([]string{"config"}, fieldNames()...) {
+		t.Setenv(envName(name), "")
+		os.Unsetenv(envName(name))
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func fieldNames() []string {
+	names := make([]string, len(fields))
+	for i, fld := range fields {
+		names[i] = fld.name
+	}
+	return names
+}
+
+func writeFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const completeFile = `
+server = "file.example"
+port = 1111
+cert = "file.pem"
+privatekey = "file.key"
+server-root-ca-cert = "file-ca.pem"
+`
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"server":              "IPCACHE_SERVER",
+		"server-root-ca-cert": "IPCACHE_SERVER_ROOT_CA_CERT",
+		"config":              "IPCACHE_CONFIG",
+	}
+	for name, want := range tests {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	filePath := writeFile(t, completeFile)
+	otherPath := writeFile(t, completeFile+`framing = "json"`)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want ClientConfig
+	}{
+		{
+			name: "file only",
+			args: []string{"--config", filePath},
+			want: ClientConfig{Server: "file.example", Port: 1111, Cert: "file.pem", PrivateKey: "file.key", ServerRootCACert: "file-ca.pem", Framing: "gob"},
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"IPCACHE_SERVER": "env.example", "IPCACHE_PORT": "2222"},
+			args: []string{"--config", filePath},
+			want: ClientConfig{Server: "env.example", Port: 2222, Cert: "file.pem", PrivateKey: "file.key", ServerRootCACert: "file-ca.pem", Framing: "gob"},
+		},
+		{
+			name: "flags over env",
+			env:  map[string]string{"IPCACHE_SERVER": "env.example", "IPCACHE_PORT": "2222"},
+			args: []string{"--config", filePath, "--server", "flag.example", "--framing", "cbor"},
+			want: ClientConfig{Server: "flag.example", Port: 2222, Cert: "file.pem", PrivateKey: "file.key", ServerRootCACert: "file-ca.pem", Framing: "cbor"},
+		},
+		{
+			name: "config path from env",
+			env:  map[string]string{"IPCACHE_CONFIG": otherPath},
+			want: ClientConfig{Server: "file.example", Port: 1111, Cert: "file.pem", PrivateKey: "file.key", ServerRootCACert: "file-ca.pem", Framing: "json"},
+		},
+		{
+			name: "config flag over env",
+			env:  map[string]string{"IPCACHE_CONFIG": otherPath},
+			args: []string{"--config", filePath},
+			want: ClientConfig{Server: "file.example", Port: 1111, Cert: "file.pem", PrivateKey: "file.key", ServerRootCACert: "file-ca.pem", Framing: "gob"},
+		},
+		{
+			name: "no file",
+			env:  map[string]string{"IPCACHE_SERVER": "::1", "IPCACHE_CERT": "env.pem", "IPCACHE_PRIVATEKEY": "env.key", "IPCACHE_SERVER_ROOT_CA_CERT": "env-ca.pem"},
+			args: []string{"--port", "4430"},
+			want: ClientConfig{Server: "::1", Port: 4430, Cert: "env.pem", PrivateKey: "env.key", ServerRootCACert: "env-ca.pem", Framing: "gob"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := BindClientFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := flags.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Load() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		// Substrings the error must contain
+		want []string
+	}{
+		{name: "missing fields", file: `server = "file.example"`, want: []string{"--port / IPCACHE_PORT", "--cert / IPCACHE_CERT", ErrRequired.Error()}},
+		{name: "unknown key", file: completeFile + `colour = "blue"`, want: []string{"unknown keys: colour"}},
+		{name: "bad port in env", file: completeFile, env: map[string]string{"IPCACHE_PORT": "https"}, want: []string{"IPCACHE_PORT"}},
+		{name: "port out of range", file: completeFile, env: map[string]string{"IPCACHE_PORT": "65536"}, want: []string{"not in 1-65535"}},
+		{name: "bad framing", file: completeFile + `framing = "xml"`, want: []string{"framing"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := BindClientFlags(fs)
+			if err := fs.Parse([]string{"--config", writeFile(t, tt.file)}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := flags.Load()
+			if err == nil {
+				t.Fatal("Load() succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load() = %q, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	err := ClientConfig{Framing: "gob"}.Validate()
+	if !errors.Is(err, ErrRequired) {
+		t.Fatalf("Validate() = %v, want ErrRequired", err)
+	}
+	for _, fld := range fields {
+		if fld.required && !strings.Contains(err.Error(), fld.sources()) {
+			t.Errorf("Validate() does not name %s", fld.sources())
+		}
+	}
+}
+
+func TestAddr(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"ipcache.example", "ipcache.example:4430"},
+		{"192.0.2.1", "192.0.2.1:4430"},
+		{"::1", "[::1]:4430"},
+	}
+	for _, tt := range tests {
+		if got := (ClientConfig{Server: tt.server, Port: 4430}).Addr(); got != tt.want {
+			t.Errorf("Addr() of %q = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package msgs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	Family_IPv4 = "ipv4"
+	Family_IPv6 = "ipv6"
+)
+
+const (
+	Scope_Loopback  = "loopback"
+	Scope_LinkLocal = "link-local"
+	Scope_Private   = "private"
+	Scope_Global    = "global"
+)
+
+// One address a daemon can be reached at
+type Address struct {
+	IP net.IP
+	// Family and Scope are derived from IP by the server, whatever the daemon sent
+	Family string
+	Scope  string
+	// Optional, zero if unset
+	Port int
+	// Optional, e.g. "lan", "wan", "wireguard"
+	Label string
+	// Set by the server on the address it saw the daemon's connection come from
+	Observed bool
+}
+
+func NewAddress(ip net.IP, port int, label string) Address {
+	return Address{
+		IP:     ip,
+		Family: AddrFamily(ip),
+		Scope:  AddrScope(ip),
+		Port:   port,
+		Label:  label,
+	}
+}
+
+func AddrFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return Family_IPv4
+	}
+	return Family_IPv6
+}
+
+func AddrScope(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return Scope_Loopback
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return Scope_LinkLocal
+	case ip.IsPrivate():
+		return Scope_Private
+	default:
+		return Scope_Global
+	}
+}
+
+// Checks the fields a daemon controls
+func (a Address) Validate() error {
+	switch {
+	case a.IP == nil || a.IP.IsUnspecified():
+		return fmt.Errorf("address %v is not a usable IP", a.IP)
+	case a.Port < 0 || a.Port > 65535:
+		return fmt.Errorf("port %d of %s is not in 0-65535", a.Port, a.IP)
+	}
+	return nil
+}
+
+// label=ip, label=ip:port or label=[ipv6]:port, e.g. wan=203.0.113.7:22
+func ParseAddress(s string) (a Address, err error) {
+	label, hostport, ok := strings.Cut(s, "=")
+	if !ok {
+		label, hostport = "", s
+	}
+
+	host, port := hostport, 0
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		if port, err = strconv.Atoi(p); err != nil {
+			return a, fmt.Errorf("address %q: bad port %q", s, p)
+		}
+		host = h
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return a, fmt.Errorf("address %q: %q is not an IP", s, host)
+	}
+
+	a = NewAddress(ip, port, label)
+	return a, a.Validate()
+}
+
+func (a Address) String() string {
+	addr := a.IP.String()
+	if a.Port != 0 {
+		addr = net.JoinHostPort(addr, strconv.Itoa(a.Port))
+	}
+	if a.Label != "" {
+		addr = a.Label + "=" + addr
+	}
+	return addr
+}
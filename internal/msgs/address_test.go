@@ -0,0 +1,88 @@
+package msgs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Address
+		wantErr bool
+	}{
+		{in: "203.0.113.7", want: NewAddress(net.ParseIP("203.0.113.7"), 0, "")},
+		{in: "wan=203.0.113.7:22", want: NewAddress(net.ParseIP("203.0.113.7"), 22, "wan")},
+		{in: "lan=[fd00::1]:2222", want: NewAddress(net.ParseIP("fd00::1"), 2222, "lan")},
+		{in: "wg=fd00::1", want: NewAddress(net.ParseIP("fd00::1"), 0, "wg")},
+		{in: "wan=example.com", wantErr: true},
+		{in: "wan=203.0.113.7:ssh", wantErr: true},
+		{in: "wan=203.0.113.7:70000", wantErr: true},
+		{in: "any=0.0.0.0", wantErr: true},
+		{in: "any=[::]:22", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddress(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAddress(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !got.IP.Equal(tt.want.IP) || got.Port != tt.want.Port || got.Label != tt.want.Label || got.Family != tt.want.Family || got.Scope != tt.want.Scope {
+			t.Errorf("ParseAddress(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if back, err := ParseAddress(got.String()); err != nil || !back.IP.Equal(got.IP) || back.Port != got.Port || back.Label != got.Label {
+			t.Errorf("ParseAddress(%q) = %+v, %v, want it to round trip", got.String(), back, err)
+		}
+	}
+}
+
+func TestAddrFamilyAndScope(t *testing.T) {
+	tests := []struct {
+		ip         string
+		wantFamily string
+		wantScope  string
+	}{
+		{"127.0.0.1", Family_IPv4, Scope_Loopback},
+		{"::1", Family_IPv6, Scope_Loopback},
+		{"169.254.1.1", Family_IPv4, Scope_LinkLocal},
+		{"fe80::1", Family_IPv6, Scope_LinkLocal},
+		{"10.1.2.3", Family_IPv4, Scope_Private},
+		{"192.168.0.1", Family_IPv4, Scope_Private},
+		{"fd00::1", Family_IPv6, Scope_Private},
+		{"203.0.113.7", Family_IPv4, Scope_Global},
+		{"2001:db8::1", Family_IPv6, Scope_Global},
+		{"::ffff:203.0.113.7", Family_IPv4, Scope_Global},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := AddrFamily(ip); got != tt.wantFamily {
+			t.Errorf("AddrFamily(%s) = %s, want %s", tt.ip, got, tt.wantFamily)
+		}
+		if got := AddrScope(ip); got != tt.wantScope {
+			t.Errorf("AddrScope(%s) = %s, want %s", tt.ip, got, tt.wantScope)
+		}
+	}
+}
+
+func TestAddressValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    Address
+		wantErr bool
+	}{
+		{"IP only", Address{IP: net.ParseIP("203.0.113.7")}, false},
+		{"highest port", Address{IP: net.ParseIP("203.0.113.7"), Port: 65535}, false},
+		{"no IP", Address{Port: 22}, true},
+		{"unspecified", Address{IP: net.IPv6unspecified}, true},
+		{"negative port", Address{IP: net.ParseIP("203.0.113.7"), Port: -1}, true},
+		{"port over 65535", Address{IP: net.ParseIP("203.0.113.7"), Port: 65536}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.addr.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package msgs
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMessengerClosed = errors.New("messenger closed")
+
+// A Messenger that reads and writes on its own goroutines, so that Send, Call and Receive
+// can be used concurrently. Replies are matched to their Call; every other message goes,
+// in order, to Receive or Unsolicited. Use one or the other, not both. Like the blocking
+// Messenger, it drops messages beyond UnsolicitedQueueSize left unread, so that a caller
+// that only uses Call still gets its replies.
+type asyncMessenger struct {
+	conn   *tls.Conn
+	connrw *bufio.ReadWriter
+	codec  Codec
+	lr     *frameLimitReader
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+
+	writes   chan writeRequest
+	inbox    chan received
+	readDone chan struct{}
+	readErr  error
+
+	mu         sync.Mutex
+	limits     Limits
+	newLimits  *Limits
+	version    ProtocolVersion
+	negotiated bool
+	pending    map[uint64]pendingCall
+	pendingIds []uint64
+
+	lastRequestId   atomic.Uint64
+	unsolicited     chan Message
+	unsolicitedOnce sync.Once
+	// Messages dropped because nobody read them in time
+	dropped atomic.Uint64
+}
+
+// A Call waiting on its reply
+type pendingCall struct {
+	msgT  MessageType
+	reply chan Message
+}
+
+type writeRequest struct {
+	msg  Message
+	done chan error
+}
+
+type received struct {
+	msg Message
+	err error
+}
+
+func (am *asyncMessenger) readLoop() {
+	defer am.wg.Done()
+	defer close(am.readDone)
+	defer close(am.inbox)
+
+	for {
+		limits := am.applyLimits()
+		am.lr.reset()
+
+		msg, err := am.codec.Decode()
+		if err == nil {
+			err = limits.checkPayload(msg)
+		}
+		if err != nil {
+			// Nothing after a failed Decode can be trusted
+			if !errors.Is(err, io.EOF) {
+				err = fmt.Errorf("[ERROR] Messenger failed during Receive\n\t%w\n", err)
+			}
+			am.readErr = err
+			return
+		}
+
+		if err = am.checkVersion(msg); err != nil {
+			am.deliver(received{msg: msg, err: err})
+			continue
+		}
+		if am.route(msg) {
+			continue
+		}
+		am.deliver(received{msg: msg})
+	}
+}
+
+func (am *asyncMessenger) writeLoop() {
+	defer am.wg.Done()
+
+	for {
+		select {
+		case <-am.ctx.Done():
+			return
+		case req := <-am.writes:
+			err := am.codec.Encode(req.msg)
+			if err != nil {
+				err = fmt.Errorf("[ERROR] Messenger failed to Encode the message\n\t%w\n", err)
+			} else if err = am.connrw.Flush(); err != nil {
+				err = fmt.Errorf("[ERROR] Messenger failed to Flush the buffered connection\n\t%w\n", err)
+			}
+			req.done <- err
+		}
+	}
+}
+
+// Limits are only handed to the codec between two Decodes, from the reader goroutine
+func (am *asyncMessenger) applyLimits() (limits Limits) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.newLimits != nil {
+		am.lr.limit = am.newLimits.MaxFrameSize
+		if lc, ok := am.codec.(LimitedCodec); ok {
+			lc.SetLimits(*am.newLimits)
+		}
+		am.newLimits = nil
+	}
+	return am.limits
+}
+
+func (am *asyncMessenger) checkVersion(msg Message) (err error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.negotiated {
+		err = checkVersion(msg, am.version)
+	}
+	return
+}
+
+// Hands `msg` to its pending Call, if any. Before Version_1_1_0 there is no
+// ReplyTo, so the oldest Call that `msg` can be a reply to gets it.
+func (am *asyncMessenger) route(msg Message) (routed bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	correlated := am.negotiated && am.version >= Version_1_1_0
+	if !correlated {
+		for _, id := range am.pendingIds {
+			if call := am.pending[id]; IsReplyTo(msg.Type, call.msgT) {
+				am.removePendingLocked(id)
+				call.reply <- msg
+				return true
+			}
+		}
+		return false
+	}
+	if msg.ReplyTo == 0 {
+		return false
+	}
+
+	call, ok := am.pending[msg.ReplyTo]
+	if !ok {
+		log.Printf("[INFO] Dropping %s replying to stale request %d\n", msg.Type, msg.ReplyTo)
+		return true
+	}
+	am.removePendingLocked(msg.ReplyTo)
+	call.reply <- msg
+	return true
+}
+
+// Never blocks, since replies to pending Calls come in behind `r`
+func (am *asyncMessenger) deliver(r received) {
+	select {
+	case am.inbox <- r:
+	default:
+		log.Printf("[ERROR] Unsolicited queue is full, dropping %s (%d dropped)\n", r.msg.Type, am.dropped.Add(1))
+	}
+}
+
+func (am *asyncMessenger) removePendingLocked(id uint64) {
+	delete(am.pending, id)
+	for i, pendingId := range am.pendingIds {
+		if pendingId == id {
+			am.pendingIds = append(am.pendingIds[:i], am.pendingIds[i+1:]...)
+			break
+		}
+	}
+}
+
+func (am *asyncMessenger) Send(msg Message) (err error) {
+	am.mu.Lock()
+	limits, version, negotiated := am.limits, am.version, am.negotiated
+	am.mu.Unlock()
+
+	if err = limits.checkPayload(msg); err != nil {
+		return err
+	}
+	if negotiated {
+		stampVersion(&msg, version)
+	}
+
+	req := writeRequest{msg: msg, done: make(chan error, 1)}
+	select {
+	case am.writes <- req:
+		return <-req.done
+	case <-am.ctx.Done():
+		return fmt.Errorf("[ERROR] Messenger failed to Send %s\n\t%w\n", msg.Type, context.Cause(am.ctx))
+	}
+}
+
+func (am *asyncMessenger) SendN(msg Message) (n int, err error) {
+	return 0, am.Send(msg)
+}
+
+func (am *asyncMessenger) Receive() (msg Message, err error) {
+	r, ok := <-am.inbox
+	if !ok {
+		return msg, am.readErr
+	}
+	return r.msg, r.err
+}
+
+func (am *asyncMessenger) Call(ctx context.Context, msg Message) (reply Message, err error) {
+	msg.RequestId = am.lastRequestId.Add(1)
+	replyCh := make(chan Message, 1)
+
+	am.mu.Lock()
+	am.pending[msg.RequestId] = pendingCall{msgT: msg.Type, reply: replyCh}
+	am.pendingIds = append(am.pendingIds, msg.RequestId)
+	am.mu.Unlock()
+	defer func() {
+		am.mu.Lock()
+		am.removePendingLocked(msg.RequestId)
+		am.mu.Unlock()
+	}()
+
+	if err = am.Send(msg); err != nil {
+		return
+	}
+
+	select {
+	case reply = <-replyCh:
+		return
+	case <-ctx.Done():
+		return reply, fmt.Errorf("[ERROR] Call for %s was cancelled\n\t%w\n", msg.Type, ctx.Err())
+	case <-am.readDone:
+		// The reply may have arrived right before the connection closed
+		select {
+		case reply = <-replyCh:
+			return reply, nil
+		default:
+		}
+		return reply, fmt.Errorf("[ERROR] Connection was lost during Call for %s\n\t%w\n", msg.Type, am.readErr)
+	}
+}
+
+func (am *asyncMessenger) Reply(req Message, resp Message) (err error) {
+	resp.ReplyTo = req.RequestId
+	return am.Send(resp)
+}
+
+// Closed once the connection is lost; Receive then returns the reason
+func (am *asyncMessenger) Unsolicited() <-chan Message {
+	am.unsolicitedOnce.Do(func() {
+		go func() {
+			defer close(am.unsolicited)
+			for r := range am.inbox {
+				if r.err != nil {
+					log.Println(r.err)
+					continue
+				}
+				select {
+				case am.unsolicited <- r.msg:
+				case <-am.ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+	return am.unsolicited
+}
+
+func (am *asyncMessenger) SetVersion(version ProtocolVersion) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.version = version
+	am.negotiated = true
+}
+
+func (am *asyncMessenger) Version() (version ProtocolVersion, negotiated bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return am.version, am.negotiated
+}
+
+// New limits apply to Send right away, and to Receive from the next message on
+func (am *asyncMessenger) SetLimits(limits Limits) (err error) {
+	if err = limits.Validate(); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.limits = limits
+	am.newLimits = &limits
+	return
+}
+
+func (am *asyncMessenger) Close() (err error) {
+	am.cancel(ErrMessengerClosed)
+	am.wg.Wait()
+	return
+}
+
+func (am *asyncMessenger) SetReadTimeout(timeout time.Duration) (err error) {
+	err = am.conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set read timeout of %s\n\t%w\n", timeout.String(), err)
+	}
+	return err
+}
+func (am *asyncMessenger) SetWriteTimeout(timeout time.Duration) (err error) {
+	err = am.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set write timeout of %s\n\t%w\n", timeout.String(), err)
+	}
+	return err
+}
+func (am *asyncMessenger) SetTimeout(timeout time.Duration) (err error) {
+	err = am.conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set timeout of %s\n\t%w\n", timeout.String(), err)
+	}
+	return err
+}
+
+func (am *asyncMessenger) SetReadDeadline(deadline time.Time) (err error) {
+	err = am.conn.SetReadDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set read deadline of %s\n\t%w\n", deadline.String(), err)
+	}
+	return err
+}
+func (am *asyncMessenger) SetWriteDeadline(deadline time.Time) (err error) {
+	err = am.conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set write deadline of %s\n\t%w\n", deadline.String(), err)
+	}
+	return err
+}
+func (am *asyncMessenger) SetDeadline(deadline time.Time) (err error) {
+	err = am.conn.SetDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to set deadline of %s\n\t%w\n", deadline.String(), err)
+	}
+	return err
+}
+
+func NewAsyncMessengerWithFraming(ctx context.Context, conn *tls.Conn, framing Framing) Messenger {
+	return NewAsyncMessengerWithCodec(ctx, conn, framing.NewCodec)
+}
+
+// The Messenger closes the connection once `ctx` is done or Close is called
+func NewAsyncMessengerWithCodec(ctx context.Context, conn *tls.Conn, newCodec NewCodecFunc) Messenger {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	connrw := bufio.NewReadWriter(r, w)
+
+	lr := &frameLimitReader{r: connrw, limit: DefaultLimits.MaxFrameSize}
+	codecrw := struct {
+		io.Reader
+		io.Writer
+	}{lr, connrw}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	am := &asyncMessenger{
+		conn:   conn,
+		connrw: connrw,
+		codec:  newCodec(codecrw),
+		lr:     lr,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		writes:   make(chan writeRequest),
+		inbox:    make(chan received, UnsolicitedQueueSize),
+		readDone: make(chan struct{}),
+
+		limits:  DefaultLimits,
+		pending: make(map[uint64]pendingCall),
+
+		unsolicited: make(chan Message),
+	}
+
+	am.wg.Add(3)
+	go am.readLoop()
+	go am.writeLoop()
+	go func() {
+		defer am.wg.Done()
+		// Unblocks the reader
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	return am
+}
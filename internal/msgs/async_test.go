@@ -0,0 +1,182 @@
+package msgs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An async client and a blocking server over one connection, both at `version`
+func asyncPair(t *testing.T, version ProtocolVersion) (client Messenger, server Messenger) {
+	t.Helper()
+
+	clientConn, serverConn := tlsPipe(t)
+	client = NewAsyncMessengerWithFraming(context.Background(), clientConn, Framing_Binary)
+	server = NewMessengerWithFraming(serverConn, Framing_Binary)
+	t.Cleanup(func() { client.Close() })
+
+	client.SetVersion(version)
+	server.SetVersion(version)
+	return client, server
+}
+
+func TestCallsAnsweredOutOfOrder(t *testing.T) {
+	client, server := asyncPair(t, Version_1_1_0)
+
+	getIPs, err := Marshal(T_ClientGetIPs, GetIPsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstReplies, firstErrs := callAsync(client, getIPs)
+	first := receiveType(t, server, T_ClientGetIPs)
+	secondReplies, secondErrs := callAsync(client, Ping())
+	second := receiveType(t, server, T_Ping)
+	if first.RequestId == 0 || first.RequestId == second.RequestId {
+		t.Fatalf("RequestIds %d and %d must be distinct and non-zero", first.RequestId, second.RequestId)
+	}
+
+	// Answered out of order, with a notification in between
+	if err = server.Reply(second, Pong()); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Send(String("notification")); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := Marshal(T_ServerIPs, GetIPsResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Reply(first, ips); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := <-secondReplies; <-secondErrs != nil || reply.Type != T_Pong || reply.ReplyTo != second.RequestId {
+		t.Errorf("second Call got %s replying to %d, want Pong replying to %d", reply.Type, reply.ReplyTo, second.RequestId)
+	}
+	if reply := <-firstReplies; <-firstErrs != nil || reply.Type != T_ServerIPs || reply.ReplyTo != first.RequestId {
+		t.Errorf("first Call got %s replying to %d, want ServerIPs replying to %d", reply.Type, reply.ReplyTo, first.RequestId)
+	}
+	select {
+	case msg := <-client.Unsolicited():
+		if msg.Type != T_String {
+			t.Fatalf("unsolicited %s, want String", msg.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification never reached Unsolicited")
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, server := asyncPair(t, Version_1_1_0)
+
+	// Answers every request with an Ok carrying its RequestId
+	go func() {
+		for {
+			req, err := server.Receive()
+			if err != nil {
+				return
+			}
+			resp, _ := Marshal(T_Ok, OkPayload{Message: fmt.Sprint(req.RequestId)})
+			if err = server.Reply(req, resp); err != nil {
+				return
+			}
+		}
+	}()
+
+	const calls = 50
+	var wg sync.WaitGroup
+	for range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			reply, err := client.Call(ctx, String("hi"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var ok OkPayload
+			if err = Unmarshal(reply, &ok); err != nil {
+				t.Error(err)
+				return
+			}
+			if ok.Message != fmt.Sprint(reply.ReplyTo) {
+				t.Errorf("reply to %d carries %q", reply.ReplyTo, ok.Message)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCallFailsWhenConnectionIsLost(t *testing.T) {
+	client, server := asyncPair(t, Version_1_1_0)
+
+	replies, errs := callAsync(client, Ping())
+	receiveType(t, server, T_Ping)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-replies
+	if err := <-errs; err == nil {
+		t.Fatal("Call succeeded without a reply")
+	}
+	select {
+	case _, ok := <-client.Unsolicited():
+		if ok {
+			t.Fatal("Unsolicited delivered a message after the connection was lost")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unsolicited was not closed")
+	}
+}
+
+// Replies must get through even when nobody reads what the server pushes
+func TestCallWithFullInbox(t *testing.T) {
+	tests := []struct {
+		name    string
+		version ProtocolVersion
+	}{
+		{"1.0.0", Version_1_0_0},
+		{"1.1.0", Version_1_1_0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := asyncPair(t, tt.version)
+
+			for range UnsolicitedQueueSize + 10 {
+				if err := server.Send(String("notification")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			replies, errs := callAsync(client, Ping())
+			ping := receiveType(t, server, T_Ping)
+			if err := server.Reply(ping, Pong()); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if reply := <-replies; reply.Type != T_Pong {
+				t.Fatalf("Call got %s, want Pong", reply.Type)
+			}
+
+			// The queue still holds the oldest notifications
+			for i := range UnsolicitedQueueSize {
+				select {
+				case msg := <-client.Unsolicited():
+					if msg.Type != T_String {
+						t.Fatalf("unsolicited %d is %s, want String", i, msg.Type)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d notifications queued, want %d", i, UnsolicitedQueueSize)
+				}
+			}
+		})
+	}
+}
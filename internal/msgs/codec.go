@@ -0,0 +1,254 @@
+package msgs
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Encodes and decodes Messages on a single stream. Codecs may keep state between
+// messages (e.g. gob type info), so each connection needs its own Codec.
+type Codec interface {
+	Encode(msg Message) (err error)
+	Decode() (msg Message, err error)
+}
+
+// Builds a Codec on top of the buffered stream of a connection
+type NewCodecFunc func(rw io.ReadWriter) Codec
+
+// Names the Codecs that ship with msgs, so they can be picked by flag.
+// See docs/wire-format.md for the spec of each.
+type Framing uint8
+
+const (
+	// Legacy: only readable by Go peers
+	Framing_Gob Framing = iota
+	// Length-prefixed frames with a fixed header
+	Framing_Binary
+	// One JSON object per line, for debugging
+	Framing_JSON
+	// Compact, self-describing
+	Framing_CBOR
+)
+
+var framingName = map[Framing]string{
+	Framing_Gob:    "gob",
+	Framing_Binary: "binary",
+	Framing_JSON:   "json",
+	Framing_CBOR:   "cbor",
+}
+
+var framingCodec = map[Framing]NewCodecFunc{
+	Framing_Gob:    NewGobCodec,
+	Framing_Binary: NewBinaryCodec,
+	Framing_JSON:   NewJSONCodec,
+	Framing_CBOR:   NewCBORCodec,
+}
+
+func (f Framing) String() string {
+	return framingName[f]
+}
+
+func (f Framing) NewCodec(rw io.ReadWriter) Codec {
+	newCodec, ok := framingCodec[f]
+	if !ok {
+		return NewGobCodec(rw)
+	}
+	return newCodec(rw)
+}
+
+func ParseFraming(name string) (framing Framing, err error) {
+	for f, fname := range framingName {
+		if fname == name {
+			return f, err
+		}
+	}
+	return framing, fmt.Errorf("[ERROR] Unknown framing `%s`, expected one of: binary, json, cbor, gob", name)
+}
+
+///////////////////////////////
+// gob
+///////////////////////////////
+
+type gobCodec struct {
+	enc *gob.Encoder
+	dec *gob.Decoder
+	lr  *gobLimitReader
+}
+
+func NewGobCodec(rw io.ReadWriter) Codec {
+	lr := &gobLimitReader{r: bufio.NewReader(rw), limit: DefaultLimits.MaxFrameSize}
+	return &gobCodec{enc: gob.NewEncoder(rw), dec: gob.NewDecoder(lr), lr: lr}
+}
+
+func (gc *gobCodec) SetLimits(limits Limits) {
+	gc.lr.limit = limits.MaxFrameSize
+}
+
+func (gc *gobCodec) Encode(msg Message) (err error) {
+	return Encode(gc.enc, msg)
+}
+
+func (gc *gobCodec) Decode() (msg Message, err error) {
+	return Decode(gc.dec)
+}
+
+///////////////////////////////
+// JSON lines
+///////////////////////////////
+
+// Payloads are already JSON, so they are inlined rather than base64-encoded
+type jsonMessage struct {
+	Type             MessageType
+	Version          ProtocolVersion
+	UnixTimestampUtc int64
+	Payload          json.RawMessage `json:",omitempty"`
+	RequestId        uint64          `json:",omitempty"`
+	ReplyTo          uint64          `json:",omitempty"`
+}
+
+type jsonCodec struct {
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func NewJSONCodec(rw io.ReadWriter) Codec {
+	return &jsonCodec{enc: json.NewEncoder(rw), dec: json.NewDecoder(rw)}
+}
+
+func (jc *jsonCodec) Encode(msg Message) (err error) {
+	if len(msg.Payload) > 0 && !json.Valid(msg.Payload) {
+		return fmt.Errorf("[ERROR] Payload of %s message is not valid JSON\n", msg.Type)
+	}
+
+	// json.Encoder terminates every value with a newline
+	err = jc.enc.Encode(jsonMessage{
+		Type:             msg.Type,
+		Version:          msg.Version,
+		UnixTimestampUtc: msg.UnixTimestampUtc,
+		Payload:          msg.Payload,
+		RequestId:        msg.RequestId,
+		ReplyTo:          msg.ReplyTo,
+	})
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to encode Message as JSON\n\t%w\n", err)
+	}
+	return
+}
+
+func (jc *jsonCodec) Decode() (msg Message, err error) {
+	var jmsg jsonMessage
+	if err = jc.dec.Decode(&jmsg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return msg, io.EOF
+		}
+		return msg, fmt.Errorf("[ERROR] Failed to decode Message from JSON\n\t%w\n", err)
+	}
+
+	msg = Message{
+		Type:             jmsg.Type,
+		Version:          jmsg.Version,
+		UnixTimestampUtc: jmsg.UnixTimestampUtc,
+		Payload:          jmsg.Payload,
+		RequestId:        jmsg.RequestId,
+		ReplyTo:          jmsg.ReplyTo,
+	}
+	return
+}
+
+///////////////////////////////
+// CBOR
+///////////////////////////////
+
+// Encoded as an array in field order: 4 elements, plus RequestId and ReplyTo since Version_1_1_0
+type cborMessage struct {
+	_                struct{} `cbor:",toarray"`
+	Type             MessageType
+	Version          ProtocolVersion
+	UnixTimestampUtc int64
+	Payload          []byte
+}
+
+type cborMessageV1_1 struct {
+	_                struct{} `cbor:",toarray"`
+	Type             MessageType
+	Version          ProtocolVersion
+	UnixTimestampUtc int64
+	Payload          []byte
+	RequestId        uint64
+	ReplyTo          uint64
+}
+
+type cborCodec struct {
+	enc *cbor.Encoder
+	dec *cbor.Decoder
+}
+
+func NewCBORCodec(rw io.ReadWriter) Codec {
+	return &cborCodec{enc: cbor.NewEncoder(rw), dec: cbor.NewDecoder(rw)}
+}
+
+func (cc *cborCodec) Encode(msg Message) (err error) {
+	if msg.Version >= Version_1_1_0 {
+		err = cc.enc.Encode(cborMessageV1_1{
+			Type:             msg.Type,
+			Version:          msg.Version,
+			UnixTimestampUtc: msg.UnixTimestampUtc,
+			Payload:          msg.Payload,
+			RequestId:        msg.RequestId,
+			ReplyTo:          msg.ReplyTo,
+		})
+	} else {
+		err = cc.enc.Encode(cborMessage{
+			Type:             msg.Type,
+			Version:          msg.Version,
+			UnixTimestampUtc: msg.UnixTimestampUtc,
+			Payload:          msg.Payload,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to encode Message as CBOR\n\t%w\n", err)
+	}
+	return
+}
+
+func (cc *cborCodec) Decode() (msg Message, err error) {
+	// The array length tells which layout was sent
+	var raw cbor.RawMessage
+	if err = cc.dec.Decode(&raw); err != nil {
+		if errors.Is(err, io.EOF) {
+			return msg, io.EOF
+		}
+		return msg, fmt.Errorf("[ERROR] Failed to decode Message from CBOR\n\t%w\n", err)
+	}
+
+	var cmsg cborMessageV1_1
+	if err = cbor.Unmarshal(raw, &cmsg); err != nil {
+		var cmsgV1_0 cborMessage
+		if errV1_0 := cbor.Unmarshal(raw, &cmsgV1_0); errV1_0 != nil {
+			return msg, fmt.Errorf("[ERROR] Failed to decode Message from CBOR\n\t%w\n", err)
+		}
+		cmsg = cborMessageV1_1{
+			Type:             cmsgV1_0.Type,
+			Version:          cmsgV1_0.Version,
+			UnixTimestampUtc: cmsgV1_0.UnixTimestampUtc,
+			Payload:          cmsgV1_0.Payload,
+		}
+		err = nil
+	}
+
+	msg = Message{
+		Type:             cmsg.Type,
+		Version:          cmsg.Version,
+		UnixTimestampUtc: cmsg.UnixTimestampUtc,
+		Payload:          cmsg.Payload,
+		RequestId:        cmsg.RequestId,
+		ReplyTo:          cmsg.ReplyTo,
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package msgs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// nil and empty payloads are the same message
+func sameMessage(a Message, b Message) bool {
+	return a.Type == b.Type &&
+		a.Version == b.Version &&
+		a.UnixTimestampUtc == b.UnixTimestampUtc &&
+		bytes.Equal(a.Payload, b.Payload) &&
+		a.RequestId == b.RequestId &&
+		a.ReplyTo == b.ReplyTo
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Type: T_Hello, Version: Version_1_0_0, UnixTimestampUtc: 1760659200, Payload: []byte(`{"MinVersion":0,"MaxVersion":1}`)},
+		{Type: T_Ping, Version: Version_1_0_0, UnixTimestampUtc: -5},
+		{Type: T_ClientGetIPs, Version: Version_1_1_0, UnixTimestampUtc: 1760659200, Payload: []byte(`{"Skids":["a"]}`), RequestId: 3},
+		{Type: T_ServerIPs, Version: Version_1_1_0, UnixTimestampUtc: 1760659201, Payload: []byte(`{"Entries":[]}`), ReplyTo: 3},
+	}
+
+	for framing := range framingCodec {
+		t.Run(framing.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			codec := framing.NewCodec(&buf)
+			for _, msg := range messages {
+				if err := codec.Encode(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Decoded after all were written, so codecs can't lean on lockstep
+			for i, want := range messages {
+				got, err := codec.Decode()
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if !sameMessage(got, want) {
+					t.Fatalf("message %d: got %+v, want %+v", i, got, want)
+				}
+			}
+			if _, err := codec.Decode(); !errors.Is(err, io.EOF) {
+				t.Fatalf("Decode after the last message = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestJSONCodecRejectsInvalidPayload(t *testing.T) {
+	codec := NewJSONCodec(&bytes.Buffer{})
+	msg := Message{Type: T_String, Payload: []byte("not json")}
+	if err := codec.Encode(msg); err == nil {
+		t.Fatal("Encode accepted a payload that is not JSON")
+	}
+}
+
+func TestCBORCodecReadsBothLayouts(t *testing.T) {
+	var buf bytes.Buffer
+	codec := NewCBORCodec(&buf)
+
+	// 1.0.0 has no room for correlation IDs, so they are dropped
+	sent := Message{Type: T_Ping, Version: Version_1_0_0, RequestId: 9, ReplyTo: 8}
+	if err := codec.Encode(sent); err != nil {
+		t.Fatal(err)
+	}
+	got, err := codec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestId != 0 || got.ReplyTo != 0 || got.Type != T_Ping {
+		t.Fatalf("got %+v, want a Ping without correlation IDs", got)
+	}
+}
@@ -0,0 +1,113 @@
+package msgs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+///////////////////////////////
+// Binary frames
+///////////////////////////////
+
+const (
+	FrameMagic      uint16 = 0x4943 // "IC"
+	FrameHeaderSize int    = 16
+	// Since Version_1_1_0, the header is followed by RequestId and ReplyTo
+	FrameHeaderExtSize int = 16
+	// Header of the newest version, which payload limits must leave room for
+	MaxFrameHeaderSize int = FrameHeaderSize + FrameHeaderExtSize
+)
+
+func frameHeaderSize(version ProtocolVersion) int {
+	if version >= Version_1_1_0 {
+		return FrameHeaderSize + FrameHeaderExtSize
+	}
+	return FrameHeaderSize
+}
+
+var ErrBadFrame = errors.New("malformed frame")
+
+type binaryCodec struct {
+	r      io.Reader
+	w      io.Writer
+	limits Limits
+}
+
+func NewBinaryCodec(rw io.ReadWriter) Codec {
+	return &binaryCodec{r: rw, w: rw, limits: DefaultLimits}
+}
+
+func (bc *binaryCodec) SetLimits(limits Limits) {
+	bc.limits = limits
+}
+
+func (bc *binaryCodec) Encode(msg Message) (err error) {
+	if len(msg.Payload) > math.MaxUint32 {
+		return fmt.Errorf("[ERROR] Payload of %d bytes does not fit in a frame: %w", len(msg.Payload), ErrBadFrame)
+	}
+
+	var buf [MaxFrameHeaderSize]byte
+	header := buf[:frameHeaderSize(msg.Version)]
+	binary.BigEndian.PutUint16(header[0:2], FrameMagic)
+	header[2] = byte(msg.Type)
+	header[3] = byte(msg.Version)
+	binary.BigEndian.PutUint64(header[4:12], uint64(msg.UnixTimestampUtc))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(msg.Payload)))
+	if len(header) > FrameHeaderSize {
+		binary.BigEndian.PutUint64(header[16:24], msg.RequestId)
+		binary.BigEndian.PutUint64(header[24:32], msg.ReplyTo)
+	}
+
+	if _, err = bc.w.Write(header); err != nil {
+		return fmt.Errorf("[ERROR] Failed to write frame header\n\t%w\n", err)
+	}
+	if _, err = bc.w.Write(msg.Payload); err != nil {
+		return fmt.Errorf("[ERROR] Failed to write frame payload\n\t%w\n", err)
+	}
+	return
+}
+
+func (bc *binaryCodec) Decode() (msg Message, err error) {
+	var header [FrameHeaderSize]byte
+	if _, err = io.ReadFull(bc.r, header[:]); err != nil {
+		// A clean EOF between frames is a closed connection, not an error
+		if errors.Is(err, io.EOF) {
+			return msg, io.EOF
+		}
+		return msg, fmt.Errorf("[ERROR] Failed to read frame header\n\t%w\n", err)
+	}
+
+	if magic := binary.BigEndian.Uint16(header[0:2]); magic != FrameMagic {
+		return msg, fmt.Errorf("[ERROR] Expected frame magic %#04x, but got %#04x, the peer is likely using another framing: %w", FrameMagic, magic, ErrBadFrame)
+	}
+	msg.Type = MessageType(header[2])
+	msg.Version = ProtocolVersion(header[3])
+	msg.UnixTimestampUtc = int64(binary.BigEndian.Uint64(header[4:12]))
+
+	payloadLen := binary.BigEndian.Uint32(header[12:16])
+
+	headerSize := frameHeaderSize(msg.Version)
+	if headerSize > FrameHeaderSize {
+		var ext [FrameHeaderExtSize]byte
+		if _, err = io.ReadFull(bc.r, ext[:]); err != nil {
+			return msg, fmt.Errorf("[ERROR] Failed to read frame header extension\n\t%w\n", err)
+		}
+		msg.RequestId = binary.BigEndian.Uint64(ext[0:8])
+		msg.ReplyTo = binary.BigEndian.Uint64(ext[8:16])
+	}
+
+	if payloadLen == 0 {
+		return
+	}
+	if uint64(payloadLen) > uint64(bc.limits.MaxPayloadSize) || headerSize+int(payloadLen) > bc.limits.MaxFrameSize {
+		return msg, fmt.Errorf("[ERROR] Frame announces a %s payload of %d bytes, over the limits %+v: %w", msg.Type, payloadLen, bc.limits, ErrMessageTooLarge)
+	}
+	msg.Payload = make([]byte, payloadLen)
+	if _, err = io.ReadFull(bc.r, msg.Payload); err != nil {
+		return msg, fmt.Errorf("[ERROR] Failed to read frame payload of %d bytes\n\t%w\n", payloadLen, err)
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package msgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        Message
+		headerSize int
+	}{
+		{
+			name:       "1.0.0 without payload",
+			msg:        Message{Type: T_Ping, Version: Version_1_0_0, UnixTimestampUtc: 1760659200},
+			headerSize: FrameHeaderSize,
+		},
+		{
+			name:       "1.0.0 drops nothing it can carry",
+			msg:        Message{Type: T_String, Version: Version_1_0_0, UnixTimestampUtc: -1, Payload: []byte(`"hi"`)},
+			headerSize: FrameHeaderSize,
+		},
+		{
+			name: "1.1.0 carries RequestId and ReplyTo",
+			msg: Message{
+				Type: T_ServerIPs, Version: Version_1_1_0, UnixTimestampUtc: 1760659200,
+				Payload: []byte(`{"Entries":[]}`), RequestId: 7, ReplyTo: 1<<64 - 1,
+			},
+			headerSize: FrameHeaderSize + FrameHeaderExtSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			codec := NewBinaryCodec(&buf)
+			if err := codec.Encode(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := buf.Len(), tt.headerSize+len(tt.msg.Payload); got != want {
+				t.Fatalf("encoded %d bytes, want %d", got, want)
+			}
+			if magic := binary.BigEndian.Uint16(buf.Bytes()); magic != FrameMagic {
+				t.Fatalf("magic = %#04x, want %#04x", magic, FrameMagic)
+			}
+
+			got, err := codec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("decoded %+v, want %+v", got, tt.msg)
+			}
+			if _, err = codec.Decode(); !errors.Is(err, io.EOF) {
+				t.Fatalf("Decode after the last frame = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecRejectsOtherFramings(t *testing.T) {
+	// What a gob or JSON peer opens with
+	tests := map[string][]byte{
+		"gob":  {0x3f, 0xff, 0x81, 0x03, 0x01, 0x01, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x01, 0xff},
+		"json": []byte(`{"Type":11,"Version":0,"UnixTimestampUtc":0}` + "\n"),
+	}
+	for name, opening := range tests {
+		t.Run(name, func(t *testing.T) {
+			codec := NewBinaryCodec(bytes.NewBuffer(opening))
+			if _, err := codec.Decode(); !errors.Is(err, ErrBadFrame) {
+				t.Fatalf("Decode = %v, want ErrBadFrame", err)
+			}
+		})
+	}
+}
+
+func TestParseFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Framing
+		wantErr bool
+	}{
+		{"gob", Framing_Gob, false},
+		{"binary", Framing_Binary, false},
+		{"json", Framing_JSON, false},
+		{"cbor", Framing_CBOR, false},
+		{"protobuf", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFraming(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFraming(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got != tt.want || got.String() != tt.name) {
+			t.Errorf("ParseFraming(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package msgs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Upper bounds on what a Messenger will read from, or write to, its peer.
+// A frame is everything a Codec puts on the wire for one Message, payload included.
+type Limits struct {
+	MaxFrameSize   int
+	MaxPayloadSize int
+}
+
+// Codecs read ahead by up to one buffer, so smaller frame limits would trip on well-behaved peers
+const MinFrameSize int = 4096
+
+var DefaultLimits = Limits{
+	MaxFrameSize:   1 << 20,
+	MaxPayloadSize: 1<<20 - MaxFrameHeaderSize,
+}
+
+var ErrMessageTooLarge = errors.New("message too large")
+
+func (l Limits) Validate() (err error) {
+	switch {
+	case l.MaxFrameSize < MinFrameSize:
+		return fmt.Errorf("[ERROR] Max frame size must be at least %d bytes, but got %d", MinFrameSize, l.MaxFrameSize)
+	case l.MaxPayloadSize < 1:
+		return fmt.Errorf("[ERROR] Max payload size must be positive, but got %d", l.MaxPayloadSize)
+	case l.MaxPayloadSize > l.MaxFrameSize-MaxFrameHeaderSize:
+		return fmt.Errorf("[ERROR] Max payload size (%d) cannot exceed the max frame size (%d) less a %d byte header", l.MaxPayloadSize, l.MaxFrameSize, MaxFrameHeaderSize)
+	}
+	return
+}
+
+func (l Limits) checkPayload(msg Message) (err error) {
+	if len(msg.Payload) > l.MaxPayloadSize {
+		return fmt.Errorf("[ERROR] %s payload of %d bytes exceeds the limit of %d bytes: %w", msg.Type, len(msg.Payload), l.MaxPayloadSize, ErrMessageTooLarge)
+	}
+	return
+}
+
+// Implemented by Codecs that can reject an oversized frame before allocating it
+type LimitedCodec interface {
+	Codec
+	SetLimits(limits Limits)
+}
+
+// Caps how many bytes a Codec can pull off the connection while decoding one Message.
+// The Messenger calls reset before every Decode.
+type frameLimitReader struct {
+	r     io.Reader
+	limit int
+	nread int
+}
+
+func (fr *frameLimitReader) reset() {
+	fr.nread = 0
+}
+
+func (fr *frameLimitReader) Read(p []byte) (n int, err error) {
+	remaining := fr.limit - fr.nread
+	if remaining <= 0 {
+		return 0, fmt.Errorf("[ERROR] Frame exceeds the limit of %d bytes: %w", fr.limit, ErrMessageTooLarge)
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err = fr.r.Read(p)
+	fr.nread += n
+	return
+}
+
+// Sits between a gob.Decoder and the connection, and checks the length prefix of
+// every gob message before the decoder gets to allocate a buffer for it
+type gobLimitReader struct {
+	r         *bufio.Reader
+	limit     int
+	remaining int
+}
+
+func (gr *gobLimitReader) Read(p []byte) (n int, err error) {
+	if gr.remaining == 0 {
+		size, prefixLen, err := gr.peekMessageSize()
+		if err != nil {
+			return 0, err
+		}
+		if size > uint64(gr.limit) {
+			return 0, fmt.Errorf("[ERROR] gob message of %d bytes exceeds the limit of %d bytes: %w", size, gr.limit, ErrMessageTooLarge)
+		}
+		gr.remaining = prefixLen + int(size)
+	}
+
+	if len(p) > gr.remaining {
+		p = p[:gr.remaining]
+	}
+	n, err = gr.r.Read(p)
+	gr.remaining -= n
+	return
+}
+
+// gob prefixes each message with its length as a gob uint: a single byte below 0x80,
+// otherwise a byte holding the negated count of big-endian bytes that follow
+func (gr *gobLimitReader) peekMessageSize() (size uint64, prefixLen int, err error) {
+	first, err := gr.r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] < 0x80 {
+		return uint64(first[0]), 1, err
+	}
+
+	nbytes := -int(int8(first[0]))
+	if nbytes > 8 {
+		return size, prefixLen, fmt.Errorf("[ERROR] Invalid gob length prefix %#02x", first[0])
+	}
+	prefix, err := gr.r.Peek(1 + nbytes)
+	if err != nil {
+		return
+	}
+	for _, b := range prefix[1:] {
+		size = size<<8 | uint64(b)
+	}
+	return size, 1 + nbytes, err
+}
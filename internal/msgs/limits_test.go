@@ -0,0 +1,174 @@
+package msgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr bool
+	}{
+		{"defaults", DefaultLimits, false},
+		{"smallest frame", Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: 1}, false},
+		{"frame under the minimum", Limits{MaxFrameSize: MinFrameSize - 1, MaxPayloadSize: 1}, true},
+		{"no payload", Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: 0}, true},
+		{"payload over the frame", Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: MinFrameSize + 1}, true},
+		{"largest payload", Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: MinFrameSize - MaxFrameHeaderSize}, false},
+		{"no room for the 1.1.0 header", Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: MinFrameSize - FrameHeaderSize}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.limits.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// A String message whose JSON payload is `size` bytes long
+func stringOfSize(t *testing.T, size int) Message {
+	t.Helper()
+	msg := StringJSON(strings.Repeat("x", size-2))
+	if len(msg.Payload) != size {
+		t.Fatalf("payload is %d bytes, want %d", len(msg.Payload), size)
+	}
+	return msg
+}
+
+func TestSendRefusesOversizedPayload(t *testing.T) {
+	clientConn, _ := tlsPipe(t)
+	client := NewMessengerWithFraming(clientConn, Framing_Binary)
+	if err := client.SetLimits(Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send(stringOfSize(t, 101)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Send = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestReceiveRefusesOversizedMessage(t *testing.T) {
+	maxPayload := MinFrameSize - MaxFrameHeaderSize
+	tests := []struct {
+		name   string
+		limits Limits
+		size   int
+		// Only framings whose envelope takes more than a binary header can
+		// go over the frame limit with a payload under its own
+		framings []Framing
+	}{
+		{
+			name:     "payload",
+			limits:   Limits{MaxFrameSize: 2 * MinFrameSize, MaxPayloadSize: 100},
+			size:     101,
+			framings: []Framing{Framing_Gob, Framing_Binary, Framing_JSON, Framing_CBOR},
+		},
+		{
+			name:     "frame",
+			limits:   Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: maxPayload},
+			size:     maxPayload,
+			framings: []Framing{Framing_Gob, Framing_JSON},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, framing := range tt.framings {
+			t.Run(framing.String()+"/"+tt.name, func(t *testing.T) {
+				clientConn, serverConn := tlsPipe(t)
+				client := NewMessengerWithFraming(clientConn, framing)
+				server := NewMessengerWithFraming(serverConn, framing)
+				if err := server.SetLimits(tt.limits); err != nil {
+					t.Fatal(err)
+				}
+
+				msg := stringOfSize(t, tt.size)
+				sent := make(chan error, 1)
+				go func() { sent <- client.Send(msg) }()
+
+				if _, err := server.Receive(); !errors.Is(err, ErrMessageTooLarge) {
+					t.Fatalf("Receive = %v, want ErrMessageTooLarge", err)
+				}
+				serverConn.Close()
+				<-sent
+			})
+		}
+	}
+}
+
+func TestBinaryCodecChecksHeaderBeforeReading(t *testing.T) {
+	// Announces a payload far over the limit, without sending it
+	var buf bytes.Buffer
+	if err := NewBinaryCodec(&buf).Encode(Message{Type: T_String, Payload: []byte(`""`)}); err != nil {
+		t.Fatal(err)
+	}
+	frame := buf.Bytes()
+	frame[12], frame[13], frame[14], frame[15] = 0x7f, 0xff, 0xff, 0xff
+
+	codec := NewBinaryCodec(bytes.NewBuffer(frame[:FrameHeaderSize])).(LimitedCodec)
+	codec.SetLimits(Limits{MaxFrameSize: MinFrameSize, MaxPayloadSize: MinFrameSize - MaxFrameHeaderSize})
+	if _, err := codec.Decode(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Decode = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestGobLimitReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"small", 100, false},
+		{"multi-byte length prefix", 1000, false},
+		{"over the limit", 3 * MinFrameSize, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			want := stringOfSize(t, tt.size)
+			if err := NewGobCodec(&buf).Encode(want); err != nil {
+				t.Fatal(err)
+			}
+
+			codec := NewGobCodec(&buf).(LimitedCodec)
+			codec.SetLimits(Limits{MaxFrameSize: 2 * MinFrameSize, MaxPayloadSize: 2*MinFrameSize - MaxFrameHeaderSize})
+			got, err := codec.Decode()
+			if tt.wantErr {
+				if !errors.Is(err, ErrMessageTooLarge) {
+					t.Fatalf("Decode = %v, want ErrMessageTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var text string
+			if err = json.Unmarshal(got.Payload, &text); err != nil || len(text) != tt.size-2 {
+				t.Fatalf("decoded %d characters, %v, want %d", len(text), err, tt.size-2)
+			}
+		})
+	}
+}
+
+func TestLargestPayloadFitsEveryHeader(t *testing.T) {
+	for _, version := range []ProtocolVersion{Version_1_0_0, Version_1_1_0} {
+		t.Run(version.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			msg := stringOfSize(t, DefaultLimits.MaxPayloadSize)
+			msg.Version = version
+			if err := NewBinaryCodec(&buf).Encode(msg); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() > DefaultLimits.MaxFrameSize {
+				t.Fatalf("frame of %d bytes is over the default limit of %d", buf.Len(), DefaultLimits.MaxFrameSize)
+			}
+			if _, err := NewBinaryCodec(&buf).Decode(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
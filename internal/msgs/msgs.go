@@ -2,15 +2,19 @@ package msgs
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,8 @@ type MessageType uint8
 
 const (
 	Version_1_0_0 ProtocolVersion = iota
+	// Adds Message.RequestId and Message.ReplyTo
+	Version_1_1_0
 )
 
 const (
@@ -34,6 +40,24 @@ const (
 
 	T_ClientGrantAuthorization
 	T_ClientRevokeAuthorization
+
+	T_ServerIPs
+	T_ServerRegistered
+
+	T_Hello
+	T_HelloAck
+
+	T_ClientSubscribe
+	T_ClientUnsubscribe
+	T_ServerIPChanged
+
+	T_ClientWhoAmI
+	T_ServerWhoAmI
+
+	T_ClientGetServices
+	T_ServerServices
+
+	T_ServerShutdown
 )
 
 var messageTypeName = map[MessageType]string{
@@ -49,25 +73,73 @@ var messageTypeName = map[MessageType]string{
 
 	T_ClientGrantAuthorization:  "ClientGrantAuthorization",
 	T_ClientRevokeAuthorization: "ClientRevokeAuthorization",
+
+	T_ServerIPs:        "ServerIPs",
+	T_ServerRegistered: "ServerRegistered",
+
+	T_Hello:    "Hello",
+	T_HelloAck: "HelloAck",
+
+	T_ClientSubscribe:   "ClientSubscribe",
+	T_ClientUnsubscribe: "ClientUnsubscribe",
+	T_ServerIPChanged:   "ServerIPChanged",
+
+	T_ClientWhoAmI: "ClientWhoAmI",
+	T_ServerWhoAmI: "ServerWhoAmI",
+
+	T_ClientGetServices: "ClientGetServices",
+	T_ServerServices:    "ServerServices",
+
+	T_ServerShutdown: "ServerShutdown",
 }
 
 func (mt MessageType) String() string {
 	return messageTypeName[mt]
 }
 
-var DefaultVersion ProtocolVersion = Version_1_0_0
+// What the server answers each request with, besides Err. Requests missing
+// here are answered with Ok.
+var replyTypes = map[MessageType]MessageType{
+	T_Ping:              T_Pong,
+	T_DaemonRegister:    T_ServerRegistered,
+	T_ClientGetIPs:      T_ServerIPs,
+	T_Hello:             T_HelloAck,
+	T_ClientWhoAmI:      T_ServerWhoAmI,
+	T_ClientGetServices: T_ServerServices,
+}
+
+// Whether a message of type `reply` can answer a request of type `req`, so
+// that unsolicited messages are not taken for replies before Version_1_1_0
+func IsReplyTo(reply MessageType, req MessageType) bool {
+	if reply == T_Err {
+		return true
+	}
+	if want, ok := replyTypes[req]; ok {
+		return reply == want
+	}
+	return reply == T_Ok
+}
+
+var DefaultVersion ProtocolVersion = Version_1_1_0
 
 type Message struct {
 	Type             MessageType
 	Version          ProtocolVersion
 	UnixTimestampUtc int64
 	Payload          []byte
+
+	// Since Version_1_1_0, zero means unset.
+	// A response carries the RequestId of its request in ReplyTo.
+	RequestId uint64
+	ReplyTo   uint64
 }
 
 var emptyMsg Message
 var msgStaticSize int = binary.Size(emptyMsg.Type) +
 	binary.Size(emptyMsg.Version) +
-	binary.Size(emptyMsg.UnixTimestampUtc)
+	binary.Size(emptyMsg.UnixTimestampUtc) +
+	binary.Size(emptyMsg.RequestId) +
+	binary.Size(emptyMsg.ReplyTo)
 
 func (m *Message) Size() int {
 	return msgStaticSize + binary.Size(m.Payload)
@@ -98,6 +170,11 @@ func Ping() Message {
 	return NewMessage(T_Ping)
 }
 
+// A Ping stamped with `sent`, which the Pong echoes back
+func PingAt(sent time.Time) (Message, error) {
+	return Marshal(T_Ping, PingPayload{SentUnixNano: sent.UnixNano()})
+}
+
 func Pong() Message {
 	return NewMessage(T_Pong)
 }
@@ -106,12 +183,24 @@ func DaemonRegister() Message {
 	return NewMessage(T_DaemonRegister)
 }
 
+func WhoAmI() Message {
+	return NewMessage(T_ClientWhoAmI)
+}
+
+// Sends `data` as is, as every version has
 func String(data string) Message {
 	msg := NewMessage(T_String)
 	msg.Payload = []byte(data)
 	return msg
 }
 
+// Sends `data` as a JSON string, for framings that only carry JSON payloads
+func StringJSON(data string) Message {
+	msg := NewMessage(T_String)
+	msg.Payload, _ = json.Marshal(data)
+	return msg
+}
+
 func Encode(enc *gob.Encoder, msg Message) (err error) {
 	err = enc.Encode(&msg)
 	if err != nil {
@@ -134,8 +223,11 @@ func Decode(dec *gob.Decoder) (msg Message, err error) {
 
 type Client struct {
 	// Hmmmm not sure what fields are needed yet
-	Id string
-	IP net.IP
+	Id   string
+	IP   net.IP
+	Port int
+	// Subject of the certificate the client authenticated with
+	Subject string
 }
 
 func ConnIP(conn *tls.Conn) (ip net.IP, err error) {
@@ -151,19 +243,34 @@ func ConnIP(conn *tls.Conn) (ip net.IP, err error) {
 	}
 }
 
+func ConnPort(conn *tls.Conn) (port int, err error) {
+	switch x := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return x.Port, err
+	case *net.UDPAddr:
+		return x.Port, err
+	default:
+		return 0, fmt.Errorf("The TLS connection using the address <%s> wasn't using a net.Addr that has a port", x.String())
+	}
+}
+
 func ConnId(conn *tls.Conn) (id string, err error) {
 	certs := conn.ConnectionState().PeerCertificates
 	if len(certs) < 1 {
 		return id, errors.New("PeerCertificates is empty, none were given by client")
 	}
 
-	cert := certs[0]
-	skid := base64.StdEncoding.EncodeToString(cert.SubjectKeyId)
+	skid := CertId(certs[0])
 	//log.Printf("[INFO] The subject key id from conn's cert: %+v\n", skid)
 
 	return skid, err
 }
 
+// The SKID that identifies the owner of `cert`, as seen by the server
+func CertId(cert *x509.Certificate) string {
+	return base64.StdEncoding.EncodeToString(cert.SubjectKeyId)
+}
+
 func NewClient(conn *tls.Conn) (client Client, err error) {
 	skid, err := ConnId(conn)
 	if err != nil {
@@ -176,7 +283,16 @@ func NewClient(conn *tls.Conn) (client Client, err error) {
 		log.Println(err)
 		return client, err
 	}
-	return Client{Id: skid, IP: ip}, err
+
+	port, err := ConnPort(conn)
+	if err != nil {
+		log.Println(err)
+		return client, err
+	}
+
+	// ConnId has already checked there is at least one
+	subject := conn.ConnectionState().PeerCertificates[0].Subject.String()
+	return Client{Id: skid, IP: ip, Port: port, Subject: subject}, err
 }
 
 type Messenger interface {
@@ -184,6 +300,25 @@ type Messenger interface {
 	SendN(msg Message) (n int, err error)
 	Receive() (msg Message, err error)
 
+	// Once set, outgoing messages are stamped with `version` and incoming messages must match it
+	SetVersion(version ProtocolVersion)
+	Version() (version ProtocolVersion, negotiated bool)
+
+	// Messages over the limits are refused on Send, and fail Receive before being allocated
+	SetLimits(limits Limits) (err error)
+
+	// Sends `msg` under a fresh RequestId and waits for the message replying to it.
+	// Messages that reply to nothing are handed to Unsolicited() in the meantime.
+	// Before Version_1_1_0 there is nothing to match on, so the reply is the next
+	// message of a type that can answer `msg`, see IsReplyTo.
+	Call(ctx context.Context, msg Message) (reply Message, err error)
+	// Sends `resp` as the reply to `req`
+	Reply(req Message, resp Message) (err error)
+	Unsolicited() <-chan Message
+
+	// Closes the underlying connection
+	Close() (err error)
+
 	SetDeadline(deadline time.Time) (err error)
 	SetReadDeadline(deadline time.Time) (err error)
 	SetWriteDeadline(deadline time.Time) (err error)
@@ -196,12 +331,48 @@ type Messenger interface {
 type blockingMessenger struct {
 	conn   *tls.Conn
 	connrw *bufio.ReadWriter
-	enc    *gob.Encoder
-	dec    *gob.Decoder
+	codec  Codec
+
+	limits Limits
+	lr     *frameLimitReader
+
+	version    ProtocolVersion
+	negotiated bool
+
+	lastRequestId atomic.Uint64
+	unsolicited   chan Message
+}
+
+func (bm *blockingMessenger) SetLimits(limits Limits) (err error) {
+	if err = limits.Validate(); err != nil {
+		return err
+	}
+
+	bm.limits = limits
+	bm.lr.limit = limits.MaxFrameSize
+	if lc, ok := bm.codec.(LimitedCodec); ok {
+		lc.SetLimits(limits)
+	}
+	return
+}
+
+func (bm *blockingMessenger) SetVersion(version ProtocolVersion) {
+	bm.version = version
+	bm.negotiated = true
+}
+
+func (bm *blockingMessenger) Version() (version ProtocolVersion, negotiated bool) {
+	return bm.version, bm.negotiated
 }
 
 func (bm *blockingMessenger) Send(msg Message) (err error) {
-	if err = Encode(bm.enc, msg); err != nil {
+	if err = bm.limits.checkPayload(msg); err != nil {
+		return err
+	}
+	if bm.negotiated {
+		stampVersion(&msg, bm.version)
+	}
+	if err = bm.codec.Encode(msg); err != nil {
 		return fmt.Errorf("[ERROR] Messenger failed to Encode the message\n\t%w\n", err)
 	}
 	if err = bm.connrw.Flush(); err != nil {
@@ -212,7 +383,13 @@ func (bm *blockingMessenger) Send(msg Message) (err error) {
 
 func (bm *blockingMessenger) SendN(msg Message) (n int, err error) {
 	n = 0
-	if err = Encode(bm.enc, msg); err != nil {
+	if err = bm.limits.checkPayload(msg); err != nil {
+		return n, err
+	}
+	if bm.negotiated {
+		stampVersion(&msg, bm.version)
+	}
+	if err = bm.codec.Encode(msg); err != nil {
 		return n, fmt.Errorf("[ERROR] Messenger failed to Encode the message\n\t%w\n", err)
 	}
 
@@ -225,9 +402,16 @@ func (bm *blockingMessenger) SendN(msg Message) (n int, err error) {
 }
 
 func (bm *blockingMessenger) Receive() (msg Message, err error) {
-	msg, err = Decode(bm.dec)
+	bm.lr.reset()
+	msg, err = bm.codec.Decode()
 	switch {
 	case err == nil:
+		if err = bm.limits.checkPayload(msg); err != nil {
+			return
+		}
+		if bm.negotiated {
+			err = checkVersion(msg, bm.version)
+		}
 		return
 	case errors.Is(err, io.EOF):
 		return
@@ -236,6 +420,63 @@ func (bm *blockingMessenger) Receive() (msg Message, err error) {
 	}
 }
 
+func (bm *blockingMessenger) Call(ctx context.Context, msg Message) (reply Message, err error) {
+	msg.RequestId = bm.lastRequestId.Add(1)
+	if err = bm.Send(msg); err != nil {
+		return
+	}
+	correlated := bm.negotiated && bm.version >= Version_1_1_0
+
+	// Unblock Receive once ctx is done. The connection is unusable after that,
+	// since the read may have stopped in the middle of a message.
+	stop := context.AfterFunc(ctx, func() {
+		bm.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		reply, err = bm.Receive()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return reply, fmt.Errorf("[ERROR] Call for %s was cancelled\n\t%w\n", msg.Type, ctxErr)
+			}
+			return
+		}
+
+		switch {
+		case !correlated && IsReplyTo(reply.Type, msg.Type):
+			return
+		case correlated && reply.ReplyTo == msg.RequestId:
+			return
+		case reply.ReplyTo == 0:
+			bm.pushUnsolicited(reply)
+		default:
+			log.Printf("[INFO] Dropping %s replying to stale request %d\n", reply.Type, reply.ReplyTo)
+		}
+	}
+}
+
+func (bm *blockingMessenger) Reply(req Message, resp Message) (err error) {
+	resp.ReplyTo = req.RequestId
+	return bm.Send(resp)
+}
+
+func (bm *blockingMessenger) Unsolicited() <-chan Message {
+	return bm.unsolicited
+}
+
+func (bm *blockingMessenger) pushUnsolicited(msg Message) {
+	select {
+	case bm.unsolicited <- msg:
+	default:
+		log.Printf("[ERROR] Unsolicited queue is full, dropping %s\n", msg.Type)
+	}
+}
+
+func (bm *blockingMessenger) Close() (err error) {
+	return bm.conn.Close()
+}
+
 func (bm *blockingMessenger) SetReadTimeout(timeout time.Duration) (err error) {
 	err = bm.conn.SetReadDeadline(time.Now().Add(timeout))
 	if err != nil {
@@ -280,14 +521,36 @@ func (bm *blockingMessenger) SetDeadline(deadline time.Time) (err error) {
 	return err
 }
 
+// Unsolicited messages beyond this are dropped until the queue is drained
+const UnsolicitedQueueSize = 64
+
+// Uses the legacy gob framing
 func NewMessenger(conn *tls.Conn) Messenger {
+	return NewMessengerWithFraming(conn, Framing_Gob)
+}
+
+func NewMessengerWithFraming(conn *tls.Conn, framing Framing) Messenger {
+	return NewMessengerWithCodec(conn, framing.NewCodec)
+}
+
+func NewMessengerWithCodec(conn *tls.Conn, newCodec NewCodecFunc) Messenger {
 	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
 	connrw := bufio.NewReadWriter(r, w)
 
+	// Codecs only see the connection through the frame limit
+	lr := &frameLimitReader{r: connrw, limit: DefaultLimits.MaxFrameSize}
+	codecrw := struct {
+		io.Reader
+		io.Writer
+	}{lr, connrw}
+
 	return &blockingMessenger{
 		conn:   conn,
 		connrw: connrw,
-		enc:    gob.NewEncoder(connrw),
-		dec:    gob.NewDecoder(connrw),
+		codec:  newCodec(codecrw),
+		limits: DefaultLimits,
+		lr:     lr,
+
+		unsolicited: make(chan Message, UnsolicitedQueueSize),
 	}
 }
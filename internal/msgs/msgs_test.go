@@ -0,0 +1,142 @@
+package msgs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Both ends of one connection, at `version`
+func messengerPair(t *testing.T, version ProtocolVersion) (client Messenger, server Messenger) {
+	t.Helper()
+
+	clientConn, serverConn := tlsPipe(t)
+	client = NewMessengerWithFraming(clientConn, Framing_Binary)
+	server = NewMessengerWithFraming(serverConn, Framing_Binary)
+
+	client.SetVersion(version)
+	server.SetVersion(version)
+	return client, server
+}
+
+func callAsync(client Messenger, msg Message) (replies chan Message, errs chan error) {
+	replies, errs = make(chan Message, 1), make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reply, err := client.Call(ctx, msg)
+		replies <- reply
+		errs <- err
+	}()
+	return
+}
+
+func receiveType(t *testing.T, server Messenger, want MessageType) Message {
+	t.Helper()
+	msg, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != want {
+		t.Fatalf("server received %s, want %s", msg.Type, want)
+	}
+	return msg
+}
+
+func TestIsReplyTo(t *testing.T) {
+	tests := []struct {
+		reply MessageType
+		req   MessageType
+		want  bool
+	}{
+		{T_Pong, T_Ping, true},
+		{T_Err, T_Ping, true},
+		{T_ServerIPs, T_ClientGetIPs, true},
+		{T_Ok, T_ClientSubscribe, true},
+		{T_Ok, T_ClientGrantAuthorization, true},
+		{T_ServerWhoAmI, T_ClientWhoAmI, true},
+		{T_ServerServices, T_ClientGetServices, true},
+		{T_String, T_ClientGetIPs, false},
+		{T_ServerIPChanged, T_ClientGetIPs, false},
+		{T_ServerShutdown, T_Ping, false},
+		{T_Ok, T_ClientGetIPs, false},
+		{T_ServerIPs, T_ClientSubscribe, false},
+	}
+	for _, tt := range tests {
+		if got := IsReplyTo(tt.reply, tt.req); got != tt.want {
+			t.Errorf("IsReplyTo(%s, %s) = %v, want %v", tt.reply, tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestCallCorrelatesByRequestId(t *testing.T) {
+	client, server := messengerPair(t, Version_1_1_0)
+
+	replies, errs := callAsync(client, Ping())
+	ping := receiveType(t, server, T_Ping)
+	if ping.RequestId == 0 {
+		t.Fatal("1.1.0 Ping carries no RequestId")
+	}
+
+	// A notification and a reply to an older request come first
+	if err := server.Send(String("notification")); err != nil {
+		t.Fatal(err)
+	}
+	stale := Pong()
+	stale.ReplyTo = ping.RequestId + 1
+	if err := server.Send(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Reply(ping, Pong()); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := <-replies; <-errs != nil || reply.Type != T_Pong || reply.ReplyTo != ping.RequestId {
+		t.Fatalf("Call got %s replying to %d, want Pong replying to %d", reply.Type, reply.ReplyTo, ping.RequestId)
+	}
+	select {
+	case msg := <-client.Unsolicited():
+		if msg.Type != T_String {
+			t.Fatalf("unsolicited %s, want String", msg.Type)
+		}
+	default:
+		t.Fatal("notification never reached Unsolicited")
+	}
+}
+
+// Before 1.1.0 nothing says what a message replies to, so Call goes by its type
+func TestCallSkipsUnsolicitedBeforeV1_1_0(t *testing.T) {
+	for name, newPair := range map[string]func(t *testing.T, version ProtocolVersion) (Messenger, Messenger){
+		"async":    asyncPair,
+		"blocking": messengerPair,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server := newPair(t, Version_1_0_0)
+
+			replies, errs := callAsync(client, Ping())
+			ping := receiveType(t, server, T_Ping)
+			if ping.RequestId != 0 {
+				t.Fatalf("1.0.0 Ping carries RequestId %d", ping.RequestId)
+			}
+
+			if err := server.Send(String("notification")); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.Send(Pong()); err != nil {
+				t.Fatal(err)
+			}
+
+			if reply := <-replies; <-errs != nil || reply.Type != T_Pong {
+				t.Fatalf("Call got %s, want Pong", reply.Type)
+			}
+			select {
+			case msg := <-client.Unsolicited():
+				if msg.Type != T_String {
+					t.Fatalf("unsolicited %s, want String", msg.Type)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("notification never reached Unsolicited")
+			}
+		})
+	}
+}
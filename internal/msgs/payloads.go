@@ -0,0 +1,347 @@
+package msgs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+)
+
+// Payloads are JSON-encoded, so that they can be read without knowing Go's types.
+// Every MessageType maps to exactly one payload type; nil means the message carries no payload.
+var payloadTypes = map[MessageType]reflect.Type{
+	T_Ok:     reflect.TypeFor[OkPayload](),
+	T_Err:    reflect.TypeFor[ErrorPayload](),
+	T_String: reflect.TypeFor[string](),
+
+	T_Ping: reflect.TypeFor[PingPayload](),
+	T_Pong: reflect.TypeFor[PongPayload](),
+
+	T_DaemonRegister: reflect.TypeFor[RegisterRequest](),
+	T_ClientGetIPs:   reflect.TypeFor[GetIPsRequest](),
+
+	T_ClientGrantAuthorization:  reflect.TypeFor[GrantRequest](),
+	T_ClientRevokeAuthorization: reflect.TypeFor[GrantRequest](),
+
+	T_ServerIPs:        reflect.TypeFor[GetIPsResponse](),
+	T_ServerRegistered: reflect.TypeFor[RegisterResponse](),
+
+	T_Hello:    reflect.TypeFor[HelloPayload](),
+	T_HelloAck: reflect.TypeFor[HelloAckPayload](),
+
+	T_ClientSubscribe:   reflect.TypeFor[SubscribeRequest](),
+	T_ClientUnsubscribe: reflect.TypeFor[SubscribeRequest](),
+	T_ServerIPChanged:   reflect.TypeFor[IPChangedNotification](),
+
+	T_ClientWhoAmI: nil,
+	T_ServerWhoAmI: reflect.TypeFor[WhoAmIResponse](),
+
+	T_ClientGetServices: reflect.TypeFor[GetServicesRequest](),
+	T_ServerServices:    reflect.TypeFor[GetServicesResponse](),
+
+	T_ServerShutdown: reflect.TypeFor[ShutdownNotice](),
+}
+
+// Builds a new Message of type `msgT` carrying `payload`, which must have the payload type registered for `msgT`
+func Marshal(msgT MessageType, payload any) (msg Message, err error) {
+	msg = NewMessage(msgT)
+
+	want, ok := payloadTypes[msgT]
+	if !ok {
+		return msg, fmt.Errorf("[ERROR] No payload type registered for MessageType %d\n", msgT)
+	}
+	if want == nil {
+		if payload != nil {
+			return msg, fmt.Errorf("[ERROR] MessageType %s takes no payload, but got %T\n", msgT, payload)
+		}
+		return
+	}
+	if got := reflect.TypeOf(payload); got != want {
+		return msg, fmt.Errorf("[ERROR] MessageType %s takes a payload of type %v, but got %v\n", msgT, want, got)
+	}
+
+	msg.Payload, err = json.Marshal(payload)
+	if err != nil {
+		return msg, fmt.Errorf("[ERROR] Failed to marshal %s payload\n\t%w\n", msgT, err)
+	}
+	return
+}
+
+// Decodes the payload of `msg` into `payload`, which must be a pointer to the payload type registered for `msg.Type`.
+// An empty payload leaves `payload` untouched, so a payload type can be given to a MessageType that had none.
+func Unmarshal(msg Message, payload any) (err error) {
+	want, ok := payloadTypes[msg.Type]
+	if !ok {
+		return fmt.Errorf("[ERROR] No payload type registered for MessageType %d\n", msg.Type)
+	}
+	if want == nil {
+		if len(msg.Payload) != 0 {
+			return fmt.Errorf("[ERROR] MessageType %s takes no payload, but got %d bytes\n", msg.Type, len(msg.Payload))
+		}
+		return
+	}
+	if got := reflect.TypeOf(payload); got != reflect.PointerTo(want) {
+		return fmt.Errorf("[ERROR] MessageType %s unmarshals into %v, but got %v\n", msg.Type, reflect.PointerTo(want), got)
+	}
+	if len(msg.Payload) == 0 {
+		return
+	}
+
+	if err = json.Unmarshal(msg.Payload, payload); err != nil {
+		// Sent as is by String, rather than JSON-encoded by StringJSON
+		if msg.Type == T_String {
+			*payload.(*string) = string(msg.Payload)
+			return nil
+		}
+		return fmt.Errorf("[ERROR] Failed to unmarshal %s payload\n\t%w\n", msg.Type, err)
+	}
+	return
+}
+
+///////////////////////////////
+// Ok, Err
+///////////////////////////////
+
+type OkPayload struct {
+	Message string
+}
+
+type ErrorCode uint16
+
+const (
+	ErrC_Unknown ErrorCode = iota
+	ErrC_BadRequest
+	ErrC_NotAuthorized
+	ErrC_NotFound
+	ErrC_Conflict
+	ErrC_Internal
+	ErrC_UnsupportedVersion
+	ErrC_MessageTooLarge
+	ErrC_InvalidState
+	ErrC_RateLimited
+	ErrC_TooManyConnections
+)
+
+var errorCodeName = map[ErrorCode]string{
+	ErrC_Unknown:       "Unknown",
+	ErrC_BadRequest:    "BadRequest",
+	ErrC_NotAuthorized: "NotAuthorized",
+	ErrC_NotFound:      "NotFound",
+	ErrC_Conflict:      "Conflict",
+	ErrC_Internal:      "Internal",
+
+	ErrC_UnsupportedVersion: "UnsupportedVersion",
+	ErrC_MessageTooLarge:    "MessageTooLarge",
+	ErrC_InvalidState:       "InvalidState",
+	ErrC_RateLimited:        "RateLimited",
+	ErrC_TooManyConnections: "TooManyConnections",
+}
+
+func (ec ErrorCode) String() string {
+	return errorCodeName[ec]
+}
+
+// Structured reason carried by an Err message
+type ErrorPayload struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (ep ErrorPayload) Error() string {
+	return fmt.Sprintf("%s: %s", ep.Code, ep.Message)
+}
+
+func OkMessage(message string) (msg Message, err error) {
+	return Marshal(T_Ok, OkPayload{Message: message})
+}
+
+func ErrorMessage(code ErrorCode, message string) (msg Message, err error) {
+	return Marshal(T_Err, ErrorPayload{Code: code, Message: message})
+}
+
+///////////////////////////////
+// Ping, Pong
+///////////////////////////////
+
+// Optional; a Ping without a payload is still answered
+type PingPayload struct {
+	// Sender's clock when the Ping was sent
+	SentUnixNano int64
+}
+
+type PongPayload struct {
+	// SentUnixNano of the Ping being answered, echoed back as is
+	PingSentUnixNano int64
+	// Server's clock when the Pong was sent
+	ServerUnixNano int64
+}
+
+///////////////////////////////
+// Hello, HelloAck
+///////////////////////////////
+
+// Inclusive range of protocol versions the sender can speak
+type HelloPayload struct {
+	MinVersion ProtocolVersion
+	MaxVersion ProtocolVersion
+}
+
+type HelloAckPayload struct {
+	Version ProtocolVersion
+}
+
+///////////////////////////////
+// DaemonRegister
+///////////////////////////////
+
+// Optional; DaemonRegister without a payload asks for the server defaults
+type RegisterRequest struct {
+	// How long the server keeps the entry after the daemon was last seen.
+	// Zero for the server default; the server caps it at its own maximum.
+	TTL time.Duration
+	// Other addresses the daemon can be reached at. The server always adds
+	// the one it sees the connection come from, and fills in Family and Scope.
+	Addrs []Address `json:",omitempty"`
+	// Services the daemon offers, replacing those of its last registration
+	Services []ServiceRecord `json:",omitempty"`
+}
+
+type RegisterResponse struct {
+	// Max time the server waits between pings before killing the connection
+	PingTimeout time.Duration
+	ServerTime  int64
+	// TTL the server actually applies to the entry
+	TTL time.Duration
+}
+
+///////////////////////////////
+// ClientGetIPs
+///////////////////////////////
+
+// An empty list of SKIDs asks for every IP the client is authorized to get
+type GetIPsRequest struct {
+	Skids []string
+}
+
+func (r GetIPsRequest) TargetSkids() []string {
+	return r.Skids
+}
+
+// An entry of the server's registrar
+type IPEntry struct {
+	Skid             string
+	UnixTimestampUtc int64
+	IP               net.IP
+
+	// Whether the daemon is connected right now; if not, IP may be stale
+	Online            bool
+	LastPingUtc       int64
+	ConnectedSinceUtc int64
+	// Zero while online
+	DisconnectedAtUtc int64
+	// Once past, and the daemon is offline, the entry is marked Expired and
+	// later purged. Pings and reconnects push it back.
+	ExpiresAtUtc int64
+	Expired      bool
+
+	// Every registered address, the observed one (IP) first
+	Addrs []Address
+}
+
+type GetIPsResponse struct {
+	Entries []IPEntry
+}
+
+///////////////////////////////
+// ClientSubscribe, ClientUnsubscribe, ServerIPChanged
+///////////////////////////////
+
+type SubscribeRequest struct {
+	Skids []string
+}
+
+func (r SubscribeRequest) TargetSkids() []string {
+	return r.Skids
+}
+
+// Pushed by the server, unsolicited, whenever a subscribed SKID registers a new IP
+type IPChangedNotification struct {
+	Entry IPEntry
+}
+
+///////////////////////////////
+// ClientWhoAmI, ServerWhoAmI
+///////////////////////////////
+
+// How the server sees the client on this connection
+type WhoAmIResponse struct {
+	Skid string
+	IP   net.IP
+	Port int
+	// Subject of the client certificate the server verified
+	Subject string
+}
+
+///////////////////////////////
+// ClientGetServices, ServerServices
+///////////////////////////////
+
+// An empty list of SKIDs asks for the services of every daemon the client is
+// authorized to get the IP of. A non-empty Name only returns services by that name.
+type GetServicesRequest struct {
+	Skids []string
+	Name  string `json:",omitempty"`
+}
+
+func (r GetServicesRequest) TargetSkids() []string {
+	return r.Skids
+}
+
+// The services one daemon registered
+type ServicesEntry struct {
+	Skid string
+	// Whether the daemon is connected right now; if not, its services may be down
+	Online   bool
+	Services []ServiceRecord
+}
+
+type GetServicesResponse struct {
+	Entries []ServicesEntry
+}
+
+///////////////////////////////
+// ServerShutdown
+///////////////////////////////
+
+// Pushed by the server, unsolicited, right before it closes the connection
+// because it is shutting down
+type ShutdownNotice struct {
+	Reason string
+	// How long to wait before reconnecting, e.g. for a restart to finish
+	ReconnectAfter time.Duration
+}
+
+///////////////////////////////
+// ClientGrantAuthorization, ClientRevokeAuthorization
+///////////////////////////////
+
+type AuthType int64
+
+const (
+	AuthT_GetIP AuthType = 0
+)
+
+var authTypeName = map[AuthType]string{
+	AuthT_GetIP: "GetIP",
+}
+
+func (at AuthType) String() string {
+	return authTypeName[at]
+}
+
+// The owner of the grant is always the sender, identified by its certificate
+type GrantRequest struct {
+	Other string
+	Type  AuthType
+}
@@ -0,0 +1,144 @@
+package msgs
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		msgT    MessageType
+		payload any
+	}{
+		{T_Ok, OkPayload{Message: "done"}},
+		{T_Err, ErrorPayload{Code: ErrC_NotFound, Message: "no such SKID"}},
+		{T_String, "hello"},
+		{T_DaemonRegister, RegisterRequest{TTL: time.Hour}},
+		{T_ClientGetIPs, GetIPsRequest{Skids: []string{"a", "b"}}},
+		{T_ServerRegistered, RegisterResponse{PingTimeout: time.Minute, ServerTime: 1760659200}},
+		{T_ServerIPs, GetIPsResponse{Entries: []IPEntry{{Skid: "a", UnixTimestampUtc: 1760659200, IP: net.ParseIP("192.0.2.1")}}}},
+		{T_ClientGrantAuthorization, GrantRequest{Other: "b", Type: AuthT_GetIP}},
+		{T_ServerShutdown, ShutdownNotice{Reason: "restart", ReconnectAfter: 5 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.msgT.String(), func(t *testing.T) {
+			msg, err := Marshal(tt.msgT, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != tt.msgT {
+				t.Fatalf("Type = %s, want %s", msg.Type, tt.msgT)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.payload))
+			if err = Unmarshal(msg, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), tt.payload) {
+				t.Fatalf("got %+v, want %+v", got.Elem().Interface(), tt.payload)
+			}
+		})
+	}
+}
+
+func TestMarshalChecksPayloadType(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgT    MessageType
+		payload any
+	}{
+		{"wrong struct", T_ClientGetIPs, GrantRequest{}},
+		{"pointer instead of value", T_ClientGetIPs, &GetIPsRequest{}},
+		{"payload on a type without one", T_ClientWhoAmI, OkPayload{}},
+		{"unregistered type", MessageType(255), OkPayload{}},
+	}
+	for _, tt := range tests {
+		if _, err := Marshal(tt.msgT, tt.payload); err == nil {
+			t.Errorf("%s: Marshal(%s, %T) succeeded", tt.name, tt.msgT, tt.payload)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	t.Run("wrong pointer type", func(t *testing.T) {
+		msg, err := Marshal(T_ClientGetIPs, GetIPsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var grant GrantRequest
+		if err = Unmarshal(msg, &grant); err == nil {
+			t.Fatal("Unmarshal into the wrong type succeeded")
+		}
+	})
+
+	t.Run("empty payload keeps the value", func(t *testing.T) {
+		req := RegisterRequest{TTL: time.Minute}
+		if err := Unmarshal(DaemonRegister(), &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.TTL != time.Minute {
+			t.Fatalf("TTL = %s, want it left at 1m", req.TTL)
+		}
+	})
+
+	t.Run("payload on a type without one", func(t *testing.T) {
+		msg := WhoAmI()
+		msg.Payload = []byte(`{}`)
+		if err := Unmarshal(msg, nil); err == nil {
+			t.Fatal("Unmarshal accepted a payload on ClientWhoAmI")
+		}
+	})
+}
+
+func TestEveryMessageTypeHasAPayloadType(t *testing.T) {
+	for msgT, name := range messageTypeName {
+		if _, ok := payloadTypes[msgT]; !ok {
+			t.Errorf("%s has no entry in payloadTypes", name)
+		}
+	}
+}
+
+func TestPingAt(t *testing.T) {
+	sent := time.Unix(1760659200, 123456789)
+	msg, err := PingAt(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ping PingPayload
+	if err = Unmarshal(msg, &ping); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != T_Ping || ping.SentUnixNano != sent.UnixNano() {
+		t.Fatalf("PingAt = %s stamped %d, want Ping stamped %d", msg.Type, ping.SentUnixNano, sent.UnixNano())
+	}
+}
+
+func TestStringPayload(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         Message
+		wantPayload string
+	}{
+		// The same bytes 1.0.0 peers have always sent and shown
+		{"as is", String("hello there"), "hello there"},
+		{"JSON", StringJSON("hello there"), `"hello there"`},
+		{"as is, looks like JSON", String("42"), "42"},
+	}
+	for _, tt := range tests {
+		if string(tt.msg.Payload) != tt.wantPayload {
+			t.Errorf("%s: payload %q, want %q", tt.name, tt.msg.Payload, tt.wantPayload)
+		}
+		var text string
+		if err := Unmarshal(tt.msg, &text); err != nil {
+			t.Errorf("%s: Unmarshal = %v", tt.name, err)
+			continue
+		}
+		if want := strings.Trim(tt.wantPayload, `"`); text != want {
+			t.Errorf("%s: Unmarshal = %q, want %q", tt.name, text, want)
+		}
+	}
+}
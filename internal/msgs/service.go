@@ -0,0 +1,107 @@
+package msgs
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	Proto_TCP = "tcp"
+	Proto_UDP = "udp"
+)
+
+// Bounds on what a daemon may attach to one record
+const (
+	MaxServiceNameLen     = 63
+	MaxServiceMetadata    = 16
+	MaxServiceMetadataLen = 255
+)
+
+// A named service a daemon can be reached at, e.g. ssh on tcp/2222
+type ServiceRecord struct {
+	// Lowercase letters, digits and '-', unique per Protocol
+	Name     string
+	Protocol string
+	Port     int
+	// Optional, free-form, e.g. {"user": "git"}
+	Metadata map[string]string `json:",omitempty"`
+}
+
+func validServiceName(name string) bool {
+	if name == "" || len(name) > MaxServiceNameLen {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the fields a daemon controls
+func (s ServiceRecord) Validate() error {
+	switch {
+	case !validServiceName(s.Name):
+		return fmt.Errorf("service name %q must be 1-%d lowercase letters, digits or '-'", s.Name, MaxServiceNameLen)
+	case s.Protocol != Proto_TCP && s.Protocol != Proto_UDP:
+		return fmt.Errorf("protocol %q of service %s is neither %s nor %s", s.Protocol, s.Name, Proto_TCP, Proto_UDP)
+	case s.Port < 1 || s.Port > 65535:
+		return fmt.Errorf("port %d of service %s is not in 1-65535", s.Port, s.Name)
+	case len(s.Metadata) > MaxServiceMetadata:
+		return fmt.Errorf("service %s has %d metadata entries, at most %d are allowed", s.Name, len(s.Metadata), MaxServiceMetadata)
+	}
+	for k, v := range s.Metadata {
+		if k == "" || len(k) > MaxServiceMetadataLen || len(v) > MaxServiceMetadataLen {
+			return fmt.Errorf("metadata %q of service %s must have a key of 1-%d bytes and a value of at most %d", k, s.Name, MaxServiceMetadataLen, MaxServiceMetadataLen)
+		}
+	}
+	return nil
+}
+
+// name=protocol/port, optionally followed by ,key=value pairs,
+// e.g. ssh=tcp/2222,user=git
+func ParseService(str string) (s ServiceRecord, err error) {
+	fields := strings.Split(str, ",")
+
+	name, protoPort, ok := strings.Cut(fields[0], "=")
+	if !ok {
+		return s, fmt.Errorf("service %q: expected name=protocol/port", str)
+	}
+	proto, port, ok := strings.Cut(protoPort, "/")
+	if !ok {
+		return s, fmt.Errorf("service %q: expected name=protocol/port", str)
+	}
+	s.Name, s.Protocol = name, proto
+	if s.Port, err = strconv.Atoi(port); err != nil {
+		return s, fmt.Errorf("service %q: bad port %q", str, port)
+	}
+
+	for _, field := range fields[1:] {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return s, fmt.Errorf("service %q: expected key=value, got %q", str, field)
+		}
+		if s.Metadata == nil {
+			s.Metadata = map[string]string{}
+		}
+		s.Metadata[k] = v
+	}
+	return s, s.Validate()
+}
+
+func (s ServiceRecord) String() string {
+	keys := make([]string, 0, len(s.Metadata))
+	for k := range s.Metadata {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	str := fmt.Sprintf("%s=%s/%d", s.Name, s.Protocol, s.Port)
+	for _, k := range keys {
+		str += "," + k + "=" + s.Metadata[k]
+	}
+	return str
+}
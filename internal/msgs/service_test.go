@@ -0,0 +1,85 @@
+package msgs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseService(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ServiceRecord
+		wantErr bool
+	}{
+		{in: "ssh=tcp/22", want: ServiceRecord{Name: "ssh", Protocol: Proto_TCP, Port: 22}},
+		{in: "wireguard=udp/51820", want: ServiceRecord{Name: "wireguard", Protocol: Proto_UDP, Port: 51820}},
+		{
+			in:   "git-ssh=tcp/2222,user=git,host=forge",
+			want: ServiceRecord{Name: "git-ssh", Protocol: Proto_TCP, Port: 2222, Metadata: map[string]string{"user": "git", "host": "forge"}},
+		},
+		{in: "ssh", wantErr: true},
+		{in: "ssh=tcp", wantErr: true},
+		{in: "ssh=tcp/ssh", wantErr: true},
+		{in: "ssh=sctp/22", wantErr: true},
+		{in: "ssh=tcp/0", wantErr: true},
+		{in: "ssh=tcp/65536", wantErr: true},
+		{in: "SSH=tcp/22", wantErr: true},
+		{in: "ssh_alt=tcp/22", wantErr: true},
+		{in: "ssh=tcp/22,user", wantErr: true},
+		{in: "ssh=tcp/22,=git", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseService(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseService(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseService(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if back, err := ParseService(got.String()); err != nil || !reflect.DeepEqual(back, got) {
+			t.Errorf("ParseService(%q) = %+v, %v, want it to round trip", got.String(), back, err)
+		}
+	}
+}
+
+func TestServiceRecordValidate(t *testing.T) {
+	valid := ServiceRecord{Name: "ssh", Protocol: Proto_TCP, Port: 22}
+	metadata := func(n int, keyLen int, valueLen int) map[string]string {
+		m := make(map[string]string, n)
+		for i := range n {
+			key := fmt.Sprint(i) + strings.Repeat("k", keyLen-len(fmt.Sprint(i)))
+			m[key] = strings.Repeat("v", valueLen)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(s *ServiceRecord)
+		wantErr bool
+	}{
+		{"valid", func(s *ServiceRecord) {}, false},
+		{"longest name", func(s *ServiceRecord) { s.Name = strings.Repeat("a", MaxServiceNameLen) }, false},
+		{"name too long", func(s *ServiceRecord) { s.Name = strings.Repeat("a", MaxServiceNameLen+1) }, true},
+		{"no name", func(s *ServiceRecord) { s.Name = "" }, true},
+		{"no protocol", func(s *ServiceRecord) { s.Protocol = "" }, true},
+		{"no port", func(s *ServiceRecord) { s.Port = 0 }, true},
+		{"most metadata", func(s *ServiceRecord) { s.Metadata = metadata(MaxServiceMetadata, 8, MaxServiceMetadataLen) }, false},
+		{"too much metadata", func(s *ServiceRecord) { s.Metadata = metadata(MaxServiceMetadata+1, 8, 1) }, true},
+		{"metadata key too long", func(s *ServiceRecord) { s.Metadata = metadata(1, MaxServiceMetadataLen+1, 1) }, true},
+		{"metadata value too long", func(s *ServiceRecord) { s.Metadata = metadata(1, 8, MaxServiceMetadataLen+1) }, true},
+	}
+	for _, tt := range tests {
+		s := valid
+		tt.modify(&s)
+		if err := s.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
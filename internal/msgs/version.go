@@ -0,0 +1,152 @@
+package msgs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Range of protocol versions this build can speak; advertised in Hello
+var (
+	MinSupportedVersion ProtocolVersion = Version_1_0_0
+	MaxSupportedVersion ProtocolVersion = Version_1_1_0
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+var protocolVersionName = map[ProtocolVersion]string{
+	Version_1_0_0: "1.0.0",
+	Version_1_1_0: "1.1.0",
+}
+
+func (v ProtocolVersion) String() string {
+	if name, ok := protocolVersionName[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(v))
+}
+
+// Picks the highest version in both ranges
+func NegotiateVersion(
+	peerMin ProtocolVersion,
+	peerMax ProtocolVersion,
+) (version ProtocolVersion, err error) {
+	lo, hi := max(peerMin, MinSupportedVersion), min(peerMax, MaxSupportedVersion)
+	if lo > hi {
+		return version, fmt.Errorf(
+			"[ERROR] Peer supports versions [%s, %s], but only [%s, %s] are supported: %w",
+			peerMin, peerMax, MinSupportedVersion, MaxSupportedVersion, ErrUnsupportedVersion)
+	}
+	return hi, err
+}
+
+// Fields the negotiated version doesn't know about are dropped
+func stampVersion(msg *Message, version ProtocolVersion) {
+	msg.Version = version
+	if version < Version_1_1_0 {
+		msg.RequestId = 0
+		msg.ReplyTo = 0
+	}
+}
+
+func checkVersion(msg Message, version ProtocolVersion) (err error) {
+	if msg.Version != version {
+		return fmt.Errorf("[ERROR] Received %s message with version %s, but negotiated %s: %w", msg.Type, msg.Version, version, ErrUnsupportedVersion)
+	}
+	return
+}
+
+// Client side of the version handshake: sends Hello and waits up to `timeout` for the HelloAck
+func Handshake(m Messenger, timeout time.Duration) (version ProtocolVersion, err error) {
+	hello, err := Marshal(T_Hello, HelloPayload{MinVersion: MinSupportedVersion, MaxVersion: MaxSupportedVersion})
+	if err != nil {
+		return
+	}
+	// Every server can read a 1.0.0 frame
+	hello.Version = Version_1_0_0
+	if err = m.Send(hello); err != nil {
+		return
+	}
+
+	if err = m.SetReadTimeout(timeout); err != nil {
+		return
+	}
+	recvMsg, err := m.Receive()
+	if err != nil {
+		return
+	}
+	if err = m.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	switch recvMsg.Type {
+	case T_HelloAck:
+		break
+	case T_Err:
+		var reason ErrorPayload
+		if err = Unmarshal(recvMsg, &reason); err != nil {
+			return
+		}
+		return version, fmt.Errorf("[ERROR] Server rejected the version handshake\n\t- %w\n", reason)
+	default:
+		return version, fmt.Errorf("[ERROR] Expected the server to respond with MessageType HelloAck, but got %s\n", recvMsg.Type)
+	}
+
+	var ack HelloAckPayload
+	if err = Unmarshal(recvMsg, &ack); err != nil {
+		return
+	}
+	if ack.Version < MinSupportedVersion || ack.Version > MaxSupportedVersion {
+		return version, fmt.Errorf("[ERROR] Server picked version %s: %w", ack.Version, ErrUnsupportedVersion)
+	}
+
+	m.SetVersion(ack.Version)
+	return ack.Version, err
+}
+
+// Server side of the version handshake: waits up to `timeout` for a Hello, then answers with HelloAck or Err
+func AcceptHandshake(m Messenger, timeout time.Duration) (version ProtocolVersion, err error) {
+	if err = m.SetReadTimeout(timeout); err != nil {
+		return
+	}
+	recvMsg, err := m.Receive()
+	if err != nil {
+		return
+	}
+	if err = m.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	if recvMsg.Type != T_Hello {
+		err = fmt.Errorf("[ERROR] Expected the client to open with MessageType Hello, but got %s\n", recvMsg.Type)
+		return version, errors.Join(err, sendHandshakeError(m, ErrC_BadRequest, err))
+	}
+
+	var hello HelloPayload
+	if err = Unmarshal(recvMsg, &hello); err != nil {
+		return version, errors.Join(err, sendHandshakeError(m, ErrC_BadRequest, err))
+	}
+
+	version, err = NegotiateVersion(hello.MinVersion, hello.MaxVersion)
+	if err != nil {
+		return version, errors.Join(err, sendHandshakeError(m, ErrC_UnsupportedVersion, err))
+	}
+
+	ack, err := Marshal(T_HelloAck, HelloAckPayload{Version: version})
+	if err != nil {
+		return
+	}
+	m.SetVersion(version)
+	err = m.Send(ack)
+	return
+}
+
+func sendHandshakeError(m Messenger, code ErrorCode, reason error) (err error) {
+	errMsg, err := ErrorMessage(code, reason.Error())
+	if err != nil {
+		return
+	}
+	// Nothing was negotiated, so answer in a frame every client can read
+	errMsg.Version = Version_1_0_0
+	return m.Send(errMsg)
+}
@@ -0,0 +1,117 @@
+package msgs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		peerMin ProtocolVersion
+		peerMax ProtocolVersion
+		want    ProtocolVersion
+		wantErr bool
+	}{
+		{"same range", Version_1_0_0, Version_1_1_0, Version_1_1_0, false},
+		{"older peer", Version_1_0_0, Version_1_0_0, Version_1_0_0, false},
+		{"newer peer", Version_1_0_0, ProtocolVersion(9), Version_1_1_0, false},
+		{"only newer", ProtocolVersion(8), ProtocolVersion(9), 0, true},
+		{"empty range", Version_1_1_0, Version_1_0_0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := NegotiateVersion(tt.peerMin, tt.peerMax)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("%s: err = %v, want ErrUnsupportedVersion", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: NegotiateVersion(%s, %s) = %s, %v, want %s", tt.name, tt.peerMin, tt.peerMax, got, err, tt.want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	clientConn, serverConn := tlsPipe(t)
+	client := NewMessenger(clientConn)
+	server := NewMessenger(serverConn)
+
+	accepted := make(chan ProtocolVersion, 1)
+	go func() {
+		version, err := AcceptHandshake(server, time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- version
+	}()
+
+	version, err := Handshake(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != MaxSupportedVersion || <-accepted != version {
+		t.Fatalf("negotiated %s, want %s on both ends", version, MaxSupportedVersion)
+	}
+	for name, m := range map[string]Messenger{"client": client, "server": server} {
+		if got, negotiated := m.Version(); !negotiated || got != version {
+			t.Errorf("%s Version() = %s, %v, want %s, true", name, got, negotiated, version)
+		}
+	}
+}
+
+func TestAcceptHandshakeRefuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      func(t *testing.T) Message
+		wantCode ErrorCode
+	}{
+		{
+			name:     "no Hello first",
+			msg:      func(t *testing.T) Message { return Ping() },
+			wantCode: ErrC_BadRequest,
+		},
+		{
+			name: "no common version",
+			msg: func(t *testing.T) Message {
+				hello, err := Marshal(T_Hello, HelloPayload{MinVersion: 8, MaxVersion: 9})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return hello
+			},
+			wantCode: ErrC_UnsupportedVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := tlsPipe(t)
+			client := NewMessenger(clientConn)
+			server := NewMessenger(serverConn)
+
+			msg := tt.msg(t)
+			msg.Version = Version_1_0_0
+			if err := client.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := AcceptHandshake(server, time.Second); err == nil {
+				t.Fatal("AcceptHandshake succeeded")
+			}
+
+			reply, err := client.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reason ErrorPayload
+			if err = Unmarshal(reply, &reason); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Type != T_Err || reason.Code != tt.wantCode {
+				t.Fatalf("got %s %+v, want Err %s", reply.Type, reason, tt.wantCode)
+			}
+		})
+	}
+}
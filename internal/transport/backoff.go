@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jittered exponential backoff. Each delay is picked uniformly from
+// [d/2, d], where d starts at Min and doubles up to Max, so that many peers
+// failing at once do not retry in lockstep. The zero value is not usable.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	if max < min {
+		max = min
+	}
+	return &Backoff{Min: min, Max: max}
+}
+
+// Returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Number of delays handed out since the last Reset
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+// Starts over from Min, e.g. after a connection succeeded
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
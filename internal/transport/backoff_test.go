@@ -0,0 +1,42 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(100*time.Millisecond, time.Second)
+
+	// Upper bound of each delay, doubling up to Max
+	bounds := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, max := range bounds {
+		if got := b.Next(); got < max/2 || got > max {
+			t.Errorf("delay %d = %s, want within [%s, %s]", i, got, max/2, max)
+		}
+		if b.Attempt() != i+1 {
+			t.Errorf("Attempt() = %d after %d delays", b.Attempt(), i+1)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got > 100*time.Millisecond {
+		t.Errorf("delay after Reset = %s, want at most Min", got)
+	}
+}
+
+func TestNewBackoffMaxUnderMin(t *testing.T) {
+	b := NewBackoff(time.Second, time.Millisecond)
+	for range 5 {
+		if got := b.Next(); got < 500*time.Millisecond || got > time.Second {
+			t.Fatalf("delay = %s, want Max raised to Min", got)
+		}
+	}
+}
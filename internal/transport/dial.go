@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+type DialConfig struct {
+	// host:port of the server, IPv6 hosts in brackets
+	Addr string
+	TLS  *tls.Config
+	// Name sent as SNI and checked against the server certificate.
+	// Defaults to TLS.ServerName, then to the host of Addr.
+	ServerName string
+	// Max time for one attempt to connect and complete the TLS handshake
+	HandshakeTimeout time.Duration
+	// Attempts made after the first one fails, waiting RetryDelay between each
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// Connects to the server and completes the TLS handshake, retrying failed
+// attempts up to cfg.Retries times. Certificate errors are not retried,
+// since they fail the same way every time.
+func Dial(ctx context.Context, cfg DialConfig) (conn *tls.Conn, err error) {
+	if cfg.TLS == nil {
+		return nil, errors.New("transport: DialConfig.TLS is nil")
+	}
+	config := cfg.TLS.Clone()
+	if cfg.ServerName != "" {
+		config.ServerName = cfg.ServerName
+	}
+	timeout := cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config:    config,
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err = dialOnce(ctx, dialer, cfg.Addr, timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= cfg.Retries || !isRetryable(err) || ctx.Err() != nil {
+			return nil, fmt.Errorf("dial %s: %w", cfg.Addr, err)
+		}
+
+		log.Printf("[INFO] Failed to connect to %s, retrying in %s (%d/%d)\n\t- Reason: %v\n", cfg.Addr, cfg.RetryDelay, attempt+1, cfg.Retries, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dial %s: %w", cfg.Addr, ctx.Err())
+		case <-time.After(cfg.RetryDelay):
+		}
+	}
+}
+
+func dialOnce(ctx context.Context, dialer *tls.Dialer, addr string, timeout time.Duration) (conn *tls.Conn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	netconn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return netconn.(*tls.Conn), nil
+}
+
+func isRetryable(err error) bool {
+	var (
+		verifyErr *tls.CertificateVerificationError
+		alertErr  tls.AlertError
+	)
+	return !errors.As(err, &verifyErr) && !errors.As(err, &alertErr)
+}
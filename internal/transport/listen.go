@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type ListenConfig struct {
+	// host:port to listen on, IPv6 hosts in brackets
+	Addr string
+	TLS  *tls.Config
+	// Max time a new connection has to complete the TLS handshake
+	HandshakeTimeout time.Duration
+	// Max handshakes in progress at once; further connections wait in the
+	// kernel's backlog. Zero for DefaultMaxPendingHandshakes.
+	MaxPendingHandshakes int
+	// If set, called on every new connection before its handshake. An error
+	// closes the connection right away; otherwise `release`, if not nil, runs
+	// once it is closed.
+	Admit func(conn net.Conn) (release func(), err error)
+}
+
+const DefaultMaxPendingHandshakes = 128
+
+// Bounds on the delay after a failed Accept, e.g. when out of file descriptors
+const (
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
+)
+
+// Hands out connections only once their TLS handshake has completed.
+// Handshakes run concurrently, so a slow peer does not hold up the others.
+type Listener struct {
+	ln      net.Listener
+	tls     *tls.Config
+	admit   func(conn net.Conn) (release func(), err error)
+	timeout time.Duration
+	conns   chan *tls.Conn
+	// One token per handshake in progress
+	pending chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen(cfg ListenConfig) (l *Listener, err error) {
+	if cfg.TLS == nil {
+		return nil, errors.New("transport: ListenConfig.TLS is nil")
+	}
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	maxPending := cfg.MaxPendingHandshakes
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPendingHandshakes
+	}
+	l = &Listener{
+		ln:      ln,
+		tls:     cfg.TLS,
+		admit:   cfg.Admit,
+		timeout: timeout,
+		conns:   make(chan *tls.Conn),
+		pending: make(chan struct{}, maxPending),
+		done:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Blocks until a client completes its handshake. Returns net.ErrClosed once
+// the Listener is closed.
+func (l *Listener) Accept() (conn *tls.Conn, err error) {
+	select {
+	case conn = <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.ln.Close()
+	})
+	return
+}
+
+// Backs off after failed Accepts instead of spinning on them
+func (l *Listener) acceptLoop() {
+	backoff := NewBackoff(acceptRetryMin, acceptRetryMax)
+	for {
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.done:
+			return
+		}
+
+		netconn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			l.Close()
+			return
+		}
+		if err != nil {
+			<-l.pending
+			delay := backoff.Next()
+			log.Printf("[ERROR] Failed to accept connection on %s, retrying in %s\n\t- %v\n", l.ln.Addr(), delay.Round(time.Millisecond), err)
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+
+		if l.admit != nil {
+			release, err := l.admit(netconn)
+			if err != nil {
+				log.Println("[ERROR] Refused connection from", netconn.RemoteAddr(), "\n\t-", err)
+				netconn.Close()
+				<-l.pending
+				continue
+			}
+			if release != nil {
+				netconn = &admittedConn{Conn: netconn, release: release}
+			}
+		}
+
+		go l.handshake(tls.Server(netconn, l.tls))
+	}
+}
+
+// Runs the `release` given by ListenConfig.Admit on the first Close
+type admittedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *admittedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (l *Listener) handshake(conn *tls.Conn) {
+	err := Handshake(conn, l.timeout)
+	<-l.pending
+	if err != nil {
+		log.Println("[ERROR] Failed TLS handshake for", conn.RemoteAddr(), ".\n\t- Reason:", err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
@@ -0,0 +1,88 @@
+// Package transport sets up the mTLS connections that a msgs.Messenger runs
+// over, for both ends: Dial for client and clientd, Listen for the server.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Referencing https://smallstep.com/hello-mtls/doc/combined/go/go
+// Referencing https://gist.github.com/denji/12b3a568f092ab951456
+func ClientTLSConfig(certPath string, keyPath string, rootCAPaths ...string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cert %s, key %s: %w", certPath, keyPath, err)
+	}
+	rootCAs, err := LoadCertPool(rootCAPaths...)
+	if err != nil {
+		return nil, err
+	}
+
+	config = &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}
+	return config, nil
+}
+
+// Requires every client to present a certificate signed by one of `clientCAPaths`
+func ServerTLSConfig(certPath string, keyPath string, clientCAPaths ...string) (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cert %s, key %s: %w", certPath, keyPath, err)
+	}
+	clientCAs, err := LoadCertPool(clientCAPaths...)
+	if err != nil {
+		return nil, err
+	}
+
+	config = &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	return config, nil
+}
+
+// Reads PEM bundles into one pool. A bundle without any certificate is an
+// error, since it is almost always the wrong file.
+func LoadCertPool(paths ...string) (pool *x509.CertPool, err error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no CA bundles given")
+	}
+
+	pool = x509.NewCertPool()
+	for _, path := range paths {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// Eagerly runs the TLS handshake, which is normally performed lazily, so a
+// bad peer fails fast instead of on the first message
+func Handshake(conn *tls.Conn, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err = conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
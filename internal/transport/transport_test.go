@@ -0,0 +1,335 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for localhost, good as a server
+// certificate, a client certificate and the CA of both
+func writeCertificate(t *testing.T, name string) (certPath string, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func testListener(t *testing.T, certPath string, keyPath string) *Listener {
+	t.Helper()
+	config, err := ServerTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Listen(ListenConfig{Addr: "127.0.0.1:0", TLS: config, HandshakeTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func acceptAsync(ln *Listener) (conns chan *tls.Conn, errs chan error) {
+	conns, errs = make(chan *tls.Conn, 1), make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		conns <- conn
+		errs <- err
+	}()
+	return
+}
+
+func TestListenDial(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "peer")
+	ln := testListener(t, certPath, keyPath)
+	conns, errs := acceptAsync(ln)
+
+	config, err := ClientTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(context.Background(), DialConfig{Addr: ln.Addr().String(), TLS: config, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := <-conns
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Accept only hands out connections whose handshake is complete
+	state := server.ConnectionState()
+	if !state.HandshakeComplete || len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "peer" {
+		t.Fatalf("server sees handshake complete %v with %d peer certificates", state.HandshakeComplete, len(state.PeerCertificates))
+	}
+
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+}
+
+func TestDialDoesNotRetryCertificateErrors(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "server")
+	otherCertPath, otherKeyPath := writeCertificate(t, "other")
+	ln := testListener(t, certPath, keyPath)
+
+	// Trusts a CA the server certificate was not signed by
+	config, err := ClientTLSConfig(otherCertPath, otherKeyPath, otherCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = Dial(context.Background(), DialConfig{
+		Addr:       ln.Addr().String(),
+		TLS:        config,
+		ServerName: "localhost",
+		Retries:    3,
+		RetryDelay: time.Minute,
+	})
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("Dial = %v, want a CertificateVerificationError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Fatalf("Dial took %s, so it retried", elapsed)
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "peer")
+	config, err := ClientTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on the port once this is closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		retries int
+		ctx     func() context.Context
+	}{
+		{"no retries", 0, context.Background},
+		{"retries", 2, context.Background},
+		{"cancelled", 5, func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Dial(tt.ctx(), DialConfig{Addr: addr, TLS: config, Retries: tt.retries, RetryDelay: time.Millisecond})
+			if err == nil {
+				t.Fatal("Dial succeeded with nothing listening")
+			}
+		})
+	}
+}
+
+func TestListenerSurvivesFailedHandshakes(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "peer")
+	ln := testListener(t, certPath, keyPath)
+
+	// Not TLS at all
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err = raw.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conns, errs := acceptAsync(ln)
+	config, err := ClientTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(context.Background(), DialConfig{Addr: ln.Addr().String(), TLS: config, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := <-conns
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+}
+
+func TestListenerClose(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "peer")
+	ln := testListener(t, certPath, keyPath)
+	conns, errs := acceptAsync(ln)
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-conns
+	if err := <-errs; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept = %v, want net.ErrClosed", err)
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatalf("second Close = %v", err)
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	certPath, _ := writeCertificate(t, "peer")
+	notPem := filepath.Join(t.TempDir(), "not.pem")
+	if err := os.WriteFile(notPem, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{"one bundle", []string{certPath}, false},
+		{"none", nil, true},
+		{"missing file", []string{filepath.Join(t.TempDir(), "missing.pem")}, true},
+		{"no certificates", []string{certPath, notPem}, true},
+	}
+	for _, tt := range tests {
+		if _, err := LoadCertPool(tt.paths...); (err != nil) != tt.wantErr {
+			t.Errorf("%s: LoadCertPool = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestListenAdmit(t *testing.T) {
+	certPath, keyPath := writeCertificate(t, "peer")
+	serverConfig, err := ServerTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		admit bool
+	}{
+		{"admitted", true},
+		{"refused", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			released := make(chan struct{})
+			ln, err := Listen(ListenConfig{
+				Addr:             "127.0.0.1:0",
+				TLS:              serverConfig,
+				HandshakeTimeout: time.Second,
+				Admit: func(conn net.Conn) (release func(), err error) {
+					if !tt.admit {
+						return nil, errors.New("over the cap")
+					}
+					return func() { close(released) }, nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			conns, errs := acceptAsync(ln)
+
+			client, err := Dial(context.Background(), DialConfig{Addr: ln.Addr().String(), TLS: clientConfig, ServerName: "localhost"})
+			if !tt.admit {
+				// Closed before the handshake, so it never reaches Accept
+				if err == nil {
+					client.Close()
+					t.Fatal("Dial succeeded on a refused connection")
+				}
+				select {
+				case conn := <-conns:
+					t.Fatalf("Accept handed out refused connection %v", conn.RemoteAddr())
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			server := <-conns
+			if err = <-errs; err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-released:
+				t.Fatal("released before the connection closed")
+			default:
+			}
+			server.Close()
+			select {
+			case <-released:
+			case <-time.After(time.Second):
+				t.Fatal("not released once the connection closed")
+			}
+		})
+	}
+}